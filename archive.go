@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The file in an archive which lists what has been fetched
+const archiveIndexFile = "index.ndjson"
+
+// An Archive keeps the raw bodies of pages which have been fetched, so that
+// they can be parsed again without fetching them. Bodies are stored gzipped
+// and named by their SHA-256 (so a page which hasn't changed is only stored
+// once), and the index lists each fetch. A request other than a GET (such as
+// a POST of a form) is archived along with its method and a hash of its body,
+// apart from a GET of the same URL:
+//
+//	archive/index.ndjson
+//	archive/objects/3f/3f1b...e2.gz
+type Archive struct {
+	dir string
+
+	mu     sync.Mutex
+	latest map[string]ArchiveEntry
+}
+
+// ArchiveEntry is a page which was fetched, and where its body is. The method
+// and the hash of the body of the request are only set for requests other
+// than a GET
+type ArchiveEntry struct {
+	Method        string      `json:"method,omitempty"`
+	URL           string      `json:"url"`
+	RequestSHA256 string      `json:"requestSha256,omitempty"`
+	SHA256        string      `json:"sha256"`
+	FetchedAt     time.Time   `json:"fetchedAt"`
+	StatusCode    int         `json:"status,omitempty"`
+	Header        http.Header `json:"header,omitempty"`
+}
+
+// The key of an entry, which is what its request is keyed on
+func (e ArchiveEntry) key() string {
+	return exchangeKey(e.Method, e.URL, e.RequestSHA256)
+}
+
+// The key of what is archived for a request. A GET is the URL alone, like the
+// name of its fixture (see fixtureFile), others have the method and the hash
+// of the body too
+func requestKey(req *Request) string {
+	if req.plain() {
+		return req.URL
+	}
+	sum := sha256.Sum256([]byte(req.Body))
+	return exchangeKey(req.method(), req.URL, hex.EncodeToString(sum[:]))
+}
+
+// The key of a request by its method, URL and the hash of its body, where the
+// method is empty for a GET
+func exchangeKey(method, url, bodySum string) string {
+	if method == "" {
+		return url
+	}
+	return method + " " + url + "\n" + bodySum
+}
+
+// OpenArchive opens the archive in a directory, creating it if needed
+func OpenArchive(dir string) (*Archive, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "objects"), 0755); err != nil {
+		return nil, fmt.Errorf("could not create archive: %s", err)
+	}
+	a := &Archive{
+		dir:    dir,
+		latest: make(map[string]ArchiveEntry),
+	}
+
+	f, err := os.Open(filepath.Join(dir, archiveIndexFile))
+	if os.IsNotExist(err) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not open archive index: %s", err)
+	}
+	defer f.Close()
+
+	decoder := json.NewDecoder(bufio.NewReader(f))
+	for {
+		var entry ArchiveEntry
+		err := decoder.Decode(&entry)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not decode archive index: %s", err)
+		}
+		if latest, found := a.latest[entry.key()]; !found || !entry.FetchedAt.Before(latest.FetchedAt) {
+			a.latest[entry.key()] = entry
+		}
+	}
+	return a, nil
+}
+
+// Put stores a response in the archive
+func (a *Archive) Put(resp *Response) (ArchiveEntry, error) {
+	return a.PutExchange(&Request{URL: resp.URL}, resp)
+}
+
+// PutExchange is Put for the response to any request, which is stored along
+// with its method and the hash of its body
+func (a *Archive) PutExchange(req *Request, resp *Response) (ArchiveEntry, error) {
+	sum := sha256.Sum256([]byte(resp.Body))
+	entry := ArchiveEntry{
+		URL:        resp.URL,
+		SHA256:     hex.EncodeToString(sum[:]),
+		FetchedAt:  time.Now().UTC(),
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+	}
+	if !req.plain() {
+		requestSum := sha256.Sum256([]byte(req.Body))
+		entry.Method = req.method()
+		entry.RequestSHA256 = hex.EncodeToString(requestSum[:])
+	}
+
+	if err := a.writeObject(entry.SHA256, resp.Body); err != nil {
+		return entry, err
+	}
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return entry, fmt.Errorf("could not encode archive entry: %s", err)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	f, err := os.OpenFile(filepath.Join(a.dir, archiveIndexFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return entry, fmt.Errorf("could not open archive index: %s", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		return entry, fmt.Errorf("could not write archive index: %s", err)
+	}
+	a.latest[entry.key()] = entry
+	return entry, nil
+}
+
+// The path of the object for a hash
+func (a *Archive) objectPath(sum string) string {
+	return filepath.Join(a.dir, "objects", sum[:2], sum+".gz")
+}
+
+// Writes a body unless it is already stored. It is written to a temporary
+// file first, so that a partly written object is never seen
+func (a *Archive) writeObject(sum, body string) error {
+	path := a.objectPath(sum)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("could not create archive directory: %s", err)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "tmp")
+	if err != nil {
+		return fmt.Errorf("could not create archive object: %s", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	gz := gzip.NewWriter(tmp)
+	if _, err := io.WriteString(gz, body); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not write archive object: %s", err)
+	}
+	if err := gz.Close(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not write archive object: %s", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("could not write archive object: %s", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("could not write archive object: %s", err)
+	}
+	return nil
+}
+
+// Entries returns the latest entry for each request in the archive, in order
+// of URL and then method
+func (a *Archive) Entries() []ArchiveEntry {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	entries := make([]ArchiveEntry, 0, len(a.latest))
+	for _, entry := range a.latest {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].URL != entries[j].URL {
+			return entries[i].URL < entries[j].URL
+		}
+		return entries[i].key() < entries[j].key()
+	})
+	return entries
+}
+
+// Do returns the latest response archived for the request, so that an
+// Archive can be used as a WebReader which never touches the network
+func (a *Archive) Do(req *Request) (*Response, error) {
+	a.mu.Lock()
+	entry, found := a.latest[requestKey(req)]
+	a.mu.Unlock()
+	if !found {
+		if !req.plain() {
+			return nil, fmt.Errorf("%s %s with that body is not in the archive", req.method(), req.URL)
+		}
+		return nil, fmt.Errorf("%s is not in the archive", req.URL)
+	}
+	url := req.URL
+
+	f, err := os.Open(a.objectPath(entry.SHA256))
+	if err != nil {
+		return nil, fmt.Errorf("could not open archived %s: %s", url, err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("could not read archived %s: %s", url, err)
+	}
+	body, err := ioutil.ReadAll(gz)
+	if err != nil {
+		return nil, fmt.Errorf("could not read archived %s: %s", url, err)
+	}
+
+	return &Response{
+		URL:        url,
+		StatusCode: entry.StatusCode,
+		Header:     entry.Header,
+		Body:       string(body),
+	}, nil
+}
+
+// GetResponse returns the latest response archived for the URL
+func (a *Archive) GetResponse(url string) (*Response, error) {
+	return a.Do(&Request{URL: url})
+}
+
+// GetBody returns the latest body archived for the URL
+func (a *Archive) GetBody(url string) (string, error) {
+	resp, err := a.GetResponse(url)
+	if err != nil {
+		return "", err
+	}
+	return resp.Body, nil
+}
+
+// ArchiveReader is a WebReader which archives every page that another one
+// fetches
+type ArchiveReader struct {
+	WebReader
+	archive *Archive
+}
+
+// NewArchiveReader returns a reader which archives what webReader fetches
+func NewArchiveReader(webReader WebReader, archive *Archive) *ArchiveReader {
+	return &ArchiveReader{
+		WebReader: webReader,
+		archive:   archive,
+	}
+}
+
+// Do makes the request and archives the page. A page which can't be archived
+// is still returned, as the scrape can carry on without it
+func (a *ArchiveReader) Do(req *Request) (*Response, error) {
+	resp, err := doRequest(a.WebReader, req)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := a.archive.PutExchange(req, resp); err != nil {
+		log.Printf("[Warning] Could not archive %s: %s", req.URL, err)
+	}
+	return resp, nil
+}
+
+// GetResponse fetches the page and archives it
+func (a *ArchiveReader) GetResponse(url string) (*Response, error) {
+	return a.Do(&Request{URL: url})
+}
+
+// GetBody fetches the body of the page and archives it
+func (a *ArchiveReader) GetBody(url string) (string, error) {
+	resp, err := a.GetResponse(url)
+	if err != nil {
+		return "", err
+	}
+	return resp.Body, nil
+}
+
+// GetStream opens the body of the page, and archives it once all of it has
+// been read
+func (a *ArchiveReader) GetStream(url string) (*Stream, error) {
+	stream, err := getStream(a.WebReader, url)
+	if err != nil {
+		return nil, err
+	}
+	return watchStream(stream, true, func(resp *Response) {
+		if resp == nil {
+			return
+		}
+		if _, err := a.archive.Put(resp); err != nil {
+			log.Printf("[Warning] Could not archive %s: %s", url, err)
+		}
+	}), nil
+}
+
+// Streams when the other reader can
+func (a *ArchiveReader) streams(url string) bool {
+	return canStream(a.WebReader, url)
+}
+
+// Archives every page which is fetched for the profiles
+func archiveProfiles(profiles []*Profile, archive *Archive) {
+	for _, p := range profiles {
+		p.webReader = NewArchiveReader(p.WebReader(), archive)
+	}
+}
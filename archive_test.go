@@ -0,0 +1,193 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	archive, err := OpenArchive(dir)
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+
+	reader := NewArchiveReader(mapReader{
+		"http://example.com/a": "<path>a.jpg</path>",
+		"http://example.com/b": "<path>a.jpg</path>",
+	}, archive)
+	for _, url := range []string{"http://example.com/a", "http://example.com/b"} {
+		if _, err := reader.GetBody(url); err != nil {
+			t.Fatalf("Did not expect to receive an error, got %s", err)
+		}
+	}
+	if _, err := archive.Put(&Response{
+		URL:        "http://example.com/a",
+		StatusCode: 200,
+		Header:     http.Header{"Content-Type": {"text/html"}},
+		Body:       "<path>changed.jpg</path>",
+	}); err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+
+	// The same body is only stored once
+	objects, _ := filepath.Glob(filepath.Join(dir, "objects", "*", "*.gz"))
+	if len(objects) != 2 {
+		t.Errorf("Expected 2 objects, got %v", objects)
+	}
+
+	// The latest of each URL is used, after opening it again too
+	archive, err = OpenArchive(dir)
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	entries := archive.Entries()
+	if len(entries) != 2 || entries[0].URL != "http://example.com/a" || entries[1].URL != "http://example.com/b" {
+		t.Fatalf("Expected an entry for each URL, got %+v", entries)
+	}
+	resp, err := archive.GetResponse("http://example.com/a")
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	expected := &Response{
+		URL:        "http://example.com/a",
+		StatusCode: 200,
+		Header:     http.Header{"Content-Type": {"text/html"}},
+		Body:       "<path>changed.jpg</path>",
+	}
+	if !reflect.DeepEqual(resp, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, resp)
+	}
+	if _, err := archive.GetBody("http://example.com/c"); err == nil {
+		t.Errorf("Expected a URL which isn't archived to fail")
+	}
+}
+
+func TestReparse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reparse")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	archive, err := OpenArchive(filepath.Join(dir, "archive"))
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	for url, body := range map[string]string{
+		"http://example.com/fruit": "<path>apricot.jpg</path><path>kiwi.jpg</path> EOF",
+		"http://example.com/veg":   "<path>carrot.jpg</path> EOF",
+		"http://other.com/":        "<path>other.jpg</path> EOF",
+	} {
+		if _, err := archive.Put(&Response{URL: url, Body: body}); err != nil {
+			t.Fatalf("Did not expect to receive an error, got %s", err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "path.definition"), []byte("<path>{{path}}</path>"), 0644); err != nil {
+		t.Fatalf("failed to write definition: %s", err)
+	}
+
+	out := filepath.Join(dir, "out.ndjson")
+	err = reparseCommand([]string{
+		"-archive", filepath.Join(dir, "archive"),
+		"-definition", filepath.Join(dir, "path.definition"),
+		"-url", "http://example.com/*",
+		"-sink", "ndjson:" + out,
+	})
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+
+	records, err := readNDJSON(out)
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	paths := make(map[interface{}]bool)
+	for _, record := range records {
+		paths[record["path"]] = true
+	}
+	expected := map[interface{}]bool{"apricot.jpg": true, "kiwi.jpg": true, "carrot.jpg": true}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("Expected %v, got %v", expected, paths)
+	}
+}
+
+func TestReparsePost(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reparse")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A search page which gives one thing to a GET and another to a POST
+	archive, err := OpenArchive(filepath.Join(dir, "archive"))
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	url := "http://example.com/search"
+	post := &Request{Method: "POST", URL: url, Body: "q=apricot"}
+	if _, err := archive.Put(&Response{URL: url, Body: "<path>form.jpg</path> EOF"}); err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	if _, err := archive.PutExchange(post, &Response{URL: url, Body: "<path>apricot.jpg</path> EOF"}); err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+
+	// Both are kept, after opening the archive again too
+	archive, err = OpenArchive(filepath.Join(dir, "archive"))
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	if entries := archive.Entries(); len(entries) != 2 {
+		t.Errorf("Expected the GET and the POST to be archived apart, got %+v", entries)
+	}
+	if body, err := archive.GetBody(url); err != nil || body != "<path>form.jpg</path> EOF" {
+		t.Errorf("Expected the GET, got %q (%v)", body, err)
+	}
+	if resp, err := archive.Do(post); err != nil || resp.Body != "<path>apricot.jpg</path> EOF" {
+		t.Errorf("Expected the POST, got %+v (%v)", resp, err)
+	}
+	if _, err := archive.Do(&Request{Method: "POST", URL: url, Body: "q=kiwi"}); err == nil {
+		t.Errorf("Expected a POST with another body to not be archived")
+	}
+
+	for name, content := range map[string]string{
+		"path.definition": "<path>{{path}}</path>",
+		"urls.txt":        url + "\n" + `{"method": "POST", "url": "` + url + `", "form": {"q": "apricot"}}` + "\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write %s: %s", name, err)
+		}
+	}
+	out := filepath.Join(dir, "out.ndjson")
+	err = reparseCommand([]string{
+		"-archive", filepath.Join(dir, "archive"),
+		"-definition", filepath.Join(dir, "path.definition"),
+		"-sink", "ndjson:" + out,
+		filepath.Join(dir, "urls.txt"),
+	})
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	records, err := readNDJSON(out)
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	paths := make(map[interface{}]bool)
+	for _, record := range records {
+		paths[record["path"]] = true
+	}
+	expected := map[interface{}]bool{"form.jpg": true, "apricot.jpg": true}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("Expected %v, got %v", expected, paths)
+	}
+}
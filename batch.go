@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// The batch command scrapes every URL in a file (one per line), each with the
+// profile which matches it. Lines can also be local files, directories or
+// globs of them, e.g.
+//
+//	scraper batch -profiles profiles.json -sink ndjson -sink csv:products.csv urls.txt
+func batchCommand(args []string) error {
+	flags := flag.NewFlagSet("batch", flag.ContinueOnError)
+	profilesFile := flags.String("profiles", ProfilesFile, "the profiles to route URLs with")
+	flags.StringVar(&QuarantineFile, "quarantine", QuarantineFile, "where to write records which break the rules")
+	provenance := flags.Bool("provenance", false, "attach where each field came from to every record, for every profile")
+	fetch := newFetchFlags(flags)
+	openSink := sinkFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: scraper batch [-profiles profiles.json] %s [-sink format[:file]]... [-columns a,b] urls.txt", fetchUsage)
+	}
+
+	profiles, err := loadProfiles(*profilesFile)
+	if err != nil {
+		return err
+	}
+	if *provenance {
+		provenanceProfiles(profiles)
+	}
+	fetching, err := fetch.apply(profiles)
+	if err != nil {
+		return err
+	}
+	defer fetching.Close()
+
+	urls, err := readURLs(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	urls, err = expandLocal(urls)
+	if err != nil {
+		return err
+	}
+
+	sink, err := openSink()
+	if err != nil {
+		return err
+	}
+	defer sink.Close()
+
+	if err := scrapeAll(profiles, urls, sink); err != nil {
+		return err
+	}
+	if fetching.cache != nil {
+		log.Printf("Cache: %s", fetching.cache)
+	}
+	return nil
+}
+
+// Reads a file of URLs (or RequestSpecs), one per line, skipping blank lines
+// and # comments
+func readURLs(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("could not open batch file: %s", err)
+	}
+	defer f.Close()
+
+	urls := make([]string, 0, 100)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+			urls = append(urls, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read batch file: %s", err)
+	}
+	return urls, nil
+}
+
+// Scrapes each of the URLs with the profile which matches it, writing the
+// output to the sink
+func scrapeAll(profiles []*Profile, urls []string, sink Sink) error {
+	errors := make(chan error)
+	quit := make(chan struct{})
+	defer close(quit)
+
+	input := make(chan string)
+	printable := router(input, errors, quit, profiles)
+
+	go func() {
+		for _, url := range urls {
+			select {
+			case <-quit:
+				return
+			case input <- url:
+			}
+		}
+	}()
+
+	for range urls {
+		select {
+		case err := <-errors:
+			return err
+		case output := <-printable:
+			if err := sink.Write(output); err != nil {
+				return err
+			}
+		}
+	}
+	log.Printf("Scraped %d URLs, rejected %s records, retried %s fetches, skipped %s blocked by robots.txt", len(urls), rejections, retries, blocked)
+	return nil
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An HTTPCache keeps responses on the disk so that they don't have to be
+// fetched again while they are fresh, one gzipped file per URL and key. The
+// key keeps apart the same URL fetched in different ways, such as by profiles
+// with different readers or headers. When the files add up to more than the
+// size limit, those used longest ago are removed
+type HTTPCache struct {
+	dir     string
+	maxSize int64
+
+	mu sync.Mutex
+
+	// How the cache has been used, for the stats at the end of a run
+	hits, revalidated, misses int
+}
+
+// A cacheEntry is a response in the cache and when it was fetched (or last
+// revalidated)
+type cacheEntry struct {
+	Key        string      `json:"key,omitempty"`
+	URL        string      `json:"url"`
+	StatusCode int         `json:"status,omitempty"`
+	Header     http.Header `json:"header,omitempty"`
+	Body       string      `json:"body"`
+	StoredAt   time.Time   `json:"storedAt"`
+}
+
+// OpenHTTPCache opens the cache in a directory, creating it if needed. A
+// maxSize of 0 means no limit
+func OpenHTTPCache(dir string, maxSize int64) (*HTTPCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("could not create cache: %s", err)
+	}
+	return &HTTPCache{
+		dir:     dir,
+		maxSize: maxSize,
+	}, nil
+}
+
+// The file of the entry for a URL and key
+func (c *HTTPCache) file(key, url string) string {
+	id := url
+	if key != "" {
+		id = key + "\n" + url
+	}
+	sum := sha256.Sum256([]byte(id))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])+".json.gz")
+}
+
+// Gets the entry for a URL and key, or nil if there isn't one. Using it
+// counts as using it recently, for eviction
+func (c *HTTPCache) get(key, url string) (*cacheEntry, error) {
+	file := c.file(key, url)
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read cache: %s", err)
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("could not read cache entry for %s: %s", url, err)
+	}
+	defer gz.Close()
+	var entry cacheEntry
+	if err := json.NewDecoder(gz).Decode(&entry); err != nil {
+		return nil, fmt.Errorf("could not read cache entry for %s: %s", url, err)
+	}
+	if entry.URL != url || entry.Key != key {
+		return nil, nil
+	}
+
+	now := time.Now()
+	os.Chtimes(file, now, now)
+	return &entry, nil
+}
+
+// Puts an entry in the cache, then evicts entries if it is over its size
+func (c *HTTPCache) put(entry *cacheEntry) error {
+	tmp, err := ioutil.TempFile(c.dir, ".entry")
+	if err != nil {
+		return fmt.Errorf("could not write cache: %s", err)
+	}
+	gz := gzip.NewWriter(tmp)
+	err = json.NewEncoder(gz).Encode(entry)
+	if closeErr := gz.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), c.file(entry.Key, entry.URL))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("could not write cache: %s", err)
+	}
+	return c.evict()
+}
+
+// Removes the entries used longest ago until the cache is within its size
+func (c *HTTPCache) evict() error {
+	if c.maxSize <= 0 {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	files, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return fmt.Errorf("could not read cache: %s", err)
+	}
+	var size int64
+	entries := make([]os.FileInfo, 0, len(files))
+	for _, info := range files {
+		if !strings.HasSuffix(info.Name(), ".json.gz") {
+			continue
+		}
+		size += info.Size()
+		entries = append(entries, info)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ModTime().Before(entries[j].ModTime())
+	})
+	for _, info := range entries {
+		if size <= c.maxSize {
+			break
+		}
+		if err := os.Remove(filepath.Join(c.dir, info.Name())); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("could not evict from cache: %s", err)
+		}
+		size -= info.Size()
+	}
+	return nil
+}
+
+// Counts how a response was served
+func (c *HTTPCache) count(counter *int) {
+	c.mu.Lock()
+	*counter++
+	c.mu.Unlock()
+}
+
+// String summarises how the cache has been used
+func (c *HTTPCache) String() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return fmt.Sprintf("%d hits, %d revalidated, %d misses", c.hits, c.revalidated, c.misses)
+}
+
+// CachingReader is a WebReader which serves pages from an HTTPCache while
+// they are fresh (by their Cache-Control max-age), and otherwise asks another
+// reader for them with a conditional request so that an unchanged page isn't
+// sent again. With offline set it only serves what is in the cache, however
+// old, and fails for anything else. Its entries are kept under its key, apart
+// from those of readers with other keys
+type CachingReader struct {
+	WebReader
+	cache   *HTTPCache
+	key     string
+	offline bool
+
+	// The time now, which tests replace
+	now func() time.Time
+}
+
+// NewCachingReader returns a reader which caches what webReader fetches under
+// the key
+func NewCachingReader(webReader WebReader, cache *HTTPCache, key string, offline bool) *CachingReader {
+	return &CachingReader{
+		WebReader: webReader,
+		cache:     cache,
+		key:       key,
+		offline:   offline,
+		now:       time.Now,
+	}
+}
+
+// Do makes the request through the cache when it is a GET with no headers of
+// its own, otherwise it can't be answered from the cache and is made as it is
+func (c *CachingReader) Do(req *Request) (*Response, error) {
+	if req.plain() && len(req.Header) == 0 {
+		return c.GetResponse(req.URL)
+	}
+	if c.offline {
+		return nil, fmt.Errorf("could not %s %s, only the cache can be used", req.method(), req.URL)
+	}
+	return doRequest(c.WebReader, req)
+}
+
+// GetResponse returns the cached response if it is fresh, or fetches it
+func (c *CachingReader) GetResponse(url string) (*Response, error) {
+	entry, err := c.cache.get(c.key, url)
+	if err != nil {
+		log.Printf("[Warning] %s", err)
+		entry = nil
+	}
+
+	if c.offline {
+		if entry == nil {
+			return nil, fmt.Errorf("%s is not in the cache", url)
+		}
+		c.cache.count(&c.cache.hits)
+		return entry.response(), nil
+	}
+	if entry != nil && entry.fresh(c.now()) {
+		c.cache.count(&c.cache.hits)
+		return entry.response(), nil
+	}
+
+	// Ask for the page only if it has changed since it was cached
+	req := &Request{URL: url, Header: http.Header{}}
+	if entry != nil {
+		if etag := entry.Header.Get("ETag"); etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		if modified := entry.Header.Get("Last-Modified"); modified != "" {
+			req.Header.Set("If-Modified-Since", modified)
+		}
+	}
+	resp, err := doRequest(c.WebReader, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if entry != nil && resp.StatusCode == http.StatusNotModified {
+		c.cache.count(&c.cache.revalidated)
+		// The new headers (such as the max-age) replace the cached ones
+		if entry.Header == nil {
+			entry.Header = http.Header{}
+		}
+		for name, values := range resp.Header {
+			entry.Header[name] = values
+		}
+		entry.StoredAt = c.now()
+		if err := c.cache.put(entry); err != nil {
+			log.Printf("[Warning] %s", err)
+		}
+		return entry.response(), nil
+	}
+
+	c.cache.count(&c.cache.misses)
+	if cacheable(resp) {
+		err := c.cache.put(&cacheEntry{
+			Key:        c.key,
+			URL:        url,
+			StatusCode: resp.StatusCode,
+			Header:     resp.Header,
+			Body:       resp.Body,
+			StoredAt:   c.now(),
+		})
+		if err != nil {
+			log.Printf("[Warning] %s", err)
+		}
+	}
+	return resp, nil
+}
+
+// GetBody returns the cached body if it is fresh, or fetches it
+func (c *CachingReader) GetBody(url string) (string, error) {
+	resp, err := c.GetResponse(url)
+	if err != nil {
+		return "", err
+	}
+	return resp.Body, nil
+}
+
+// GetStream opens the cached body if it is fresh, or streams the page and
+// caches it once all of it has been read. A stale page is revalidated as
+// GetResponse does, which reads it in full
+func (c *CachingReader) GetStream(url string) (*Stream, error) {
+	entry, err := c.cache.get(c.key, url)
+	if err != nil {
+		log.Printf("[Warning] %s", err)
+		entry = nil
+	}
+	if c.offline || entry != nil {
+		resp, err := c.GetResponse(url)
+		if err != nil {
+			return nil, err
+		}
+		return responseStream(resp)
+	}
+
+	stream, err := getStream(c.WebReader, url)
+	if err != nil {
+		return nil, err
+	}
+	c.cache.count(&c.cache.misses)
+	return watchStream(stream, true, func(resp *Response) {
+		if resp == nil || !cacheable(resp) {
+			return
+		}
+		err := c.cache.put(&cacheEntry{
+			Key:        c.key,
+			URL:        url,
+			StatusCode: resp.StatusCode,
+			Header:     resp.Header,
+			Body:       resp.Body,
+			StoredAt:   c.now(),
+		})
+		if err != nil {
+			log.Printf("[Warning] %s", err)
+		}
+	}), nil
+}
+
+// Streams when the other reader can
+func (c *CachingReader) streams(url string) bool {
+	return canStream(c.WebReader, url)
+}
+
+// The response of a cache entry
+func (e *cacheEntry) response() *Response {
+	return &Response{
+		URL:        e.URL,
+		StatusCode: e.StatusCode,
+		Header:     e.Header,
+		Body:       e.Body,
+	}
+}
+
+// Returns whether the entry can be used without asking the site, which is
+// when it is younger than its max-age
+func (e *cacheEntry) fresh(now time.Time) bool {
+	directives := cacheControl(e.Header)
+	if _, found := directives["no-cache"]; found {
+		return false
+	}
+	maxAge, err := strconv.Atoi(directives["max-age"])
+	if err != nil {
+		return false
+	}
+	return now.Sub(e.StoredAt) < time.Duration(maxAge)*time.Second
+}
+
+// Returns whether a response can be cached: pages which were fetched fine
+// (or by a reader which doesn't know the status) and which the site allows
+// to be stored
+func cacheable(resp *Response) bool {
+	if resp.StatusCode != 0 && resp.StatusCode != http.StatusOK {
+		return false
+	}
+	_, noStore := cacheControl(resp.Header)["no-store"]
+	return !noStore
+}
+
+// Parses the Cache-Control header into its directives, e.g. "max-age=60,
+// no-cache" is {"max-age": "60", "no-cache": ""}
+func cacheControl(header http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, value := range header["Cache-Control"] {
+		for _, directive := range strings.Split(value, ",") {
+			directive = strings.TrimSpace(directive)
+			if directive == "" {
+				continue
+			}
+			name, arg := directive, ""
+			if i := strings.Index(directive, "="); i >= 0 {
+				name, arg = directive[:i], strings.Trim(directive[i+1:], `"`)
+			}
+			directives[strings.ToLower(name)] = arg
+		}
+	}
+	return directives
+}
+
+// Serves every page for the profiles from the cache when it can. Each profile
+// has its own entries, as they can fetch the same URL differently
+func cacheProfiles(profiles []*Profile, cache *HTTPCache, offline bool) {
+	for _, p := range profiles {
+		p.webReader = NewCachingReader(p.WebReader(), cache, p.Name, offline)
+	}
+}
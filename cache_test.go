@@ -0,0 +1,213 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCachingReader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var mu sync.Mutex
+	fetched := make(map[string]int)
+	sent := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetched[r.URL.Path]++
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/fresh":
+			w.Header().Set("Cache-Control", "public, max-age=60")
+		case "/etag":
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		case "/modified":
+			w.Header().Set("Last-Modified", "Mon, 19 Oct 2026 09:00:00 GMT")
+			if r.Header.Get("If-Modified-Since") == "Mon, 19 Oct 2026 09:00:00 GMT" {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		case "/private":
+			w.Header().Set("Cache-Control", "no-store")
+		case "/missing":
+			http.NotFound(w, r)
+			return
+		}
+		mu.Lock()
+		sent[r.URL.Path]++
+		mu.Unlock()
+		w.Write([]byte("<path>" + r.URL.Path + "</path>"))
+	}))
+	defer server.Close()
+
+	cache, err := OpenHTTPCache(dir, 0)
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	reader := NewCachingReader(NewHttpReader(), cache, "", false)
+	now := time.Now()
+	reader.now = func() time.Time { return now }
+
+	paths := []string{"/fresh", "/etag", "/modified", "/private", "/missing"}
+	for i := 0; i < 2; i++ {
+		for _, path := range paths {
+			resp, err := reader.GetResponse(server.URL + path)
+			if err != nil {
+				t.Fatalf("Did not expect to receive an error, got %s", err)
+			}
+			if path != "/missing" && resp.Body != "<path>"+path+"</path>" {
+				t.Errorf("Expected the body of %s, got %q", path, resp.Body)
+			}
+		}
+	}
+
+	for path, expected := range map[string][2]int{
+		"/fresh":    {1, 1}, // Fresh for 60 seconds, so not asked for again
+		"/etag":     {2, 1}, // Asked for again, but not sent again
+		"/modified": {2, 1},
+		"/private":  {2, 2}, // Not allowed to be stored
+		"/missing":  {2, 0}, // Errors aren't stored
+	} {
+		if fetched[path] != expected[0] || sent[path] != expected[1] {
+			t.Errorf("Expected %s to be fetched %d times and sent %d, got %d and %d", path, expected[0], expected[1], fetched[path], sent[path])
+		}
+	}
+	if stats := cache.String(); stats != "1 hits, 2 revalidated, 7 misses" {
+		t.Errorf("Expected the stats to count each use, got %s", stats)
+	}
+
+	// Once it is stale it is asked for again
+	now = now.Add(2 * time.Minute)
+	if _, err := reader.GetBody(server.URL + "/fresh"); err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	if fetched["/fresh"] != 2 {
+		t.Errorf("Expected a stale page to be fetched again, got %d fetches", fetched["/fresh"])
+	}
+
+	// Offline, whatever is in the cache is served however old it is, and
+	// nothing else
+	offline := NewCachingReader(mapReader{}, cache, "", true)
+	offline.now = func() time.Time { return now.Add(24 * time.Hour) }
+	if body, err := offline.GetBody(server.URL + "/fresh"); err != nil || body != "<path>/fresh</path>" {
+		t.Errorf("Expected the cached page offline, got %q (%v)", body, err)
+	}
+	if _, err := offline.GetBody(server.URL + "/private"); err == nil {
+		t.Errorf("Expected a page which isn't cached to fail offline")
+	}
+}
+
+func TestHTTPCacheEviction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Enough room for about two entries of incompressible bodies
+	cache, err := OpenHTTPCache(dir, 2500)
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	body := func(seed int) string {
+		b := make([]byte, 1000)
+		x := uint32(seed + 1)
+		for i := range b {
+			x = x*1664525 + 1013904223
+			b[i] = 'a' + byte(x>>24)%26
+		}
+		return string(b)
+	}
+
+	start := time.Now().Add(-time.Hour)
+	for i, url := range []string{"http://example.com/a", "http://example.com/b"} {
+		if err := cache.put(&cacheEntry{URL: url, Body: body(i), StoredAt: start}); err != nil {
+			t.Fatalf("Did not expect to receive an error, got %s", err)
+		}
+		// Make the order they were used in clear
+		used := start.Add(time.Duration(i) * time.Minute)
+		os.Chtimes(cache.file("", url), used, used)
+	}
+
+	// Using a makes b the one used longest ago
+	if entry, err := cache.get("", "http://example.com/a"); err != nil || entry == nil {
+		t.Fatalf("Expected a to be cached, got %v (%v)", entry, err)
+	}
+	if err := cache.put(&cacheEntry{URL: "http://example.com/c", Body: body(2), StoredAt: start}); err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+
+	for url, expected := range map[string]bool{
+		"http://example.com/a": true,
+		"http://example.com/b": false,
+		"http://example.com/c": true,
+	} {
+		entry, err := cache.get("", url)
+		if err != nil {
+			t.Fatalf("Did not expect to receive an error, got %s", err)
+		}
+		if (entry != nil) != expected {
+			t.Errorf("Expected %s to be cached to be %t", url, expected)
+		}
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	for _, file := range files {
+		if strings.HasPrefix(filepath.Base(file), ".entry") {
+			t.Errorf("Expected no temporary files to be left, got %s", file)
+		}
+	}
+}
+
+func TestCacheProfilesKeptApart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	cache, err := OpenHTTPCache(dir, 0)
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+
+	// Two profiles which fetch the same URL with different readers
+	url := "http://example.com/page"
+	profiles := []*Profile{
+		{Name: "live", webReader: mapReader{url: "<p>live</p>"}},
+		{Name: "saved", webReader: mapReader{url: "<p>saved</p>"}},
+	}
+	cacheProfiles(profiles, cache, false)
+	for _, p := range profiles {
+		if _, err := p.WebReader().GetBody(url); err != nil {
+			t.Fatalf("Did not expect to receive an error, got %s", err)
+		}
+	}
+
+	// Offline, each profile is served what its own reader fetched
+	for _, p := range profiles {
+		offline := NewCachingReader(mapReader{}, cache, p.Name, true)
+		body, err := offline.GetBody(url)
+		if err != nil {
+			t.Fatalf("Did not expect to receive an error, got %s", err)
+		}
+		if expected := "<p>" + p.Name + "</p>"; body != expected {
+			t.Errorf("Expected %s to be cached for %s, got %s", expected, p.Name, body)
+		}
+	}
+	if _, err := NewCachingReader(mapReader{}, cache, "other", true).GetBody(url); err == nil {
+		t.Errorf("Expected a profile which hasn't fetched the page to not be served it")
+	}
+}
@@ -0,0 +1,191 @@
+package definition
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+)
+
+// BundleExtension is the extension of bundle files, to tell them apart from
+// definition files
+const BundleExtension = ".bundle"
+
+// A Bundle is a set of named definitions which are all applied to the same
+// content in one pass, for pages which have more than one kind of record on
+// them (products, breadcrumbs, a result count and so on)
+//
+// A bundle file is JSON which maps names to definition files, relative to the
+// bundle file:
+//
+//	{
+//	    "products": {"definition": "list.definition"},
+//	    "breadcrumbs": {"definition": "breadcrumbs.definition"},
+//	    "total": {"definition": "total.definition", "field": "total"}
+//	}
+//
+// By default each name gets all of the blocks which were matched. With
+// "single" it gets only the first block, and with "field" it gets just that
+// field of the first block
+type Bundle struct {
+	entries []bundleEntry
+}
+
+// A bundleEntry is a named definition within a bundle
+type bundleEntry struct {
+	Name       string `json:"-"`
+	Definition string `json:"definition"`
+	Single     bool   `json:"single"`
+	Field      string `json:"field"`
+
+	def *DefinitionParser
+}
+
+// NewBundle reads a bundle file and all of the definitions within it
+func NewBundle(bundleFile string) (*Bundle, error) {
+	b, err := ioutil.ReadFile(bundleFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening bundle file: %s", err)
+	}
+
+	entries := make(map[string]bundleEntry, 10)
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return nil, fmt.Errorf("Error decoding bundle file: %s", err)
+	}
+
+	bundle := &Bundle{
+		entries: make([]bundleEntry, 0, len(entries)),
+	}
+	for name, entry := range entries {
+		path := entry.Definition
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(bundleFile), path)
+		}
+		entry.def, err = NewDefinition(path)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading definition %s: %s", name, err)
+		}
+		entry.Name = name
+		bundle.entries = append(bundle.entries, entry)
+	}
+
+	// Apply them in a predictable order
+	sort.Slice(bundle.entries, func(i, j int) bool {
+		return bundle.entries[i].Name < bundle.entries[j].Name
+	})
+	return bundle, nil
+}
+
+// Names returns the names of the definitions in the bundle
+func (b *Bundle) Names() []string {
+	names := make([]string, len(b.entries))
+	for i, entry := range b.entries {
+		names[i] = entry.Name
+	}
+	return names
+}
+
+// Parse applies all of the definitions to the content and returns the result
+// of each by name
+func (b *Bundle) Parse(content string) map[string]interface{} {
+	return b.parse(content, "", false)
+}
+
+// ParseWithProvenance is Parse with provenance attached to every record, as
+// with DefinitionParser.ParseWithProvenance
+func (b *Bundle) ParseWithProvenance(content, source string) map[string]interface{} {
+	return b.parse(content, source, true)
+}
+
+func (b *Bundle) parse(content, source string, provenance bool) map[string]interface{} {
+	scanners, entries := b.active(source, provenance)
+
+	records := make([][]map[string]interface{}, len(b.entries))
+	for i := range records {
+		records[i] = make([]map[string]interface{}, 0, 10)
+	}
+	scanIndex(newIndex(content), scanners, func(i int, fields map[string]interface{}) error {
+		records[entries[i]] = append(records[entries[i]], fields)
+		return nil
+	})
+	return b.results(records)
+}
+
+// ParseReader applies all of the definitions to content read from r in a
+// single pass, passing each block to emit along with the name of the
+// definition that matched it as soon as it has been matched
+func (b *Bundle) ParseReader(
+	r io.Reader,
+	emit func(name string, fields map[string]interface{}) error,
+) error {
+	return b.parseReader(r, "", false, emit)
+}
+
+// ParseReaderWithProvenance is ParseReader with provenance attached to every
+// record, as with DefinitionParser.ParseReaderWithProvenance
+func (b *Bundle) ParseReaderWithProvenance(
+	r io.Reader,
+	source string,
+	emit func(name string, fields map[string]interface{}) error,
+) error {
+	return b.parseReader(r, source, true, emit)
+}
+
+func (b *Bundle) parseReader(
+	r io.Reader,
+	source string,
+	provenance bool,
+	emit func(name string, fields map[string]interface{}) error,
+) error {
+	scanners, entries := b.active(source, provenance)
+	return scanReader(r, scanners, func(i int, fields map[string]interface{}) error {
+		return emit(b.entries[entries[i]].Name, fields)
+	})
+}
+
+// Returns a scanner for each entry whose definition isn't empty, along with
+// the index of the entry each is for
+func (b *Bundle) active(source string, provenance bool) ([]*scanner, []int) {
+	scanners := make([]*scanner, 0, len(b.entries))
+	entries := make([]int, 0, len(b.entries))
+	for i, entry := range b.entries {
+		if len(entry.def.L.ast) == 0 {
+			continue
+		}
+		var trace *tracer
+		if provenance {
+			trace = entry.def.tracer(source)
+		}
+		s := newScanner(entry.def.compiled(), trace)
+		if entry.Single || entry.Field != "" {
+			s.limit = 1
+		}
+		scanners = append(scanners, s)
+		entries = append(entries, i)
+	}
+	return scanners, entries
+}
+
+// Shapes the records of each entry into the result for it
+func (b *Bundle) results(records [][]map[string]interface{}) map[string]interface{} {
+	results := make(map[string]interface{}, len(b.entries))
+	for i, entry := range b.entries {
+		switch {
+		case entry.Field != "":
+			results[entry.Name] = nil
+			if len(records[i]) > 0 {
+				results[entry.Name] = records[i][0][entry.Field]
+			}
+		case entry.Single:
+			results[entry.Name] = nil
+			if len(records[i]) > 0 {
+				results[entry.Name] = records[i][0]
+			}
+		default:
+			results[entry.Name] = records[i]
+		}
+	}
+	return results
+}
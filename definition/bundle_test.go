@@ -0,0 +1,107 @@
+package definition
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestBundle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bundle")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range map[string]string{
+		"products.definition":    `<li class="product"><a href="{{path}}">{{name|trim}}</a></li>`,
+		"breadcrumbs.definition": `<li class="crumb">{{crumb|trim}}</li>`,
+		"total.definition":       `<p class="total">{{total|pence}} results</p>`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write %s: %s", name, err)
+		}
+	}
+
+	// Definitions can also be given with an absolute path
+	bundleFile := filepath.Join(dir, "page.bundle")
+	err = ioutil.WriteFile(bundleFile, []byte(`{
+		"products": {"definition": "products.definition"},
+		"breadcrumbs": {"definition": "breadcrumbs.definition"},
+		"total": {"definition": "total.definition", "field": "total"},
+		"first": {"definition": "products.definition", "single": true},
+		"missing": {"definition": "`+filepath.Join(dir, "breadcrumbs.definition")+`", "field": "nope"}
+	}`), 0644)
+	if err != nil {
+		t.Fatalf("failed to write bundle: %s", err)
+	}
+
+	bundle, err := NewBundle(bundleFile)
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+
+	content := strings.Join([]string{
+		`<ul><li class="crumb"> Home </li><li class="crumb"> Fruit </li></ul>`,
+		`<p class="total">1,234 results</p>`,
+		`<ul>`,
+		`<li class="product"><a href="/apricot.html"> Apricot </a></li>`,
+		`<li class="product"><a href="/kiwi.html"> Kiwi </a></li>`,
+		`</ul>`,
+	}, "\n")
+
+	expected := map[string]interface{}{
+		"products": []map[string]interface{}{
+			{"path": "/apricot.html", "name": "Apricot"},
+			{"path": "/kiwi.html", "name": "Kiwi"},
+		},
+		"breadcrumbs": []map[string]interface{}{
+			{"crumb": "Home"},
+			{"crumb": "Fruit"},
+		},
+		"total":   1234,
+		"first":   map[string]interface{}{"path": "/apricot.html", "name": "Apricot"},
+		"missing": nil,
+	}
+
+	results := bundle.Parse(content)
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("Expected results to be %+v, got %+v", expected, results)
+	}
+
+	streamed := make(map[string][]map[string]interface{})
+	err = bundle.ParseReader(iotest.OneByteReader(strings.NewReader(content)), func(name string, fields map[string]interface{}) error {
+		streamed[name] = append(streamed[name], fields)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	for name, n := range map[string]int{"products": 2, "breadcrumbs": 2, "total": 1, "first": 1, "missing": 1} {
+		if len(streamed[name]) != n {
+			t.Errorf("Expected %d streamed %s, got %+v", n, name, streamed[name])
+		}
+	}
+
+	// Streaming with provenance gives the same records as parsing with it
+	parsed := bundle.ParseWithProvenance(content, "http://example.com/fruit")
+	streamed = make(map[string][]map[string]interface{})
+	err = bundle.ParseReaderWithProvenance(iotest.HalfReader(strings.NewReader(content)), "http://example.com/fruit", func(name string, fields map[string]interface{}) error {
+		streamed[name] = append(streamed[name], fields)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	if !reflect.DeepEqual(streamed["products"], parsed["products"]) {
+		t.Errorf("Expected the streamed products to be %+v, got %+v", parsed["products"], streamed["products"])
+	}
+	crumb := streamed["breadcrumbs"][1][ProvenanceKey].(map[string]Provenance)["crumb"]
+	if crumb.Source != "http://example.com/fruit" || crumb.Line != 1 {
+		t.Errorf("Expected the provenance of the second crumb, got %+v", crumb)
+	}
+}
@@ -0,0 +1,129 @@
+package definition
+
+// A Chain is an ordered list of definitions for the same content, such as the
+// current definition for a site followed by older ones. Each is tried in turn
+// and the first (or the best) to meet the thresholds is used
+type Chain struct {
+	Definitions []*DefinitionParser
+
+	// A definition meets the thresholds when at least MinRecords of its
+	// records have all of the Required fields
+	MinRecords int
+	Required   []string
+
+	// Try every definition and use the best, rather than the first which
+	// meets the thresholds
+	Best bool
+}
+
+// Score is how well a definition matched some content
+type Score struct {
+	// The number of records, and how many of those have all of the
+	// required fields
+	Records  int
+	Complete int
+}
+
+// ChainResult is the outcome of applying a chain
+type ChainResult struct {
+	Fields     []map[string]interface{}
+	Definition *DefinitionParser
+	Score      Score
+
+	// Whether the definition met the thresholds. If none of them did, the
+	// best is used anyway
+	Met bool
+}
+
+// Parse applies the definitions in the chain to the content, returning the
+// records of the one which was chosen
+func (c *Chain) Parse(content string) ChainResult {
+	return c.parse(content, "", false)
+}
+
+// ParseWithProvenance is Parse with provenance attached to every record, as
+// with DefinitionParser.ParseWithProvenance
+func (c *Chain) ParseWithProvenance(content, source string) ChainResult {
+	return c.parse(content, source, true)
+}
+
+func (c *Chain) parse(content, source string, provenance bool) ChainResult {
+	ix := newIndex(content)
+
+	best := ChainResult{}
+	for i, def := range c.Definitions {
+		var trace *tracer
+		if provenance {
+			trace = def.tracer(source)
+		}
+
+		fields := make([]map[string]interface{}, 0, 10)
+		if len(def.L.ast) > 0 {
+			s := newScanner(def.compiled(), trace)
+			for {
+				f := s.next(ix)
+				if f == nil {
+					break
+				}
+				fields = append(fields, f)
+			}
+		}
+
+		result := ChainResult{
+			Fields:     fields,
+			Definition: def,
+			Score:      c.score(fields),
+		}
+		result.Met = c.meets(result.Score)
+
+		if result.Met && !c.Best {
+			return result
+		}
+		if i == 0 || result.better(best) {
+			best = result
+		}
+	}
+	return best
+}
+
+// Scores the records against the required fields
+func (c *Chain) score(fields []map[string]interface{}) Score {
+	score := Score{
+		Records: len(fields),
+	}
+	for _, f := range fields {
+		complete := true
+		for _, name := range c.Required {
+			if _, found := f[name]; !found {
+				complete = false
+				break
+			}
+		}
+		if complete {
+			score.Complete++
+		}
+	}
+	return score
+}
+
+// Whether the score meets the thresholds, there must always be at least one
+// complete record
+func (c *Chain) meets(score Score) bool {
+	min := c.MinRecords
+	if min < 1 {
+		min = 1
+	}
+	return score.Complete >= min
+}
+
+// Whether this result is better than another, meeting the thresholds comes
+// first and then the number of complete records
+func (r ChainResult) better(other ChainResult) bool {
+	if r.Met != other.Met {
+		return r.Met
+	}
+	if r.Score.Complete != other.Score.Complete {
+		return r.Score.Complete > other.Score.Complete
+	}
+	return r.Score.Records > other.Score.Records
+}
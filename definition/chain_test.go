@@ -0,0 +1,86 @@
+package definition
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestChain(t *testing.T) {
+	definitions := make([]*DefinitionParser, 0, 3)
+	for _, definition := range []string{
+		// The latest redesign, which hasn't happened yet
+		`<div class="tile"><h2>{{name|trim}}</h2><em>{{price|pence}}</em></div>`,
+		// Only finds the names
+		`<li><a>{{name|trim}}</a><span>`,
+		// Finds everything
+		`<li><a>{{name|trim}}</a><span>{{price|pence}}</span></li>`,
+	} {
+		ast := &lexer{}
+		ast.tokenize(definition)
+		definitions = append(definitions, &DefinitionParser{
+			L:       ast,
+			filters: filters,
+		})
+	}
+
+	content := strings.Join([]string{
+		`<ul>`,
+		`<li><a>Apricot</a><span>£3.50</span></li>`,
+		`<li><a>Kiwifruit</a><span>£0.50</span></li>`,
+		`</ul>`,
+	}, "\n")
+
+	for _, test := range []struct {
+		chain      *Chain
+		definition int
+		score      Score
+		met        bool
+	}{
+		{
+			// Without thresholds the first with any records wins
+			chain:      &Chain{Definitions: definitions},
+			definition: 1,
+			score:      Score{Records: 2, Complete: 2},
+			met:        true,
+		},
+		{
+			chain:      &Chain{Definitions: definitions, Required: []string{"name", "price"}},
+			definition: 2,
+			score:      Score{Records: 2, Complete: 2},
+			met:        true,
+		},
+		{
+			chain:      &Chain{Definitions: definitions, Required: []string{"name", "price"}, MinRecords: 3},
+			definition: 2,
+			score:      Score{Records: 2, Complete: 2},
+			met:        false,
+		},
+		{
+			// None of them meet the thresholds, so the one with most records
+			chain:      &Chain{Definitions: definitions[:2], Required: []string{"price"}},
+			definition: 1,
+			score:      Score{Records: 2, Complete: 0},
+			met:        false,
+		},
+		{
+			chain:      &Chain{Definitions: definitions, Best: true},
+			definition: 1,
+			score:      Score{Records: 2, Complete: 2},
+			met:        true,
+		},
+	} {
+		result := test.chain.Parse(content)
+		if result.Definition != definitions[test.definition] {
+			t.Errorf("Expected definition %d to be chosen, got %+v", test.definition, result.Definition)
+		}
+		if result.Score != test.score {
+			t.Errorf("Expected score to be %+v, got %+v", test.score, result.Score)
+		}
+		if result.Met != test.met {
+			t.Errorf("Expected met to be %t, got %t", test.met, result.Met)
+		}
+		if len(result.Fields) != result.Score.Records {
+			t.Errorf("Expected %d fields, got %d", result.Score.Records, len(result.Fields))
+		}
+	}
+}
@@ -1,7 +1,9 @@
 package definition
 
 import (
+	"crypto/sha256"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"strings"
 	"unicode"
@@ -11,15 +13,31 @@ import (
 // want to extract from it
 type Definition interface {
 	Parse(content string) []map[string]interface{}
+	ParseReader(r io.Reader, emit func(map[string]interface{}) error) error
 }
 
 // A filterFunc is a function which can be used to modify a string
 type filterFunc func(string) interface{}
 
+// An unfilterFunc is a function which will undo a filterFunc
+type unfilterFunc func(interface{}) string
+
 // DefinitionParser will contain the bytes from a definition file
 type DefinitionParser struct {
 	filters map[string]filterFunc
 	L       *lexer
+
+	// The definition file and a hash of its contents, for provenance
+	File string
+	Hash string
+
+	// The rules from the manifest next to the definition file, and the fields
+	// computed from the variables, if any
+	Rules    Rules
+	Computed Computed
+
+	// The compiled form of L, if nil it is compiled on each Parse
+	m *matcher
 }
 
 // NewDefinition takes a definition file and will return something that can
@@ -36,9 +54,23 @@ func NewDefinition(definitionFile string) (*DefinitionParser, error) {
 		return nil, fmt.Errorf("Error tokenizing definition file: %s", err)
 	}
 
+	rules, err := loadRules(definitionFile)
+	if err != nil {
+		return nil, err
+	}
+	computed, err := loadComputed(definitionFile)
+	if err != nil {
+		return nil, err
+	}
+
 	return &DefinitionParser{
-		L:       ast,
-		filters: filters, // Apply local default filters only
+		L:        ast,
+		filters:  filters, // Apply local default filters only
+		File:     definitionFile,
+		Hash:     fmt.Sprintf("%x", sha256.Sum256(b)),
+		Rules:    rules,
+		Computed: computed,
+		m:        compile(ast.ast, filters),
 	}, nil
 }
 
@@ -48,6 +80,11 @@ func NewDefinition(definitionFile string) (*DefinitionParser, error) {
 //
 // This localises all variables and so is thread safe
 func (def *DefinitionParser) Parse(content string) []map[string]interface{} {
+	return def.parse(content, nil)
+}
+
+// Parse, optionally keeping track of provenance
+func (def *DefinitionParser) parse(content string, trace *tracer) []map[string]interface{} {
 
 	data := make([]map[string]interface{}, 0, 10)
 
@@ -56,19 +93,63 @@ func (def *DefinitionParser) Parse(content string) []map[string]interface{} {
 		return data
 	}
 
-	pos := 0
-	tokenIndex := 0
-	fields := make(map[string]interface{}, 10)
+	s := newScanner(def.compiled(), trace)
+	ix := newIndex(content)
+	for {
+		fields := s.next(ix)
+		if fields == nil {
+			break
+		}
+		data = append(data, fields)
+	}
+	return data
+}
+
+// Returns the compiled definition, compiling it now if needed
+func (def *DefinitionParser) compiled() *matcher {
+	if def.m == nil {
+		return compile(def.L.ast, def.filters)
+	}
+	return def.m
+}
 
-	variableStart := 0
-	variableName := ""
-	variableTokenIndex := 0
+// A scanner holds the state of applying a definition to some content, so that
+// it can stop when the content runs out and carry on if more arrives
+type scanner struct {
+	m     *matcher
+	trace *tracer
 
-	for {
-		currentToken := def.L.ast[tokenIndex]
-		tokenContent := currentToken.content
+	pos        int
+	tokenIndex int
+	fields     map[string]interface{}
+
+	// How many blocks have been matched, and how many to stop at if not 0
+	count int
+	limit int
 
-		switch currentToken.token {
+	variableStart      int
+	variableName       string
+	variableTokenIndex int
+}
+
+func newScanner(m *matcher, trace *tracer) *scanner {
+	return &scanner{
+		m:      m,
+		trace:  trace,
+		fields: make(map[string]interface{}, 10),
+	}
+}
+
+// Next will keep applying the definition until a block has been matched and
+// return its fields. If the content runs out first it will return nil
+func (s *scanner) next(ix *index) map[string]interface{} {
+	if s.finished() {
+		return nil
+	}
+	for s.pos < len(ix.content) {
+		currentStep := &s.m.steps[s.tokenIndex]
+
+		switch currentStep.token {
 
 		default:
 			// Not a match, reset
@@ -76,83 +157,96 @@ func (def *DefinitionParser) Parse(content string) []map[string]interface{} {
 		case tokenEOF:
 			// EOF means we want to retry applying our definition to
 			// newly seen text to see if we can get multiple
-			data = append(data, fields)
-			fields = make(map[string]interface{}, 10)
-			tokenIndex = 0
-			pos -= 1
-			continue
+			fields := s.fields
+			s.fields = make(map[string]interface{}, 10)
+			s.tokenIndex = 0
+			s.pos -= 1
+			s.count++
+			return fields
 		case tokenText:
-			// If there is some token text, we care about previous
-			// state and can just determine if we're looking into a
-			// variable or not and handle it in different ways
-			if p, o := HasPrefixIgnoreWhitespace(content[pos:], tokenContent); p {
-
-				// If we're looking to fill in a variable name
-				if len(variableName) > 0 {
-
-					// Do nothing
-					if variableName == "_" {
-						variableStart = 0
-						variableName = ""
-						variableTokenIndex = 0
-						continue
-					}
-
-					// While there are no more filters
-					filtersToApply := make([]string, 0, 3)
-					for j := 1; ; j++ {
-						if variableTokenIndex+j >= len(def.L.ast) {
-							break
-						}
-						tok := def.L.ast[variableTokenIndex+j]
-						if tok.token == tokenPipe {
-							continue
-						} else if tok.token == tokenFilter {
-							filtersToApply = append(filtersToApply, tok.content)
-						} else {
-							break
-						}
-					}
-					fields[variableName] = content[variableStart-1 : pos]
-
-					// Apply any filters
-					for _, filter := range filtersToApply {
-						filterFunc, found := def.filters[filter]
-						if found {
-							fields[variableName] = filterFunc(fields[variableName].(string))
-						}
-					}
-
-					// Reset variable
-					variableStart = 0
-					variableName = ""
-					variableTokenIndex = 0
+			// Jump straight to where the text next appears. If it
+			// doesn't appear then we can at least skip past where it
+			// can't, in case more content arrives
+			p, o, found := ix.find(s.pos, currentStep)
+			if !found {
+				s.pos = ix.resume(s.pos, currentStep)
+				return nil
+			}
+			s.pos = p
+
+			// If we're looking to fill in a variable name, skips
+			// ("_") have nothing to fill in
+			if len(s.variableName) > 0 && s.variableName != "_" {
+				s.fields[s.variableName] = ix.content[s.variableStart-1 : s.pos]
+				if s.trace != nil {
+					s.trace.attach(s.fields, s.variableName, ix.content, s.variableStart-1, s.pos)
+				}
+
+				// Apply any filters
+				for _, filterFunc := range s.m.steps[s.variableTokenIndex].filters {
+					s.fields[s.variableName] = filterFunc(s.fields[s.variableName].(string))
 				}
-				pos += o
-				tokenIndex++
 			}
+
+			// Reset variable
+			s.variableStart = 0
+			s.variableName = ""
+			s.variableTokenIndex = 0
+
+			s.pos += o
+			s.tokenIndex++
 		case tokenFilter,
 			tokenPipe,
 			tokenRightMeta:
-			tokenIndex++
+			s.tokenIndex++
 		case tokenLeftMeta:
 			// Can optimize and fall through to the proceeding state
-			tokenIndex++
+			s.tokenIndex++
 			fallthrough
 		case tokenVariable:
 			// Keep track of our position and the name of the variable
-			variableStart = pos
-			variableName = def.L.ast[tokenIndex].content
-			variableTokenIndex = tokenIndex
-			tokenIndex++
+			s.variableStart = s.pos
+			s.variableName = s.m.steps[s.tokenIndex].content
+			s.variableTokenIndex = s.tokenIndex
+			s.tokenIndex++
 		}
 
-		pos++
-		if pos >= len(content) {
-			break
-		}
+		s.pos++
+	}
+	return nil
+}
+
+// Finished returns whether the scanner has matched as many blocks as it is
+// limited to
+func (s *scanner) finished() bool {
+	return s.limit > 0 && s.count >= s.limit
+}
+
+// Discardable returns how much of the start of the content is no longer needed
+func (s *scanner) discardable() int {
+	n := s.pos - 1
+	if len(s.variableName) > 0 && s.variableName != "_" && s.variableStart-1 < n {
+		n = s.variableStart - 1
+	}
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+// Discard moves the scanner's positions back for when the first n bytes of the
+// content have been dropped, n must be no more than discardable
+func (s *scanner) discard(ix *index, n int) {
+	if n == 0 {
+		return
+	}
+	if s.trace != nil {
+		s.trace.discard(ix.content, n)
+	}
+	s.pos -= n
+	if len(s.variableName) > 0 {
+		s.variableStart -= n
 	}
-	return data
 }
 
 // Means we can be whitespace agnostic, also means we'll only accept
@@ -0,0 +1,620 @@
+package definition
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ComputedExtension is the extension of the file of computed fields for a
+// definition, which sits next to it with the same name. Each line names a
+// field and the expression to compute it with, in order, so that later fields
+// can use earlier ones:
+//
+//	# The number of units in the measure
+//	quantity = pricePerMeasure > 0 ? pricePerUnit / pricePerMeasure : null
+//	label = productName + " (" + (unit ?? "each") + ")"
+//
+// Expressions have numbers, "strings", true, false, null, the variables of the
+// record, arithmetic (+ - * / %), + to join strings, comparisons, && || !,
+// c ? a : b and a ?? b (b when a is null). A variable which is missing is
+// null, and arithmetic or comparisons with null are null rather than errors.
+// When the result is null the field is left out
+const ComputedExtension = ".computed"
+
+// Computed is the list of fields computed for each record of a definition
+type Computed []ComputedField
+
+// A ComputedField is a field and the expression which computes it
+type ComputedField struct {
+	Name   string
+	Source string
+
+	eval expression
+}
+
+// An expression is a compiled expression, evaluated against a record
+type expression func(fields map[string]interface{}) (interface{}, error)
+
+// Reads the computed fields file for a definition file, which is optional
+func loadComputed(definitionFile string) (Computed, error) {
+	computedFile := strings.TrimSuffix(definitionFile, filepath.Ext(definitionFile)) + ComputedExtension
+	f, err := os.Open(computedFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error opening computed file: %s", err)
+	}
+	defer f.Close()
+
+	computed := make(Computed, 0, 10)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		field, err := parseComputedField(text)
+		if err != nil {
+			return nil, fmt.Errorf("Error in computed file on line %d: %s", line, err)
+		}
+		computed = append(computed, field)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Error reading computed file: %s", err)
+	}
+	return computed, nil
+}
+
+// Parses a "name = expression" line
+func parseComputedField(text string) (ComputedField, error) {
+	i := strings.Index(text, "=")
+	if i < 0 {
+		return ComputedField{}, fmt.Errorf("expected name = expression")
+	}
+	field := ComputedField{
+		Name:   strings.TrimSpace(text[:i]),
+		Source: strings.TrimSpace(text[i+1:]),
+	}
+	if !isIdentifier(field.Name) {
+		return ComputedField{}, fmt.Errorf("%q is not a valid field name", field.Name)
+	}
+	eval, err := compileExpression(field.Source)
+	if err != nil {
+		return ComputedField{}, err
+	}
+	field.eval = eval
+	return field, nil
+}
+
+// Apply computes the fields of a record, in order. A field which can't be
+// computed is left out, and why is returned so that it can be reported
+func (c Computed) Apply(fields map[string]interface{}) []error {
+	var errs []error
+	for _, field := range c {
+		value, err := field.eval(fields)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", field.Name, err))
+			continue
+		}
+		if value != nil {
+			fields[field.Name] = value
+		}
+	}
+	return errs
+}
+
+// compileExpression parses an expression into something which can be evaluated
+// against a record
+func compileExpression(source string) (expression, error) {
+	tokens, err := lexExpression(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{tokens: tokens}
+	eval, err := p.ternary()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != exprEOF {
+		return nil, fmt.Errorf("unexpected %q at %d", p.peek().text, p.peek().pos)
+	}
+	return eval, nil
+}
+
+type exprKind int
+
+const (
+	exprEOF exprKind = iota
+	exprNumber
+	exprString
+	exprIdent
+	exprOperator
+)
+
+type exprToken struct {
+	kind  exprKind
+	text  string
+	value interface{}
+	pos   int
+}
+
+// The operators, longest first so that they are matched greedily
+var exprOperators = []string{
+	"??", "&&", "||", "==", "!=", "<=", ">=",
+	"+", "-", "*", "/", "%", "<", ">", "!", "?", ":", "(", ")",
+}
+
+func lexExpression(source string) ([]exprToken, error) {
+	tokens := make([]exprToken, 0, 16)
+	for pos := 0; pos < len(source); {
+		c := source[pos]
+		switch {
+		case c == ' ' || c == '\t':
+			pos++
+
+		case c >= '0' && c <= '9' || c == '.':
+			start := pos
+			for pos < len(source) && (source[pos] >= '0' && source[pos] <= '9' || source[pos] == '.') {
+				pos++
+			}
+			text := source[start:pos]
+			var value interface{}
+			if i, err := strconv.Atoi(text); err == nil {
+				value = i
+			} else if f, err := strconv.ParseFloat(text, 64); err == nil {
+				value = f
+			} else {
+				return nil, fmt.Errorf("invalid number %q at %d", text, start)
+			}
+			tokens = append(tokens, exprToken{kind: exprNumber, text: text, value: value, pos: start})
+
+		case c == '"':
+			start := pos
+			pos++
+			var b strings.Builder
+			for ; pos < len(source) && source[pos] != '"'; pos++ {
+				if source[pos] == '\\' && pos+1 < len(source) {
+					pos++
+				}
+				b.WriteByte(source[pos])
+			}
+			if pos >= len(source) {
+				return nil, fmt.Errorf("unterminated string at %d", start)
+			}
+			pos++
+			tokens = append(tokens, exprToken{kind: exprString, text: source[start:pos], value: b.String(), pos: start})
+
+		case isIdentifierByte(c, true):
+			start := pos
+			for pos < len(source) && isIdentifierByte(source[pos], false) {
+				pos++
+			}
+			tokens = append(tokens, exprToken{kind: exprIdent, text: source[start:pos], pos: start})
+
+		default:
+			matched := false
+			for _, op := range exprOperators {
+				if strings.HasPrefix(source[pos:], op) {
+					tokens = append(tokens, exprToken{kind: exprOperator, text: op, pos: pos})
+					pos += len(op)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("unexpected %q at %d", c, pos)
+			}
+		}
+	}
+	return append(tokens, exprToken{kind: exprEOF, pos: len(source)}), nil
+}
+
+func isIdentifierByte(c byte, first bool) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || !first && c >= '0' && c <= '9'
+}
+
+func isIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !isIdentifierByte(s[i], i == 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// A recursive descent parser, from the lowest precedence to the highest:
+// ?: then ?? then || then && then comparisons then + - then * / % then unary
+type exprParser struct {
+	tokens []exprToken
+	pos    int
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.tokens[p.pos]
+}
+
+// Consumes the next token if it is one of the operators
+func (p *exprParser) accept(ops ...string) (string, bool) {
+	t := p.peek()
+	if t.kind != exprOperator {
+		return "", false
+	}
+	for _, op := range ops {
+		if t.text == op {
+			p.pos++
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *exprParser) ternary() (expression, error) {
+	cond, err := p.coalesce()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := p.accept("?"); !ok {
+		return cond, nil
+	}
+	then, err := p.ternary()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := p.accept(":"); !ok {
+		return nil, fmt.Errorf("expected : at %d", p.peek().pos)
+	}
+	otherwise, err := p.ternary()
+	if err != nil {
+		return nil, err
+	}
+	return func(fields map[string]interface{}) (interface{}, error) {
+		c, err := cond(fields)
+		if err != nil {
+			return nil, err
+		}
+		if truthy(c) {
+			return then(fields)
+		}
+		return otherwise(fields)
+	}, nil
+}
+
+func (p *exprParser) coalesce() (expression, error) {
+	left, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.accept("??"); !ok {
+			return left, nil
+		}
+		right, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(fields map[string]interface{}) (interface{}, error) {
+			v, err := l(fields)
+			if err != nil || v != nil {
+				return v, err
+			}
+			return right(fields)
+		}
+	}
+}
+
+func (p *exprParser) or() (expression, error) {
+	return p.logical("||", p.and)
+}
+
+func (p *exprParser) and() (expression, error) {
+	return p.logical("&&", p.comparison)
+}
+
+// Parses a chain of && or ||, which short circuit
+func (p *exprParser) logical(op string, next func() (expression, error)) (expression, error) {
+	left, err := next()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.accept(op); !ok {
+			return left, nil
+		}
+		right, err := next()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(fields map[string]interface{}) (interface{}, error) {
+			v, err := l(fields)
+			if err != nil {
+				return nil, err
+			}
+			if truthy(v) == (op == "||") {
+				return op == "||", nil
+			}
+			v, err = right(fields)
+			if err != nil {
+				return nil, err
+			}
+			return truthy(v), nil
+		}
+	}
+}
+
+func (p *exprParser) comparison() (expression, error) {
+	left, err := p.additive()
+	if err != nil {
+		return nil, err
+	}
+	op, ok := p.accept("==", "!=", "<=", ">=", "<", ">")
+	if !ok {
+		return left, nil
+	}
+	right, err := p.additive()
+	if err != nil {
+		return nil, err
+	}
+	return binary(op, left, right), nil
+}
+
+func (p *exprParser) additive() (expression, error) {
+	return p.binaryChain([]string{"+", "-"}, p.multiplicative)
+}
+
+func (p *exprParser) multiplicative() (expression, error) {
+	return p.binaryChain([]string{"*", "/", "%"}, p.unary)
+}
+
+// Parses a left associative chain of the operators
+func (p *exprParser) binaryChain(ops []string, next func() (expression, error)) (expression, error) {
+	left, err := next()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.accept(ops...)
+		if !ok {
+			return left, nil
+		}
+		right, err := next()
+		if err != nil {
+			return nil, err
+		}
+		left = binary(op, left, right)
+	}
+}
+
+func (p *exprParser) unary() (expression, error) {
+	op, ok := p.accept("!", "-")
+	if !ok {
+		return p.primary()
+	}
+	operand, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	return func(fields map[string]interface{}) (interface{}, error) {
+		v, err := operand(fields)
+		if err != nil {
+			return nil, err
+		}
+		if op == "!" {
+			return !truthy(v), nil
+		}
+		switch v := v.(type) {
+		case nil:
+			return nil, nil
+		case int:
+			return -v, nil
+		case float64:
+			return -v, nil
+		}
+		return nil, fmt.Errorf("cannot negate %s", typeName(v))
+	}, nil
+}
+
+func (p *exprParser) primary() (expression, error) {
+	t := p.peek()
+	p.pos++
+	switch t.kind {
+	case exprNumber, exprString:
+		value := t.value
+		return func(map[string]interface{}) (interface{}, error) { return value, nil }, nil
+
+	case exprIdent:
+		switch t.text {
+		case "null":
+			return func(map[string]interface{}) (interface{}, error) { return nil, nil }, nil
+		case "true", "false":
+			value := t.text == "true"
+			return func(map[string]interface{}) (interface{}, error) { return value, nil }, nil
+		}
+		name := t.text
+		return func(fields map[string]interface{}) (interface{}, error) { return fields[name], nil }, nil
+
+	case exprOperator:
+		if t.text == "(" {
+			inner, err := p.ternary()
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := p.accept(")"); !ok {
+				return nil, fmt.Errorf("expected ) at %d", p.peek().pos)
+			}
+			return inner, nil
+		}
+	case exprEOF:
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	return nil, fmt.Errorf("unexpected %q at %d", t.text, t.pos)
+}
+
+// Returns an expression applying a binary operator to two others
+func binary(op string, left, right expression) expression {
+	return func(fields map[string]interface{}) (interface{}, error) {
+		l, err := left(fields)
+		if err != nil {
+			return nil, err
+		}
+		r, err := right(fields)
+		if err != nil {
+			return nil, err
+		}
+
+		switch op {
+		case "==":
+			return equal(l, r), nil
+		case "!=":
+			return !equal(l, r), nil
+		}
+		if l == nil || r == nil {
+			return nil, nil
+		}
+
+		// Joining strings
+		_, lString := l.(string)
+		_, rString := r.(string)
+		if lString || rString {
+			switch op {
+			case "+":
+				return fmt.Sprint(l) + fmt.Sprint(r), nil
+			case "<", "<=", ">", ">=":
+				if lString && rString {
+					return compare(op, strings.Compare(l.(string), r.(string))), nil
+				}
+			}
+			return nil, fmt.Errorf("cannot apply %s to %s and %s", op, typeName(l), typeName(r))
+		}
+
+		// Whole numbers stay whole, as with the pence filter
+		li, lInt := l.(int)
+		ri, rInt := r.(int)
+		if lInt && rInt {
+			switch op {
+			case "+":
+				return li + ri, nil
+			case "-":
+				return li - ri, nil
+			case "*":
+				return li * ri, nil
+			case "/", "%":
+				if ri == 0 {
+					return nil, fmt.Errorf("division by zero")
+				}
+				if op == "/" {
+					return li / ri, nil
+				}
+				return li % ri, nil
+			}
+			return compare(op, li-ri), nil
+		}
+
+		lf, lok := toFloat(l)
+		rf, rok := toFloat(r)
+		if !lok || !rok {
+			return nil, fmt.Errorf("cannot apply %s to %s and %s", op, typeName(l), typeName(r))
+		}
+		switch op {
+		case "+":
+			return lf + rf, nil
+		case "-":
+			return lf - rf, nil
+		case "*":
+			return lf * rf, nil
+		case "/", "%":
+			if rf == 0 {
+				return nil, fmt.Errorf("division by zero")
+			}
+			if op == "/" {
+				return lf / rf, nil
+			}
+			return math.Mod(lf, rf), nil
+		}
+		switch {
+		case lf < rf:
+			return compare(op, -1), nil
+		case lf > rf:
+			return compare(op, 1), nil
+		}
+		return compare(op, 0), nil
+	}
+}
+
+// The result of a comparison operator, given the sign of the difference
+func compare(op string, sign int) bool {
+	switch op {
+	case "<":
+		return sign < 0
+	case "<=":
+		return sign <= 0
+	case ">":
+		return sign > 0
+	}
+	return sign >= 0
+}
+
+// Whether two values are equal, where ints and floats are compared as numbers
+func equal(l, r interface{}) bool {
+	lf, lok := toFloat(l)
+	rf, rok := toFloat(r)
+	if lok && rok {
+		return lf == rf
+	}
+	switch l.(type) {
+	case nil, bool, string:
+		return l == r
+	}
+	return false
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case int:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// Null, false, zero and the empty string are false, everything else is true
+func truthy(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case int:
+		return v != 0
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	}
+	return true
+}
+
+func typeName(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "bool"
+	case int, float64:
+		return "number"
+	case string:
+		return "string"
+	}
+	return fmt.Sprintf("%T", v)
+}
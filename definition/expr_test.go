@@ -0,0 +1,135 @@
+package definition
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestExpression(t *testing.T) {
+	fields := map[string]interface{}{
+		"pricePerUnit":    350,
+		"pricePerMeasure": 175,
+		"zero":            0,
+		"weight":          0.5,
+		"name":            "Apricot",
+		"empty":           "",
+	}
+
+	for _, test := range []struct {
+		source   string
+		expected interface{}
+		err      string
+	}{
+		{source: "pricePerUnit / pricePerMeasure", expected: 2},
+		{source: "1 + 2 * 3 - 4", expected: 3},
+		{source: "(1 + 2) * 3", expected: 9},
+		{source: "10 - 4 - 3", expected: 3},
+		{source: "7 % 4", expected: 3},
+		{source: "pricePerUnit * weight", expected: 175.0},
+		{source: "-weight", expected: -0.5},
+		{source: "1 / 4.0", expected: 0.25},
+		{source: `name + " x" + 2`, expected: "Apricot x2"},
+		{source: `name == "Apricot"`, expected: true},
+		{source: "pricePerUnit == 350.0", expected: true},
+		{source: "pricePerUnit >= pricePerMeasure && !empty", expected: true},
+		{source: "zero || name", expected: true},
+		{source: `"a" < "b"`, expected: true},
+		{source: `zero > 0 ? pricePerUnit / zero : "none"`, expected: "none"},
+		{source: "1 ? 2 ? 3 : 4 : 5", expected: 3},
+
+		// Missing variables are null, which spreads rather than failing
+		{source: "missing", expected: nil},
+		{source: "missing * 2 + 1", expected: nil},
+		{source: "missing > 1", expected: nil},
+		{source: "missing == null", expected: true},
+		{source: "missing ?? zero ?? 3", expected: 0},
+		{source: `(missing + "x") ?? name`, expected: "Apricot"},
+
+		// Errors when evaluating
+		{source: "pricePerUnit / zero", err: "division by zero"},
+		{source: "weight % 0", err: "division by zero"},
+		{source: "name * 2", err: "cannot apply * to string and number"},
+		{source: "-name", err: "cannot negate string"},
+
+		// Errors when compiling
+		{source: "1 +", err: "unexpected end of expression"},
+		{source: "(1 + 2", err: "expected ) at 6"},
+		{source: "1 ? 2", err: "expected : at 5"},
+		{source: `"open`, err: "unterminated string at 0"},
+		{source: "1 2", err: `unexpected "2" at 2`},
+		{source: "a # b", err: `unexpected '#' at 2`},
+	} {
+		eval, err := compileExpression(test.source)
+		var value interface{}
+		if err == nil {
+			value, err = eval(fields)
+		}
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("Expected %q to fail with %q, got %v", test.source, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Did not expect %q to fail, got %s", test.source, err)
+		} else if !reflect.DeepEqual(value, test.expected) {
+			t.Errorf("Expected %q to be %#v, got %#v", test.source, test.expected, value)
+		}
+	}
+}
+
+func TestComputed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "computed")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range map[string]string{
+		"list.definition": "<li>{{name}}</li>",
+		"list.computed": `
+			# Comments and blank lines are ignored
+			quantity = unit / measure
+
+			label = name + " x" + (quantity ?? "?")
+		`,
+		"bad.definition": "<li>{{name}}</li>",
+		"bad.computed":   "quantity unit / measure",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write %s: %s", name, err)
+		}
+	}
+
+	if _, err := NewDefinition(filepath.Join(dir, "bad.definition")); err == nil {
+		t.Errorf("Expected an error reading a bad computed file")
+	}
+
+	def, err := NewDefinition(filepath.Join(dir, "list.definition"))
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+
+	fields := map[string]interface{}{"name": "Apricot", "unit": 350, "measure": 175}
+	if errs := def.Computed.Apply(fields); len(errs) != 0 {
+		t.Errorf("Did not expect any errors, got %v", errs)
+	}
+	expected := map[string]interface{}{"name": "Apricot", "unit": 350, "measure": 175, "quantity": 2, "label": "Apricot x2"}
+	if !reflect.DeepEqual(fields, expected) {
+		t.Errorf("Expected %v, got %v", expected, fields)
+	}
+
+	// A field which can't be computed is left out, and the rest carry on
+	fields = map[string]interface{}{"name": "Apricot", "unit": 350, "measure": 0}
+	errs := def.Computed.Apply(fields)
+	if len(errs) != 1 || errs[0].Error() != "quantity: division by zero" {
+		t.Errorf("Expected a division by zero error, got %v", errs)
+	}
+	expected = map[string]interface{}{"name": "Apricot", "unit": 350, "measure": 0, "label": "Apricot x?"}
+	if !reflect.DeepEqual(fields, expected) {
+		t.Errorf("Expected %v, got %v", expected, fields)
+	}
+}
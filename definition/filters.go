@@ -1,6 +1,7 @@
 package definition
 
 import (
+	"fmt"
 	"html"
 	"log"
 	"math"
@@ -54,3 +55,46 @@ var filters = map[string]filterFunc{
 		return pennies
 	},
 }
+
+// Map a filter name to a function which will undo it, so that a value can be
+// rendered back into content that the filter would turn into that value.
+// Filters which can't be undone (such as lowercase) are left as they are
+var unfilters = map[string]unfilterFunc{
+	"trim":     func(v interface{}) string { return fmt.Sprint(v) },
+	"unescape": func(v interface{}) string { return html.EscapeString(fmt.Sprint(v)) },
+
+	// Removes the spaces that would be added before capitals
+	"respace": func(v interface{}) string {
+		str := fmt.Sprint(v)
+		for i := len(str) - 3; i >= 1; i-- {
+			if str[i] != ' ' {
+				continue
+			}
+			if (str[i+1] >= 'A' && str[i+1] <= 'Z') ||
+				(str[i+1] == '&') ||
+				(i+2 < len(str) && str[i+1] == 'x' && (str[i+2] >= '0' && str[i+2] <= '9')) {
+				str = str[:i] + str[i+1:]
+			}
+		}
+		return str
+	},
+
+	"pence": func(v interface{}) string {
+		var pennies int
+		switch v := v.(type) {
+		case int:
+			pennies = v
+		case float64: // As decoded from JSON
+			pennies = int(v)
+		default:
+			return fmt.Sprint(v)
+		}
+		return fmt.Sprintf("&pound%d.%02d", pennies/100, pennies%100)
+	},
+}
+
+// Filters which ignore whitespace around a value, so values can be padded
+var padded = map[string]bool{
+	"trim":  true,
+	"pence": true,
+}
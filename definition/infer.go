@@ -0,0 +1,580 @@
+package definition
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"log"
+	"strings"
+)
+
+// Example is a value which should be extracted from a page, along with the
+// name of the variable to extract it into
+type Example struct {
+	Name  string
+	Value string
+}
+
+// Infer will write a definition from a page and some of the values that should
+// be extracted from it. The smallest repeating block of the page containing
+// all of the values is found, the values become variables and anything which
+// differs from the next repetition of the block becomes a skip (`{{_}}`)
+//
+// If the resulting definition doesn't extract the examples when applied to
+// the page, a warning is logged
+func Infer(content string, examples []Example) (string, error) {
+	if len(examples) == 0 {
+		return "", fmt.Errorf("Error inferring definition: no examples given")
+	}
+
+	spans, err := findExamples(content, examples)
+	if err != nil {
+		return "", fmt.Errorf("Error inferring definition: %s", err)
+	}
+
+	tokens := tokenizeHTML(content)
+	closes := matchTags(content, tokens)
+
+	// The tokens which the first and last example fall in to
+	first, last := len(tokens), -1
+	for _, s := range spans {
+		if i := tokenAt(tokens, s.start); i < first {
+			first = i
+		}
+		if i := tokenAt(tokens, s.end-1); i > last {
+			last = i
+		}
+	}
+
+	a, b := findBlock(content, tokens, closes, first, last)
+	if a < 0 {
+		return "", fmt.Errorf("Error inferring definition: examples are not within a single element")
+	}
+	if b < 0 {
+		log.Printf("[Warning] The block <%s> doesn't repeat, no skips could be inferred", tagName(content[tokens[a].start:tokens[a].end]))
+	}
+
+	var repetition []blockToken
+	if b >= 0 {
+		repetition = blockTokens(content, tokens, b, closes[b], nil)
+	}
+	w := &definitionWriter{}
+	w.diff(blockTokens(content, tokens, a, closes[a], spans), repetition)
+	def := w.String()
+
+	verifyInferred(def, content, examples)
+	return def, nil
+}
+
+// An exampleSpan is where an example was found in the content
+type exampleSpan struct {
+	start   int
+	end     int
+	name    string
+	escaped bool
+}
+
+// Finds each of the examples in the content, ignoring whitespace. The values
+// are also searched for HTML escaped. When an example appears more than once,
+// the occurrence closest to the first example is used
+func findExamples(content string, examples []Example) ([]exampleSpan, error) {
+	ix := newIndex(content)
+	spans := make([]exampleSpan, 0, len(examples))
+
+	for i, example := range examples {
+		escaped := html.EscapeString(example.Value)
+		candidates := []string{
+			example.Value,
+			escaped,
+			strings.Replace(escaped, "£", "&pound;", -1),
+			strings.Replace(escaped, "£", "&pound", -1),
+		}
+
+		best := exampleSpan{start: -1}
+		for c, candidate := range candidates {
+			needle := stripWhitespaceBytes(candidate)
+			if len(needle) == 0 {
+				continue
+			}
+			for k := 0; ; k++ {
+				n := strings.Index(ix.stripped[k:], needle)
+				if n < 0 {
+					break
+				}
+				k += n
+				span := exampleSpan{
+					start:   int(ix.offsets[k]),
+					end:     int(ix.offsets[k+len(needle)-1]) + 1,
+					name:    example.Name,
+					escaped: c > 0,
+				}
+				if best.start < 0 || i > 0 && distance(span, spans[0]) < distance(best, spans[0]) {
+					best = span
+				}
+				if i == 0 {
+					break
+				}
+			}
+			if best.start >= 0 {
+				break
+			}
+		}
+		if best.start < 0 {
+			return nil, fmt.Errorf("could not find %q in the page", example.Value)
+		}
+		spans = append(spans, best)
+	}
+	return spans, nil
+}
+
+func distance(a, b exampleSpan) int {
+	if a.start > b.start {
+		return a.start - b.start
+	}
+	return b.start - a.start
+}
+
+// An htmlToken is either a tag (or comment), or the text between tags
+type htmlToken struct {
+	start int
+	end   int
+	tag   bool
+}
+
+// Elements which don't have a closing tag
+var voidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true,
+	"hr": true, "img": true, "input": true, "link": true, "meta": true,
+	"param": true, "source": true, "track": true, "wbr": true,
+}
+
+// Splits HTML into tags and text. This is deliberately forgiving, as it is only
+// used to find a sensible block to build a definition from
+func tokenizeHTML(content string) []htmlToken {
+	tokens := make([]htmlToken, 0, 100)
+	for i := 0; i < len(content); {
+		if content[i] != '<' {
+			end := strings.IndexByte(content[i:], '<')
+			if end < 0 {
+				end = len(content) - i
+			}
+			tokens = append(tokens, htmlToken{start: i, end: i + end})
+			i += end
+			continue
+		}
+
+		closer := ">"
+		if strings.HasPrefix(content[i:], "<!--") {
+			closer = "-->"
+		}
+		end := strings.Index(content[i:], closer)
+		if end < 0 {
+			end = len(content) - i
+		} else {
+			end += len(closer)
+		}
+		tokens = append(tokens, htmlToken{start: i, end: i + end, tag: true})
+		i += end
+
+		// The contents of scripts and styles are text, even if they look
+		// like tags
+		if name := tagName(content[i-end : i]); name == "script" || name == "style" {
+			raw := strings.Index(strings.ToLower(content[i:]), "</"+name)
+			if raw < 0 {
+				raw = len(content) - i
+			}
+			if raw > 0 {
+				tokens = append(tokens, htmlToken{start: i, end: i + raw})
+				i += raw
+			}
+		}
+	}
+	return tokens
+}
+
+// Returns the lowercase name of a tag, which is prefixed with a / for closing
+// tags. Comments and doctypes start with !
+func tagName(tag string) string {
+	end := 1
+	for end < len(tag) && !isWhitespace(tag[end]) && tag[end] != '>' && (tag[end] != '/' || end == 1) {
+		end++
+	}
+	return strings.ToLower(tag[1:end])
+}
+
+// Returns the value of a tag's class attribute
+func tagClass(tag string) string {
+	for _, quote := range []string{`"`, `'`} {
+		i := strings.Index(tag, "class="+quote)
+		if i < 0 {
+			continue
+		}
+		i += len("class=" + quote)
+		if end := strings.Index(tag[i:], quote); end >= 0 {
+			return strings.Join(strings.Fields(tag[i:i+end]), " ")
+		}
+	}
+	return ""
+}
+
+// Returns whether the tag opens an element which has a closing tag
+func isOpening(tag string) bool {
+	name := tagName(tag)
+	return len(name) > 0 && name[0] != '/' && name[0] != '!' && !voidElements[name] &&
+		!strings.HasSuffix(tag, "/>")
+}
+
+// Works out where each element closes, it is -1 for tokens which aren't
+// opening tags. Elements which are never closed are closed by their parent
+func matchTags(content string, tokens []htmlToken) []int {
+	closes := make([]int, len(tokens))
+	stack := make([]int, 0, 20)
+	for i, t := range tokens {
+		closes[i] = -1
+		if t.tag && isOpening(content[t.start:t.end]) {
+			stack = append(stack, i)
+			continue
+		}
+		name := ""
+		if t.tag {
+			name = tagName(content[t.start:t.end])
+		}
+		if len(name) < 2 || name[0] != '/' {
+			continue
+		}
+		for j := len(stack) - 1; j >= 0; j-- {
+			if tagName(content[tokens[stack[j]].start:tokens[stack[j]].end]) != name[1:] {
+				continue
+			}
+			for _, unclosed := range stack[j+1:] {
+				closes[unclosed] = i - 1
+			}
+			closes[stack[j]] = i
+			stack = stack[:j]
+			break
+		}
+	}
+	for _, unclosed := range stack {
+		closes[unclosed] = len(tokens) - 1
+	}
+	return closes
+}
+
+// Returns the index of the token which contains the position
+func tokenAt(tokens []htmlToken, pos int) int {
+	for i, t := range tokens {
+		if pos < t.end {
+			return i
+		}
+	}
+	return len(tokens) - 1
+}
+
+// Finds the innermost element which contains the tokens from first to last and
+// which repeats, returning it and the next (or previous) repetition of it. If
+// nothing repeats the innermost element is returned with -1
+func findBlock(content string, tokens []htmlToken, closes []int, first, last int) (int, int) {
+	innermost := -1
+	for a := first; a >= 0; a-- {
+		if closes[a] < last {
+			continue
+		}
+		if innermost < 0 {
+			innermost = a
+		}
+
+		// A repetition is an element with the same name and class
+		text := content[tokens[a].start:tokens[a].end]
+		key := tagName(text) + "." + tagClass(text)
+		previous := -1
+		for b := range tokens {
+			if b == a || closes[b] < 0 {
+				continue
+			}
+			other := content[tokens[b].start:tokens[b].end]
+			if tagName(other)+"."+tagClass(other) != key {
+				continue
+			}
+			if b > closes[a] {
+				return a, b
+			}
+			if closes[b] < a {
+				previous = b
+			}
+		}
+		if previous >= 0 {
+			return a, previous
+		}
+	}
+	return innermost, -1
+}
+
+// A blockToken is the text of a token along with any examples within it
+type blockToken struct {
+	text  string
+	tag   bool
+	spans []exampleSpan
+}
+
+// Returns the tokens from start to end, without any which are only whitespace.
+// Spans are made relative to the token they are in
+func blockTokens(content string, tokens []htmlToken, start, end int, spans []exampleSpan) []blockToken {
+	block := make([]blockToken, 0, end-start+1)
+	for _, t := range tokens[start : end+1] {
+		text := content[t.start:t.end]
+		if len(stripWhitespaceBytes(text)) == 0 {
+			continue
+		}
+		bt := blockToken{
+			text: text,
+			tag:  t.tag,
+		}
+		for _, s := range spans {
+			if s.start >= t.start && s.start < t.end {
+				s.start -= t.start
+				s.end -= t.start
+				if s.end > len(text) {
+					s.end = len(text)
+				}
+				bt.spans = append(bt.spans, s)
+			}
+		}
+		block = append(block, bt)
+	}
+	return block
+}
+
+// Tokens are the same if they only differ by whitespace, tokens containing
+// examples are never the same as they need to become variables
+func sameToken(a, b blockToken) bool {
+	return len(a.spans) == 0 && a.tag == b.tag &&
+		stripWhitespaceBytes(a.text) == stripWhitespaceBytes(b.text)
+}
+
+// A segment is a piece of the definition being written
+type segment struct {
+	text     string
+	skip     bool
+	variable bool
+}
+
+// The definitionWriter builds up a definition a line at a time, indenting by
+// how deeply nested the elements are
+type definitionWriter struct {
+	segments []segment
+	depth    int
+}
+
+// Diff writes a, making variables of its examples and skipping anything
+// which differs from b. The tokens are aligned by their longest common
+// subsequence
+func (w *definitionWriter) diff(a, b []blockToken) {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if sameToken(a[i], b[j]) {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var aRun, bRun []blockToken
+	flush := func() {
+		if len(aRun) > 0 {
+			w.differing(aRun, bRun)
+		}
+		aRun, bRun = nil, nil
+	}
+
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && sameToken(a[i], b[j]):
+			flush()
+			w.line(a[i], segment{text: a[i].text})
+			i++
+			j++
+		case j >= len(b) || i < len(a) && lcs[i+1][j] >= lcs[i][j+1]:
+			aRun = append(aRun, a[i])
+			i++
+		default:
+			bRun = append(bRun, b[j])
+			j++
+		}
+	}
+	flush()
+}
+
+// Writes tokens of a which differ from those in b. Without anything to compare
+// to, the tokens are kept as they are
+func (w *definitionWriter) differing(a, b []blockToken) {
+	for k, t := range a {
+		switch {
+		case len(a) == len(b) && t.tag == b[k].tag &&
+			(!t.tag || tagName(t.text) == tagName(b[k].text)):
+			w.line(t, diffToken(t, b[k].text)...)
+		case len(t.spans) > 0 || b == nil:
+			w.line(t, diffToken(t, t.text)...)
+		default:
+			w.line(t, segment{skip: true})
+		}
+	}
+}
+
+// Writes a line of segments for the token, opening and closing tags change the
+// indentation
+func (w *definitionWriter) line(t blockToken, segments ...segment) {
+	name := ""
+	if t.tag {
+		name = tagName(t.text)
+	}
+	if strings.HasPrefix(name, "/") && w.depth > 0 {
+		w.depth--
+	}
+	if len(w.segments) > 0 {
+		w.segments = append(w.segments, segment{text: "\n"})
+	}
+	w.segments = append(w.segments, segment{text: strings.Repeat("\t", w.depth)})
+
+	// Whitespace is ignored, so only keep it where it is within the line
+	segments[0].text = strings.TrimLeft(segments[0].text, " \t\n\r")
+	segments[len(segments)-1].text = strings.TrimRight(segments[len(segments)-1].text, " \t\n\r")
+	w.segments = append(w.segments, segments...)
+	if t.tag && isOpening(t.text) {
+		w.depth++
+	}
+}
+
+// Returns the segments for a token of a which differs from b. What they have
+// in common at the start and end is kept, and the rest becomes a skip or the
+// variables for the examples in a
+func diffToken(a blockToken, b string) []segment {
+	prefix := 0
+	for prefix < len(a.text) && prefix < len(b) && a.text[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a.text)-prefix && suffix < len(b)-prefix &&
+		a.text[len(a.text)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	if len(a.spans) == 0 {
+		// Don't split attributes or words, skip all of them
+		for prefix > 0 && !strings.ContainsRune("\"'=> \t\n\r", rune(a.text[prefix-1])) {
+			prefix--
+		}
+		end := len(a.text) - suffix
+		for end < len(a.text) && !strings.ContainsRune("\"'< \t\n\r", rune(a.text[end])) {
+			end++
+		}
+		if len(stripWhitespaceBytes(a.text[prefix:end])) == 0 {
+			return []segment{{text: a.text}}
+		}
+		return []segment{
+			{text: a.text[:prefix]},
+			{skip: true},
+			{text: a.text[end:]},
+		}
+	}
+
+	// Everything from the first example to the last is kept apart from what
+	// differs either side, which the variables will take in
+	first := a.spans[0]
+	last := a.spans[len(a.spans)-1]
+	if prefix > first.start {
+		prefix = first.start
+	}
+	if suffix > len(a.text)-last.end {
+		suffix = len(a.text) - last.end
+	}
+
+	segments := []segment{{text: a.text[:prefix]}}
+	for k, s := range a.spans {
+		if k > 0 {
+			segments = append(segments, segment{text: a.text[a.spans[k-1].end:s.start]})
+		}
+		filters := ""
+		if !a.tag {
+			filters += "|trim"
+		}
+		if s.escaped || strings.Contains(a.text[s.start:s.end], "&") {
+			filters += "|unescape"
+		}
+		segments = append(segments, segment{
+			text:     s.name + filters,
+			variable: true,
+		})
+	}
+	return append(segments, segment{text: a.text[len(a.text)-suffix:]})
+}
+
+// String returns the definition. Skips next to each other or next to a
+// variable are redundant, so are dropped
+func (w *definitionWriter) String() string {
+	var buf bytes.Buffer
+	last := segment{}
+	for k, s := range w.segments {
+		if s.skip {
+			if last.skip || last.variable || nextIsVariable(w.segments[k+1:]) {
+				continue
+			}
+			buf.WriteString(leftMeta + "_" + rightMeta)
+		} else if s.variable {
+			buf.WriteString(leftMeta + s.text + rightMeta)
+		} else {
+			buf.WriteString(s.text)
+			if len(stripWhitespaceBytes(s.text)) == 0 {
+				continue
+			}
+		}
+		last = s
+	}
+	return buf.String()
+}
+
+// Returns whether the next segment which isn't whitespace is a variable
+func nextIsVariable(segments []segment) bool {
+	for _, s := range segments {
+		if s.skip || s.variable {
+			return s.variable
+		}
+		if len(stripWhitespaceBytes(s.text)) > 0 {
+			return false
+		}
+	}
+	return false
+}
+
+// Applies the definition back to the content, and logs a warning for each
+// example that it doesn't extract
+func verifyInferred(def, content string, examples []Example) {
+	ast := &lexer{}
+	ast.tokenize(def)
+	parser := &DefinitionParser{
+		L:       ast,
+		filters: filters,
+	}
+	records := parser.Parse(content)
+
+	for _, example := range examples {
+		found := false
+		for _, record := range records {
+			value, ok := record[example.Name].(string)
+			if ok && strings.Contains(stripWhitespaceBytes(value), stripWhitespaceBytes(example.Value)) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			log.Printf("[Warning] The inferred definition does not extract %q into %s", example.Value, example.Name)
+		}
+	}
+}
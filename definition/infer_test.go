@@ -0,0 +1,90 @@
+package definition
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Three product tiles, in between some markup which doesn't repeat
+var inferPage = strings.Join([]string{
+	`<html><body><h1>Ripe &amp; ready</h1>`,
+	`<ul class="products">`,
+	`  <li class="product">`,
+	`    <a href="/shop/apricot.html" id="p1">`,
+	`      Apricot Ripe &amp; Ready`,
+	`      <img src="/img/apricot.jpg" />`,
+	`    </a>`,
+	`    <p class="pricePerUnit">&pound;3.50<abbr title="per">/</abbr>unit</p>`,
+	`  </li>`,
+	`  <li class="product">`,
+	`    <a href="/shop/avocado.html" id="p2">`,
+	`      Avocado XL`,
+	`      <img src="/img/avocado.jpg" />`,
+	`    </a>`,
+	`    <p class="pricePerUnit">&pound;1.80<abbr title="per">/</abbr>unit</p>`,
+	`  </li>`,
+	`  <li class="product">`,
+	`    <a href="/shop/kiwi.html" id="p3">`,
+	`      Kiwi`,
+	`      <img src="/img/kiwi.jpg" />`,
+	`    </a>`,
+	`    <p class="pricePerUnit">&pound;0.50<abbr title="per">/</abbr>unit</p>`,
+	`  </li>`,
+	`</ul>`,
+	`<p>&copy; 2016</p></body></html>`,
+}, "\n")
+
+func TestInfer(t *testing.T) {
+	def, err := Infer(inferPage, []Example{
+		{Name: "productName", Value: "Apricot Ripe & Ready"},
+		{Name: "pricePerUnit", Value: "£3.50"},
+	})
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+
+	expected := strings.Join([]string{
+		`<li class="product">`,
+		`	<a href="{{_}}">`,
+		`		{{productName|trim|unescape}}`,
+		`		<img src="{{_}}" />`,
+		`	</a>`,
+		`	<p class="pricePerUnit">`,
+		`		{{pricePerUnit|trim|unescape}}`,
+		`		<abbr title="per">`,
+		`			/`,
+		`		</abbr>`,
+		`		unit`,
+		`	</p>`,
+		`</li>`,
+	}, "\n")
+	if def != expected {
+		t.Errorf("Expected definition to be\n%s\ngot\n%s", expected, def)
+	}
+
+	ast := &lexer{}
+	ast.tokenize(def)
+	parser := &DefinitionParser{
+		L:       ast,
+		filters: filters,
+	}
+	vars := parser.Parse(inferPage)
+	expectedVars := []map[string]interface{}{
+		{"productName": "Apricot Ripe & Ready", "pricePerUnit": "£3.50"},
+		{"productName": "Avocado XL", "pricePerUnit": "£1.80"},
+		{"productName": "Kiwi", "pricePerUnit": "£0.50"},
+	}
+	if !reflect.DeepEqual(vars, expectedVars) {
+		t.Errorf("Expected vars to be %+v, got %+v", expectedVars, vars)
+	}
+}
+
+func TestInferMissingExample(t *testing.T) {
+	_, err := Infer(inferPage, []Example{
+		{Name: "productName", Value: "Banana"},
+	})
+	if err == nil {
+		t.Errorf("Expected an error for an example which isn't on the page")
+	}
+}
@@ -0,0 +1,203 @@
+package definition
+
+import (
+	"sort"
+	"strings"
+)
+
+// A matcher is a definition which has been compiled ahead of time. Text
+// tokens have their whitespace removed so they can be searched for in a
+// whitespace stripped copy of the content, rather than by trying every
+// position of the content in turn
+type matcher struct {
+	steps []step
+}
+
+// A step is an element of the AST along with anything that can be
+// precomputed for it
+type step struct {
+	token   token
+	content string
+
+	// For text, the content without whitespace and the whitespace which
+	// trails the last non-whitespace character
+	needle   string
+	trailing string
+
+	// For variables, the filters to be applied to the value in order
+	filters []filterFunc
+}
+
+// compile converts a flat AST into a matcher, resolving filter names against
+// the given filters. Unknown filters are dropped, as they would otherwise be
+// ignored at parse time
+func compile(ast []element, available map[string]filterFunc) *matcher {
+	m := &matcher{
+		steps: make([]step, len(ast)),
+	}
+	for i, el := range ast {
+		s := step{
+			token:   el.token,
+			content: el.content,
+		}
+		switch el.token {
+		case tokenText:
+			s.needle = stripWhitespaceBytes(el.content)
+			end := len(el.content)
+			for end > 0 && isWhitespace(el.content[end-1]) {
+				end--
+			}
+			s.trailing = el.content[end:]
+		case tokenVariable:
+			for j := i + 1; j < len(ast); j++ {
+				if ast[j].token == tokenPipe {
+					continue
+				} else if ast[j].token != tokenFilter {
+					break
+				}
+				if f, found := available[ast[j].content]; found {
+					s.filters = append(s.filters, f)
+				}
+			}
+		}
+		m.steps[i] = s
+	}
+	return m
+}
+
+// An index is the content with whitespace removed, along with where each of
+// the remaining bytes came from
+type index struct {
+	content  string
+	stripped string
+	offsets  []int32
+}
+
+// newIndex builds an index over the content, this is a single pass
+func newIndex(content string) *index {
+	ix := &index{}
+	ix.extend(content)
+	return ix
+}
+
+// extend adds more content to the end of the index. Only the new content is
+// indexed, so that content which arrives a chunk at a time isn't indexed over
+// and over
+func (ix *index) extend(more string) {
+	base := len(ix.content)
+	b := make([]byte, 0, len(more))
+	for i := 0; i < len(more); i++ {
+		if isWhitespace(more[i]) {
+			continue
+		}
+		b = append(b, more[i])
+		ix.offsets = append(ix.offsets, int32(base+i))
+	}
+	ix.content += more
+	ix.stripped += string(b)
+}
+
+// drop removes the first n bytes of the content from the index
+func (ix *index) drop(n int) {
+	if n == 0 {
+		return
+	}
+	k := sort.Search(len(ix.offsets), func(i int) bool {
+		return int(ix.offsets[i]) >= n
+	})
+	ix.offsets = ix.offsets[:copy(ix.offsets, ix.offsets[k:])]
+	for i := range ix.offsets {
+		ix.offsets[i] -= int32(n)
+	}
+	ix.content = ix.content[n:]
+	ix.stripped = ix.stripped[k:]
+}
+
+// find returns the first position at or after pos where the content has the
+// step's text as a prefix (as HasPrefixIgnoreWhitespace would see it), along
+// with the offset to the end of that prefix
+func (ix *index) find(pos int, s *step) (int, int, bool) {
+
+	// Whitespace only text will match almost anywhere, so just try each
+	// position in turn
+	if len(s.needle) == 0 {
+		for ; pos < len(ix.content); pos++ {
+			if p, o := HasPrefixIgnoreWhitespace(ix.content[pos:], s.content); p {
+				return pos, o, true
+			}
+		}
+		return 0, 0, false
+	}
+
+	k := sort.Search(len(ix.offsets), func(i int) bool {
+		return int(ix.offsets[i]) >= pos
+	})
+	n := strings.Index(ix.stripped[k:], s.needle)
+	if n < 0 {
+		return 0, 0, false
+	}
+	k += n
+
+	// The earliest position to match is the whitespace leading up to the
+	// first character, but not before where we were asked to look from
+	start := pos
+	if k > 0 && int(ix.offsets[k-1])+1 > start {
+		start = int(ix.offsets[k-1]) + 1
+	}
+
+	// Trailing whitespace in the text is consumed the same way that
+	// HasPrefixIgnoreWhitespace would. If that fails then only whitespace
+	// remains, and so there can't be a later match either
+	end := int(ix.offsets[k+len(s.needle)-1]) + 1
+	o, ok := consumeWhitespace(ix.content[end:], s.trailing)
+	if !ok {
+		return 0, 0, false
+	}
+	return start, end + o - start, true
+}
+
+// resume returns the earliest position from pos at which the step's text could
+// still be found, if more content were to be added to the end
+func (ix *index) resume(pos int, s *step) int {
+	c := len(ix.stripped) - len(s.needle)
+	if c <= 0 {
+		return pos
+	}
+	if p := int(ix.offsets[c-1]) + 1; p > pos {
+		return p
+	}
+	return pos
+}
+
+// consumeWhitespace walks the whitespace at the start of s against the
+// whitespace ws, returning how much of s was consumed
+func consumeWhitespace(s, ws string) (int, bool) {
+	i := 0
+	j := 0
+	for i < len(ws) {
+		if j >= len(s) {
+			return 0, false
+		}
+		if s[j] == ws[i] {
+			j++
+			i++
+		} else if isWhitespace(s[j]) {
+			j++
+		} else {
+			i++
+		}
+	}
+	return j, true
+}
+
+// Removes the same whitespace that isWhitespace checks for, which is
+// narrower than stripWhitespace
+func stripWhitespaceBytes(str string) string {
+	b := make([]byte, 0, len(str))
+	for i := 0; i < len(str); i++ {
+		if !isWhitespace(str[i]) {
+			b = append(b, str[i])
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,236 @@
+package definition
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// referenceParse is Parse as it was before definitions were compiled, trying
+// every position of the content in turn. The compiled matcher must give
+// identical results
+func referenceParse(def *DefinitionParser, content string) []map[string]interface{} {
+
+	data := make([]map[string]interface{}, 0, 10)
+
+	// Nothing to do
+	if len(def.L.ast) == 0 {
+		return data
+	}
+
+	pos := 0
+	tokenIndex := 0
+	fields := make(map[string]interface{}, 10)
+
+	variableStart := 0
+	variableName := ""
+	variableTokenIndex := 0
+
+	for {
+		currentToken := def.L.ast[tokenIndex]
+		tokenContent := currentToken.content
+
+		switch currentToken.token {
+
+		default:
+			// Not a match, reset
+			fallthrough
+		case tokenEOF:
+			// EOF means we want to retry applying our definition to
+			// newly seen text to see if we can get multiple
+			data = append(data, fields)
+			fields = make(map[string]interface{}, 10)
+			tokenIndex = 0
+			pos -= 1
+			continue
+		case tokenText:
+			// If there is some token text, we care about previous
+			// state and can just determine if we're looking into a
+			// variable or not and handle it in different ways
+			if p, o := HasPrefixIgnoreWhitespace(content[pos:], tokenContent); p {
+
+				// If we're looking to fill in a variable name
+				if len(variableName) > 0 {
+
+					// Do nothing
+					if variableName == "_" {
+						variableStart = 0
+						variableName = ""
+						variableTokenIndex = 0
+						continue
+					}
+
+					// While there are no more filters
+					filtersToApply := make([]string, 0, 3)
+					for j := 1; ; j++ {
+						if variableTokenIndex+j >= len(def.L.ast) {
+							break
+						}
+						tok := def.L.ast[variableTokenIndex+j]
+						if tok.token == tokenPipe {
+							continue
+						} else if tok.token == tokenFilter {
+							filtersToApply = append(filtersToApply, tok.content)
+						} else {
+							break
+						}
+					}
+					fields[variableName] = content[variableStart-1 : pos]
+
+					// Apply any filters
+					for _, filter := range filtersToApply {
+						filterFunc, found := def.filters[filter]
+						if found {
+							fields[variableName] = filterFunc(fields[variableName].(string))
+						}
+					}
+
+					// Reset variable
+					variableStart = 0
+					variableName = ""
+					variableTokenIndex = 0
+				}
+				pos += o
+				tokenIndex++
+			}
+		case tokenFilter,
+			tokenPipe,
+			tokenRightMeta:
+			tokenIndex++
+		case tokenLeftMeta:
+			// Can optimize and fall through to the proceeding state
+			tokenIndex++
+			fallthrough
+		case tokenVariable:
+			// Keep track of our position and the name of the variable
+			variableStart = pos
+			variableName = def.L.ast[tokenIndex].content
+			variableTokenIndex = tokenIndex
+			tokenIndex++
+		}
+
+		pos++
+		if pos >= len(content) {
+			break
+		}
+	}
+	return data
+}
+
+// Produces content which is mostly made up of the definition's own text so
+// that there are plenty of near misses, with whitespace shuffled around
+func generateContent(r *rand.Rand, definition string, size int) string {
+	pieces := []string{"<", ">", "a", "\"", "=", "/", "1", "£", " ", "\n", "\t", "\r"}
+	for _, f := range strings.Fields(strings.NewReplacer("{{", " ", "}}", " ").Replace(definition)) {
+		pieces = append(pieces, f, f, f)
+	}
+	var b strings.Builder
+	for b.Len() < size {
+		b.WriteString(pieces[r.Intn(len(pieces))])
+		if r.Intn(3) == 0 {
+			b.WriteString([]string{" ", "\n", "\t", "  ", "\r\n"}[r.Intn(5)])
+		}
+	}
+	return b.String()
+}
+
+func TestCompiledMatchesReference(t *testing.T) {
+	definitions := []string{
+		`<a href="{{someLink}}">{{someLinkText}}</a>`,
+		`<a href="{{someLink|lowercase}}">{{someLinkText|lowercase|uppercase|trim}}</a>`,
+		"<p>\n\t{{a}}\n\t</p>\n",
+		"<i>{{a}} {{b}} <b>{{_}}</b>",
+		"x{{a}}<",
+		"\t< a >{{_}}< / a >{{b|pence}}=\r\n",
+	}
+	for _, file := range []string{
+		"../definitions/sainsburys-list.definition",
+		"../definitions/sainsburys-product.definition",
+	} {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatalf("failed to read definition: %s", err)
+		}
+		definitions = append(definitions, string(b))
+	}
+
+	r := rand.New(rand.NewSource(1))
+	for _, definition := range definitions {
+		ast := &lexer{}
+		ast.tokenize(definition)
+		def := &DefinitionParser{
+			L:       ast,
+			filters: filters,
+			m:       compile(ast.ast, filters),
+		}
+
+		for i := 0; i < 200; i++ {
+			content := generateContent(r, definition, r.Intn(2000))
+			expected := referenceParse(def, content)
+			vars := def.Parse(content)
+			if !reflect.DeepEqual(vars, expected) {
+				t.Fatalf("Definition %q on content %q\nexpected %+v, got %+v", definition, content, expected, vars)
+			}
+		}
+	}
+}
+
+func TestConsumeWhitespace(t *testing.T) {
+	for _, test := range []struct {
+		str      string
+		ws       string
+		offset   int
+		consumed bool
+	}{
+		{str: "\n\n\tX", ws: "\n\t", offset: 3, consumed: true},
+		{str: "  \nX", ws: "\n", offset: 3, consumed: true},
+		{str: "  X", ws: "\n", offset: 2, consumed: true},
+		{str: "X", ws: "", offset: 0, consumed: true},
+		{str: "  ", ws: "\n", offset: 0, consumed: false},
+	} {
+		offset, consumed := consumeWhitespace(test.str, test.ws)
+		if consumed != test.consumed {
+			t.Errorf("Expected consumed to be %t, got %t", test.consumed, consumed)
+		}
+		if offset != test.offset {
+			t.Errorf("Expected offset to be %d, got %d", test.offset, offset)
+		}
+	}
+}
+
+// A page of a few MB made up of product descriptions with near misses in
+// between, which is the worst case for trying every position
+func largePage(b *testing.B) (*DefinitionParser, string) {
+	def, err := NewDefinition("../definitions/sainsburys-product.definition")
+	if err != nil {
+		b.Fatalf("failed to read definition: %s", err)
+	}
+	var page strings.Builder
+	for page.Len() < 4<<20 {
+		for j := 0; j < 20; j++ {
+			page.WriteString("\n\t<meta name=\"description\" property=\"apricots\"/>")
+		}
+		page.WriteString(`<meta name="description" content="Apricots &amp; more"/>` + "\n")
+	}
+	return def, page.String()
+}
+
+func BenchmarkParseLargePage(b *testing.B) {
+	def, page := largePage(b)
+	b.SetBytes(int64(len(page)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		def.Parse(page)
+	}
+}
+
+func BenchmarkReferenceParseLargePage(b *testing.B) {
+	def, page := largePage(b)
+	b.SetBytes(int64(len(page)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		referenceParse(def, page)
+	}
+}
@@ -0,0 +1,106 @@
+package definition
+
+import (
+	"io"
+	"strings"
+)
+
+// ProvenanceKey is the field that provenance is attached under, it holds a
+// map of variable names to their Provenance
+const ProvenanceKey = "_provenance"
+
+// Provenance records where the value of a field came from, so that if it
+// looks wrong the content that produced it can be found
+type Provenance struct {
+	// The text that was matched, before any filters were applied
+	Raw string `json:"raw"`
+
+	// Where the text started in the content, the offset is in bytes and
+	// the line starts at 1
+	Offset int `json:"offset"`
+	Line   int `json:"line"`
+
+	// Where the content came from, such as a URL
+	Source string `json:"source,omitempty"`
+
+	// The definition file which was applied and a hash of its contents
+	Definition     string `json:"definition,omitempty"`
+	DefinitionHash string `json:"definitionHash,omitempty"`
+}
+
+// ParseWithProvenance is Parse, but every record will have a map of
+// Provenance for each of its fields under the ProvenanceKey
+func (def *DefinitionParser) ParseWithProvenance(content, source string) []map[string]interface{} {
+	return def.parse(content, def.tracer(source))
+}
+
+// ParseReaderWithProvenance is ParseReader, but every record will have a map
+// of Provenance for each of its fields under the ProvenanceKey
+func (def *DefinitionParser) ParseReaderWithProvenance(
+	r io.Reader,
+	source string,
+	emit func(map[string]interface{}) error,
+) error {
+	return def.parseReader(r, emit, def.tracer(source))
+}
+
+func (def *DefinitionParser) tracer(source string) *tracer {
+	return &tracer{
+		source: source,
+		file:   def.File,
+		hash:   def.Hash,
+		line:   1,
+	}
+}
+
+// A tracer keeps track of where in the overall content a scanner is, as the
+// start of the content may have been discarded
+type tracer struct {
+	source string
+	file   string
+	hash   string
+
+	// The offset of the start of the content that the scanner can see
+	offset int
+
+	// Lines are counted incrementally, this is the position that they
+	// have been counted up to and the line that position is on
+	counted int
+	line    int
+}
+
+// Attaches provenance for the variable to the fields
+func (t *tracer) attach(fields map[string]interface{}, variable, content string, start, end int) {
+	p, ok := fields[ProvenanceKey].(map[string]Provenance)
+	if !ok {
+		p = make(map[string]Provenance, 10)
+		fields[ProvenanceKey] = p
+	}
+	p[variable] = Provenance{
+		Raw:            content[start:end],
+		Offset:         t.offset + start,
+		Line:           t.lineAt(content, start),
+		Source:         t.source,
+		Definition:     t.file,
+		DefinitionHash: t.hash,
+	}
+}
+
+// Returns the line that the position is on
+func (t *tracer) lineAt(content string, pos int) int {
+	if pos >= t.counted {
+		t.line += strings.Count(content[t.counted:pos], "\n")
+	} else {
+		t.line -= strings.Count(content[pos:t.counted], "\n")
+	}
+	t.counted = pos
+	return t.line
+}
+
+// Discard moves the tracer along when the first n bytes of the content are
+// dropped
+func (t *tracer) discard(content string, n int) {
+	t.lineAt(content, n)
+	t.counted -= n
+	t.offset += n
+}
@@ -0,0 +1,76 @@
+package definition
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestParseWithProvenance(t *testing.T) {
+	ast := &lexer{}
+	ast.tokenize(`<a href="{{someLink}}">{{someLinkText|lowercase}}</a>`)
+	def := &DefinitionParser{
+		L:       ast,
+		filters: filters,
+		File:    "links.definition",
+		Hash:    "abc",
+	}
+
+	content := strings.Join([]string{
+		`This should be skipped`,
+		`<a href="SomeLink1">SomeLinkText1</a>`,
+		`<a href="SomeLink2">`,
+		`SomeLinkText2</a>`,
+		`This should be skipped`,
+	}, "\n")
+
+	expected := []map[string]interface{}{
+		{
+			"someLink":     "SomeLink1",
+			"someLinkText": "somelinktext1",
+			ProvenanceKey: map[string]Provenance{
+				"someLink": {
+					Raw: "SomeLink1", Offset: 32, Line: 2,
+					Source: "http://example.com/", Definition: "links.definition", DefinitionHash: "abc",
+				},
+				"someLinkText": {
+					Raw: "SomeLinkText1", Offset: 43, Line: 2,
+					Source: "http://example.com/", Definition: "links.definition", DefinitionHash: "abc",
+				},
+			},
+		},
+		{
+			"someLink":     "SomeLink2",
+			"someLinkText": "\nsomelinktext2",
+			ProvenanceKey: map[string]Provenance{
+				"someLink": {
+					Raw: "SomeLink2", Offset: 70, Line: 3,
+					Source: "http://example.com/", Definition: "links.definition", DefinitionHash: "abc",
+				},
+				"someLinkText": {
+					Raw: "\nSomeLinkText2", Offset: 81, Line: 3,
+					Source: "http://example.com/", Definition: "links.definition", DefinitionHash: "abc",
+				},
+			},
+		},
+	}
+
+	vars := def.ParseWithProvenance(content, "http://example.com/")
+	if !reflect.DeepEqual(vars, expected) {
+		t.Errorf("Expected vars to be %+v, got %+v", expected, vars)
+	}
+
+	vars = make([]map[string]interface{}, 0, 10)
+	reader := iotest.OneByteReader(strings.NewReader(content))
+	err := def.ParseReaderWithProvenance(reader, "http://example.com/", func(fields map[string]interface{}) error {
+		vars = append(vars, fields)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	if !reflect.DeepEqual(vars, expected) {
+		t.Errorf("Expected streamed vars to be %+v, got %+v", expected, vars)
+	}
+}
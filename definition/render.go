@@ -0,0 +1,86 @@
+package definition
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// The text rendered for skips (`{{_}}`)
+const skipFiller = "skipped"
+
+// Render runs the definition forwards, like a template, writing a block for
+// each of the records. Parsing the result will give back the records, so it
+// can be used to test definitions and to generate content to parse
+//
+// Filters are undone where they can be, values which filters would change
+// (such as an uppercase value given to lowercase) can't be round tripped
+func (def *DefinitionParser) Render(records []map[string]interface{}) (string, error) {
+	var buf bytes.Buffer
+
+	for i, record := range records {
+		for j, el := range def.L.ast {
+			switch el.token {
+			case tokenText:
+				buf.WriteString(el.content)
+			case tokenVariable:
+				value, err := renderVariable(def.L.ast, j, record)
+				if err != nil {
+					return "", fmt.Errorf("Error rendering record %d: %s", i, err)
+				}
+				buf.WriteString(value)
+			}
+		}
+	}
+
+	// Parsing needs something after the last block to know that it has
+	// ended
+	buf.WriteString("\n<!-- end -->\n")
+	return buf.String(), nil
+}
+
+// Renders the variable at index i of the AST from the record
+func renderVariable(ast []element, i int, record map[string]interface{}) (string, error) {
+	name := ast[i].content
+
+	names := make([]string, 0, 3)
+	for j := i + 1; j < len(ast); j++ {
+		if ast[j].token == tokenPipe {
+			continue
+		} else if ast[j].token != tokenFilter {
+			break
+		}
+		names = append(names, ast[j].content)
+	}
+
+	if name == "_" {
+		return skipFiller, nil
+	}
+
+	v, found := record[name]
+	if !found {
+		return "", fmt.Errorf("no value for %s", name)
+	}
+
+	// Undo the filters in reverse
+	value := fmt.Sprint(v)
+	canPad := false
+	for j := len(names) - 1; j >= 0; j-- {
+		if unfilter, found := unfilters[names[j]]; found {
+			value = unfilter(v)
+		}
+		v = value
+		canPad = canPad || padded[names[j]]
+	}
+
+	// A variable can only end after its own tokens have been stepped over,
+	// which is one position for the name and each pipe, filter and }}
+	min := 3 + 2*len(names)
+	if len(value) < min {
+		if !canPad {
+			return "", fmt.Errorf("value %q for %s is too short to be parsed back, it needs to be %d long", value, name, min)
+		}
+		value = strings.Repeat(" ", min-len(value)) + value
+	}
+	return value, nil
+}
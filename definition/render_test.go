@@ -0,0 +1,82 @@
+package definition
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRenderRoundTrip(t *testing.T) {
+	for _, test := range []struct {
+		definition string
+		records    []map[string]interface{}
+	}{
+		{
+			definition: "../definitions/sainsburys-list.definition",
+			records: []map[string]interface{}{
+				{
+					"productPath":     "http://example.com/apricot.html?a=1&b=2",
+					"productName":     "Apricot Ripe & Ready x5",
+					"imagePath":       "http://example.com/apricot.jpg",
+					"pricePerUnit":    350,
+					"pricePerMeasure": 70,
+				},
+				{
+					"productPath":     "http://example.com/kiwi.html",
+					"productName":     "Kiwi",
+					"imagePath":       "http://example.com/kiwi.jpg",
+					"pricePerUnit":    5,
+					"pricePerMeasure": 0,
+				},
+			},
+		},
+		{
+			definition: "../definitions/sainsburys-product.definition",
+			records: []map[string]interface{}{
+				{"description": `Apricots "ripe" & ready`},
+			},
+		},
+	} {
+		def, err := NewDefinition(test.definition)
+		if err != nil {
+			t.Fatalf("failed to read definition: %s", err)
+		}
+
+		content, err := def.Render(test.records)
+		if err != nil {
+			t.Fatalf("Did not expect to receive an error, got %s", err)
+		}
+
+		vars := def.Parse(content)
+		if !reflect.DeepEqual(vars, test.records) {
+			t.Errorf("Expected vars to be %+v, got %+v", test.records, vars)
+		}
+	}
+}
+
+func TestRenderErrors(t *testing.T) {
+	ast := &lexer{}
+	ast.tokenize(`<a href="{{link}}">{{text|trim}}</a>`)
+	def := &DefinitionParser{
+		L:       ast,
+		filters: filters,
+	}
+
+	for _, records := range [][]map[string]interface{}{
+		{{"text": "missing link"}},
+		{{"link": "/a", "text": "too short"}},
+	} {
+		if _, err := def.Render(records); err == nil {
+			t.Errorf("Expected an error rendering %+v", records)
+		}
+	}
+
+	// Trim means short values can be padded
+	content, err := def.Render([]map[string]interface{}{{"link": "/ab", "text": "a"}})
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	if !strings.Contains(content, `<a href="/ab">    a</a>`) {
+		t.Errorf("Expected the text to be padded, got %q", content)
+	}
+}
@@ -0,0 +1,186 @@
+package definition
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// RulesExtension is the extension of the manifest of rules for a definition,
+// which sits next to it with the same name. For sainsburys-list.definition it
+// is sainsburys-list.rules:
+//
+//	{
+//	    "productName": {"required": true, "maxLength": 200},
+//	    "pricePerUnit": {"required": true, "min": 1},
+//	    "unit": {"default": "each", "enum": ["each", "kg"]}
+//	}
+const RulesExtension = ".rules"
+
+// Rules are the rules for each variable of a definition
+type Rules map[string]Rule
+
+// A Rule is what a variable has to satisfy for a record to be accepted
+type Rule struct {
+	// The variable has to be in the record, after the default is applied
+	Required bool `json:"required"`
+
+	// Used when the variable is missing. Whole numbers become ints, as with
+	// the pence filter
+	Default interface{} `json:"default"`
+
+	// The value (as printed) has to be one of these
+	Enum []string `json:"enum"`
+
+	// Numeric values have to be within these
+	Min *float64 `json:"min"`
+	Max *float64 `json:"max"`
+
+	// String values have to be within these lengths, in characters. Zero
+	// means no limit
+	MinLength int `json:"minLength"`
+	MaxLength int `json:"maxLength"`
+}
+
+// A Rejection is a record which broke the rules, and why
+type Rejection struct {
+	Fields map[string]interface{} `json:"fields"`
+	Field  string                 `json:"field"`
+	Reason string                 `json:"reason"`
+}
+
+// Reads the rules manifest for a definition file, which is optional
+func loadRules(definitionFile string) (Rules, error) {
+	rulesFile := strings.TrimSuffix(definitionFile, filepath.Ext(definitionFile)) + RulesExtension
+	b, err := ioutil.ReadFile(rulesFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error opening rules file: %s", err)
+	}
+
+	rules := make(Rules, 10)
+	if err := json.Unmarshal(b, &rules); err != nil {
+		return nil, fmt.Errorf("Error decoding rules file: %s", err)
+	}
+	for name, rule := range rules {
+		if f, ok := rule.Default.(float64); ok && f == math.Trunc(f) {
+			rule.Default = int(f)
+			rules[name] = rule
+		}
+	}
+	return rules, nil
+}
+
+// Defaults fills in the defaults for the variables missing from a record, so
+// that what is computed from them can see them
+func (rules Rules) Defaults(fields map[string]interface{}) {
+	for name, rule := range rules {
+		if _, found := fields[name]; !found && rule.Default != nil {
+			fields[name] = rule.Default
+		}
+	}
+}
+
+// Check applies the rules to each record, filling in defaults. It returns the
+// records which were accepted and those which were rejected
+func (rules Rules) Check(records []map[string]interface{}) ([]map[string]interface{}, []Rejection) {
+	if len(rules) == 0 {
+		return records, nil
+	}
+
+	// Check the variables in a predictable order, so the reason is too
+	names := make([]string, 0, len(rules))
+	for name := range rules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	accepted := make([]map[string]interface{}, 0, len(records))
+	var rejected []Rejection
+	for _, fields := range records {
+		field, reason := "", ""
+		for _, name := range names {
+			if reason = rules[name].check(name, fields); reason != "" {
+				field = name
+				break
+			}
+		}
+		if reason != "" {
+			rejected = append(rejected, Rejection{
+				Fields: fields,
+				Field:  field,
+				Reason: reason,
+			})
+			continue
+		}
+		accepted = append(accepted, fields)
+	}
+	return accepted, rejected
+}
+
+// Checks one variable of a record, returning why it was rejected or an empty
+// string if it wasn't
+func (rule Rule) check(name string, fields map[string]interface{}) string {
+	value, found := fields[name]
+	if !found && rule.Default != nil {
+		value, found = rule.Default, true
+		fields[name] = value
+	}
+	if !found {
+		if rule.Required {
+			return fmt.Sprintf("%s is missing", name)
+		}
+		return ""
+	}
+
+	if len(rule.Enum) > 0 {
+		printed := fmt.Sprint(value)
+		allowed := false
+		for _, e := range rule.Enum {
+			if e == printed {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Sprintf("%s %q is not one of %s", name, printed, strings.Join(rule.Enum, ", "))
+		}
+	}
+
+	switch v := value.(type) {
+	case int:
+		return rule.checkRange(name, float64(v))
+	case float64:
+		return rule.checkRange(name, v)
+	case string:
+		length := utf8.RuneCountInString(v)
+		if rule.MinLength > 0 && length < rule.MinLength {
+			return fmt.Sprintf("%s is shorter than %d characters", name, rule.MinLength)
+		}
+		if rule.MaxLength > 0 && length > rule.MaxLength {
+			return fmt.Sprintf("%s is longer than %d characters", name, rule.MaxLength)
+		}
+		if rule.Min != nil || rule.Max != nil {
+			return fmt.Sprintf("%s %q is not a number", name, v)
+		}
+	}
+	return ""
+}
+
+func (rule Rule) checkRange(name string, v float64) string {
+	if rule.Min != nil && v < *rule.Min {
+		return fmt.Sprintf("%s %v is less than %v", name, v, *rule.Min)
+	}
+	if rule.Max != nil && v > *rule.Max {
+		return fmt.Sprintf("%s %v is more than %v", name, v, *rule.Max)
+	}
+	return ""
+}
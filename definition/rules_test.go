@@ -0,0 +1,100 @@
+package definition
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRulesCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rules")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range map[string]string{
+		"list.definition": "<li>{{name}}</li>",
+		"list.rules": `{
+			"name": {"required": true, "minLength": 3, "maxLength": 10},
+			"price": {"required": true, "min": 1, "max": 1000},
+			"unit": {"default": "each", "enum": ["each", "kg"]},
+			"stock": {"default": 0}
+		}`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write %s: %s", name, err)
+		}
+	}
+
+	def, err := NewDefinition(filepath.Join(dir, "list.definition"))
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+
+	for _, test := range []struct {
+		fields   map[string]interface{}
+		expected map[string]interface{}
+		reason   string
+	}{
+		{
+			fields:   map[string]interface{}{"name": "Apricot", "price": 350},
+			expected: map[string]interface{}{"name": "Apricot", "price": 350, "unit": "each", "stock": 0},
+		},
+		{
+			fields:   map[string]interface{}{"name": "Apricot", "price": 350, "unit": "kg"},
+			expected: map[string]interface{}{"name": "Apricot", "price": 350, "unit": "kg", "stock": 0},
+		},
+		{
+			fields: map[string]interface{}{"name": "Apricot"},
+			reason: "price is missing",
+		},
+		{
+			fields: map[string]interface{}{"name": "Apricot", "price": 0},
+			reason: "price 0 is less than 1",
+		},
+		{
+			fields: map[string]interface{}{"name": "Apricot", "price": 1350.5},
+			reason: "price 1350.5 is more than 1000",
+		},
+		{
+			fields: map[string]interface{}{"name": "Apricot", "price": "free"},
+			reason: `price "free" is not a number`,
+		},
+		{
+			fields: map[string]interface{}{"name": "Fi", "price": 350},
+			reason: "name is shorter than 3 characters",
+		},
+		{
+			fields: map[string]interface{}{"name": "Apricot Ripe & Ready", "price": 350},
+			reason: "name is longer than 10 characters",
+		},
+		{
+			fields: map[string]interface{}{"name": "Apricot", "price": 350, "unit": "g"},
+			reason: `unit "g" is not one of each, kg`,
+		},
+	} {
+		accepted, rejected := def.Rules.Check([]map[string]interface{}{test.fields})
+		if test.reason == "" {
+			if len(rejected) != 0 || len(accepted) != 1 {
+				t.Errorf("Expected %v to be accepted, got %+v", test.fields, rejected)
+			} else if !reflect.DeepEqual(accepted[0], test.expected) {
+				t.Errorf("Expected %v, got %v", test.expected, accepted[0])
+			}
+			continue
+		}
+		if len(accepted) != 0 || len(rejected) != 1 {
+			t.Errorf("Expected %v to be rejected, got %v", test.fields, accepted)
+		} else if rejected[0].Reason != test.reason {
+			t.Errorf("Expected the reason to be %q, got %q", test.reason, rejected[0].Reason)
+		}
+	}
+
+	// Without rules everything is accepted
+	records := []map[string]interface{}{{"name": "Fi"}}
+	if accepted, rejected := Rules(nil).Check(records); len(accepted) != 1 || rejected != nil {
+		t.Errorf("Expected everything to be accepted without rules, got %v", rejected)
+	}
+}
@@ -0,0 +1,276 @@
+package definition
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"sort"
+	"strings"
+)
+
+// SchemaDraft is the JSON Schema draft which schemas are written for
+const SchemaDraft = "http://json-schema.org/draft-07/schema#"
+
+// Schema is a JSON Schema, as much of it as is needed to describe what
+// definitions produce
+type Schema struct {
+	Draft       string `json:"$schema,omitempty"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+
+	// The version of the schema, which has to change whenever the schema
+	// does. Not a JSON Schema keyword, but allowed as one
+	Version string `json:"version,omitempty"`
+
+	Type       string             `json:"type,omitempty"`
+	Properties map[string]*Schema `json:"properties,omitempty"`
+	Required   []string           `json:"required,omitempty"`
+	Items      *Schema            `json:"items,omitempty"`
+
+	// Used with a null schema for values which might be null
+	AnyOf []*Schema `json:"anyOf,omitempty"`
+
+	Enum      []string    `json:"enum,omitempty"`
+	Default   interface{} `json:"default,omitempty"`
+	Minimum   *float64    `json:"minimum,omitempty"`
+	Maximum   *float64    `json:"maximum,omitempty"`
+	MinLength int         `json:"minLength,omitempty"`
+	MaxLength int         `json:"maxLength,omitempty"`
+}
+
+// The type of the values each filter gives, when it is the last filter of a
+// variable. Anything else gives a string
+var filterTypes = map[string]string{
+	"pence": "integer",
+}
+
+// RecordSchema returns the schema of one of the records which the definition
+// produces, from its variables and filters along with its rules and computed
+// fields
+func (def *DefinitionParser) RecordSchema() *Schema {
+	s := &Schema{
+		Type:       "object",
+		Properties: make(map[string]*Schema),
+		Required:   make([]string, 0, 10),
+	}
+
+	// Every variable is in every record, with the type of its last filter
+	ast := def.L.ast
+	for i, el := range ast {
+		if el.token != tokenVariable || el.content == "_" {
+			continue
+		}
+		t := "string"
+		for j := i + 1; j < len(ast) && (ast[j].token == tokenPipe || ast[j].token == tokenFilter); j++ {
+			if ast[j].token == tokenFilter {
+				t = filterTypes[ast[j].content]
+				if t == "" {
+					t = "string"
+				}
+			}
+		}
+		if _, found := s.Properties[el.content]; !found {
+			s.Required = append(s.Required, el.content)
+		}
+		s.Properties[el.content] = &Schema{Type: t}
+	}
+
+	// Computed fields are left out when they are null, and their type
+	// depends on the values
+	for _, field := range def.Computed {
+		s.Properties[field.Name] = &Schema{
+			Description: fmt.Sprintf("Computed as %s", field.Source),
+		}
+	}
+
+	for name, rule := range def.Rules {
+		p, found := s.Properties[name]
+		if !found {
+			p = &Schema{}
+			s.Properties[name] = p
+		}
+		if rule.Required || rule.Default != nil {
+			if !containsString(s.Required, name) {
+				s.Required = append(s.Required, name)
+			}
+		}
+		p.Enum = rule.Enum
+		p.Default = rule.Default
+		p.Minimum = rule.Min
+		p.Maximum = rule.Max
+		p.MinLength = rule.MinLength
+		p.MaxLength = rule.MaxLength
+	}
+
+	sort.Strings(s.Required)
+	return s
+}
+
+// Schema returns the schema of what the bundle produces, which is an object
+// with the result of each definition by name
+func (b *Bundle) Schema() *Schema {
+	s := &Schema{
+		Type:       "object",
+		Properties: make(map[string]*Schema, len(b.entries)),
+		Required:   b.Names(),
+	}
+	for _, entry := range b.entries {
+		record := entry.def.RecordSchema()
+		switch {
+		case entry.Field != "":
+			field, found := record.Properties[entry.Field]
+			if !found {
+				field = &Schema{}
+			}
+			s.Properties[entry.Name] = Nullable(field)
+		case entry.Single:
+			s.Properties[entry.Name] = Nullable(record)
+		default:
+			s.Properties[entry.Name] = ListOf(record)
+		}
+	}
+	return s
+}
+
+// ListOf returns the schema of a list of items
+func ListOf(items *Schema) *Schema {
+	return &Schema{
+		Type:  "array",
+		Items: items,
+	}
+}
+
+// Nullable returns the schema of something which might be null
+func Nullable(s *Schema) *Schema {
+	return &Schema{
+		AnyOf: []*Schema{s, {Type: "null"}},
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// GoTypes returns Go type declarations for the schema, the top level type
+// being named name and any nested objects being named after it
+func (s *Schema) GoTypes(pkg, name string) (string, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by scraper schema. DO NOT EDIT.\n\npackage %s\n", pkg)
+
+	w := &goWriter{
+		buf:   &buf,
+		names: make(map[string]bool),
+	}
+	t := w.goType(s, goName(name))
+	if t != goName(name) {
+		fmt.Fprintf(&buf, "\ntype %s %s\n", goName(name), t)
+	}
+
+	b, err := format.Source(buf.Bytes())
+	if err != nil {
+		return "", fmt.Errorf("Error formatting Go types: %s", err)
+	}
+	return string(b), nil
+}
+
+type goWriter struct {
+	buf   *bytes.Buffer
+	names map[string]bool
+}
+
+// Returns the Go type of the schema, writing out a struct for it if it is an
+// object
+func (w *goWriter) goType(s *Schema, name string) string {
+	if len(s.AnyOf) > 0 {
+		var t string
+		for _, option := range s.AnyOf {
+			if option.Type != "null" {
+				t = w.goType(option, name)
+			}
+		}
+		if t == "" || t == "interface{}" || strings.HasPrefix(t, "[]") {
+			return "interface{}"
+		}
+		return "*" + t
+	}
+
+	switch s.Type {
+	case "string":
+		return "string"
+	case "integer":
+		return "int"
+	case "number":
+		return "float64"
+	case "boolean":
+		return "bool"
+	case "array":
+		if s.Items == nil {
+			return "[]interface{}"
+		}
+		return "[]" + w.goType(s.Items, name+"Item")
+	case "object":
+	default:
+		return "interface{}"
+	}
+
+	for w.names[name] {
+		name += "_"
+	}
+	w.names[name] = true
+
+	fields := make([]string, 0, len(s.Properties))
+	for field := range s.Properties {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	// Write nested types first, then this one
+	types := make([]string, len(fields))
+	for i, field := range fields {
+		types[i] = w.goType(s.Properties[field], name+goName(field))
+	}
+
+	fmt.Fprintf(w.buf, "\ntype %s struct {\n", name)
+	for i, field := range fields {
+		tag := field
+		if !containsString(s.Required, field) {
+			tag += ",omitempty"
+		}
+		if p := s.Properties[field]; p.Description != "" {
+			fmt.Fprintf(w.buf, "// %s\n", p.Description)
+		}
+		fmt.Fprintf(w.buf, "%s %s `json:%q`\n", goName(field), types[i], tag)
+	}
+	fmt.Fprintf(w.buf, "}\n")
+	return name
+}
+
+// Turns a field name into an exported Go name, e.g. price-per_unit is
+// PricePerUnit
+func goName(s string) string {
+	var b strings.Builder
+	upper := true
+	for _, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9':
+			if upper {
+				b.WriteString(strings.ToUpper(string(r)))
+			} else {
+				b.WriteRune(r)
+			}
+			upper = false
+		default:
+			upper = true
+		}
+	}
+	name := b.String()
+	if name == "" || name[0] >= '0' && name[0] <= '9' {
+		name = "X" + name
+	}
+	return name
+}
@@ -0,0 +1,92 @@
+package definition
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRecordSchema(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schema")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range map[string]string{
+		"list.definition":  `<li id="{{_}}"><a>{{name|trim}}</a><em>{{price|trim|pence}}</em></li>`,
+		"list.rules":       `{"price": {"min": 1}, "unit": {"default": "each", "enum": ["each", "kg"]}}`,
+		"list.computed":    "double = price * 2",
+		"total.definition": "<p>{{total|pence}}</p>",
+		"page.bundle": `{
+			"products": {"definition": "list.definition"},
+			"first": {"definition": "list.definition", "single": true},
+			"total": {"definition": "total.definition", "field": "total"}
+		}`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write %s: %s", name, err)
+		}
+	}
+
+	def, err := NewDefinition(filepath.Join(dir, "list.definition"))
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+
+	min := 1.0
+	expected := &Schema{
+		Type: "object",
+		Properties: map[string]*Schema{
+			"name":   {Type: "string"},
+			"price":  {Type: "integer", Minimum: &min},
+			"unit":   {Enum: []string{"each", "kg"}, Default: "each"},
+			"double": {Description: "Computed as price * 2"},
+		},
+		Required: []string{"name", "price", "unit"},
+	}
+	record := def.RecordSchema()
+	if !reflect.DeepEqual(record, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, record)
+	}
+
+	bundle, err := NewBundle(filepath.Join(dir, "page.bundle"))
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	s := bundle.Schema()
+	if !reflect.DeepEqual(s.Required, []string{"first", "products", "total"}) {
+		t.Errorf("Expected every entry to be required, got %v", s.Required)
+	}
+	if !reflect.DeepEqual(s.Properties["products"], ListOf(expected)) {
+		t.Errorf("Expected products to be a list of records, got %+v", s.Properties["products"])
+	}
+	if !reflect.DeepEqual(s.Properties["first"], Nullable(expected)) {
+		t.Errorf("Expected first to be a record or null, got %+v", s.Properties["first"])
+	}
+	if !reflect.DeepEqual(s.Properties["total"], Nullable(&Schema{Type: "integer"})) {
+		t.Errorf("Expected total to be an integer or null, got %+v", s.Properties["total"])
+	}
+
+	types, err := s.GoTypes("products", "page")
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	for _, line := range []string{
+		"package products",
+		"type PageProductsItem struct {",
+		"\tPrice  int         `json:\"price\"`",
+		"\tDouble interface{} `json:\"double,omitempty\"`",
+		"type Page struct {",
+		"\tFirst    *PageFirst         `json:\"first\"`",
+		"\tProducts []PageProductsItem `json:\"products\"`",
+		"\tTotal    *int               `json:\"total\"`",
+	} {
+		if !strings.Contains(types, line+"\n") {
+			t.Errorf("Expected the Go types to contain %q, got\n%s", line, types)
+		}
+	}
+}
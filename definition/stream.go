@@ -0,0 +1,127 @@
+package definition
+
+import (
+	"fmt"
+	"io"
+)
+
+// The amount read from a stream at a time
+const streamChunkSize = 32 * 1024
+
+// Called with how much content is held after each read, for tests to check
+// that it stays bounded
+var buffered = func(n int) {}
+
+// ParseReader is Parse for content which is read from a stream. Each block is
+// passed to emit as soon as it has been matched, and content is dropped once
+// no match can reach back to it, so memory is bounded by the span of the
+// definition rather than by the size of the content.
+//
+// It gives the same results as calling Parse with the entire content. If emit
+// returns an error then parsing stops and that error is returned
+func (def *DefinitionParser) ParseReader(
+	r io.Reader,
+	emit func(map[string]interface{}) error,
+) error {
+	return def.parseReader(r, emit, nil)
+}
+
+// ParseReader, optionally keeping track of provenance
+func (def *DefinitionParser) parseReader(
+	r io.Reader,
+	emit func(map[string]interface{}) error,
+	trace *tracer,
+) error {
+
+	// Nothing to do
+	if len(def.L.ast) == 0 {
+		return nil
+	}
+
+	scanners := []*scanner{newScanner(def.compiled(), trace)}
+	return scanReader(r, scanners, func(_ int, fields map[string]interface{}) error {
+		return emit(fields)
+	})
+}
+
+// ScanReader applies all of the scanners to content read from r at the same
+// time. Each block is passed to emit along with the index of the scanner which
+// matched it
+func scanReader(
+	r io.Reader,
+	scanners []*scanner,
+	emit func(int, map[string]interface{}) error,
+) error {
+
+	ix := newIndex("")
+	chunk := make([]byte, streamChunkSize)
+
+	for {
+		n, err := r.Read(chunk)
+		eof := err == io.EOF
+		if err != nil && !eof {
+			return fmt.Errorf("Error reading content: %s", err)
+		}
+		if n == 0 && !eof {
+			continue
+		}
+
+		// Only the new content is indexed, what is kept from before already
+		// has been
+		ix.extend(string(chunk[:n]))
+		buffered(len(ix.content))
+		if err := scanIndex(ix, scanners, emit); err != nil {
+			return err
+		}
+		if eof {
+			return nil
+		}
+
+		// Drop what none of the scanners need any more from the front,
+		// if none of them need anything then there's no need to read any
+		// further
+		d := -1
+		for _, s := range scanners {
+			if s.finished() {
+				continue
+			}
+			if n := s.discardable(); d < 0 || n < d {
+				d = n
+			}
+		}
+		if d < 0 {
+			return nil
+		}
+		for _, s := range scanners {
+			if !s.finished() {
+				s.discard(ix, d)
+			}
+		}
+		ix.drop(d)
+	}
+}
+
+// Advances all of the scanners together over the index, each matching a block
+// in turn, until none of them can match any more of it
+func scanIndex(
+	ix *index,
+	scanners []*scanner,
+	emit func(int, map[string]interface{}) error,
+) error {
+	for {
+		matched := false
+		for i, s := range scanners {
+			fields := s.next(ix)
+			if fields == nil {
+				continue
+			}
+			matched = true
+			if err := emit(i, fields); err != nil {
+				return err
+			}
+		}
+		if !matched {
+			return nil
+		}
+	}
+}
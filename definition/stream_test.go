@@ -0,0 +1,130 @@
+package definition
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestParseReader(t *testing.T) {
+	definitions := []string{
+		`<a href="{{someLink}}">{{someLinkText|lowercase}}</a>`,
+		"<p>\n\t{{a}}\n\t</p>\n",
+		"<i>{{a}} {{b}} <b>{{_}}</b>",
+	}
+
+	r := rand.New(rand.NewSource(2))
+	for _, definition := range definitions {
+		ast := &lexer{}
+		ast.tokenize(definition)
+		def := &DefinitionParser{
+			L:       ast,
+			filters: filters,
+			m:       compile(ast.ast, filters),
+		}
+
+		for i := 0; i < 50; i++ {
+			content := generateContent(r, definition, r.Intn(20000))
+			expected := def.Parse(content)
+
+			for _, reader := range []io.Reader{
+				strings.NewReader(content),
+				iotest.HalfReader(strings.NewReader(content)),
+				iotest.DataErrReader(iotest.OneByteReader(strings.NewReader(content))),
+			} {
+				vars := make([]map[string]interface{}, 0, 10)
+				err := def.ParseReader(reader, func(fields map[string]interface{}) error {
+					vars = append(vars, fields)
+					return nil
+				})
+				if err != nil {
+					t.Fatalf("Did not expect to receive an error, got %s", err)
+				}
+				if !reflect.DeepEqual(vars, expected) {
+					t.Fatalf("Definition %q on content %q\nexpected %+v, got %+v", definition, content, expected, vars)
+				}
+			}
+		}
+	}
+}
+
+func TestParseReaderEmitError(t *testing.T) {
+	ast := &lexer{}
+	ast.tokenize(`<a>{{text}}</a>`)
+	def := &DefinitionParser{
+		L:       ast,
+		filters: filters,
+	}
+
+	stop := errors.New("stop")
+	calls := 0
+	err := def.ParseReader(strings.NewReader("<a>one</a><a>two</a> EOF"), func(map[string]interface{}) error {
+		calls++
+		return stop
+	})
+	if err != stop {
+		t.Errorf("Expected error to be %s, got %v", stop, err)
+	}
+	if calls != 1 {
+		t.Errorf("Expected emit to be called once, got %d", calls)
+	}
+}
+
+// Repeats a block until it has given size bytes
+type repeatReader struct {
+	block string
+	size  int
+	read  int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	if r.read >= r.size {
+		return 0, io.EOF
+	}
+	n := 0
+	for n < len(p) && r.read < r.size {
+		p[n] = r.block[r.read%len(r.block)]
+		n++
+		r.read++
+	}
+	return n, nil
+}
+
+func TestParseReaderBounded(t *testing.T) {
+	ast := &lexer{}
+	ast.tokenize("<li>\n\t<a href=\"{{link}}\">{{text}}</a>\n</li>")
+	def := &DefinitionParser{
+		L:       ast,
+		filters: filters,
+		m:       compile(ast.ast, filters),
+	}
+
+	most := 0
+	defer func(b func(int)) { buffered = b }(buffered)
+	buffered = func(n int) {
+		if n > most {
+			most = n
+		}
+	}
+
+	block := "<li>\n\t<a href=\"/p/1\">One</a>\n</li>\n"
+	size := 16 * 1024 * 1024
+	records := 0
+	err := def.ParseReader(&repeatReader{block: block, size: size}, func(map[string]interface{}) error {
+		records++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	if records != size/len(block) {
+		t.Errorf("Expected %d records, got %d", size/len(block), records)
+	}
+	if most > 2*streamChunkSize {
+		t.Errorf("Expected no more than %d bytes to be held at once, got %d", 2*streamChunkSize, most)
+	}
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// The diff command compares the records of two runs, matched by an identity
+// field, and reports which were added, removed and changed. The runs are
+// either the latest two of a profile in a sqlite sink's database, or two
+// NDJSON files (from the ndjson sink), e.g.
+//
+//	scraper diff -db scrapes.db -profile sainsburys -threshold pricePerUnit=10%
+//	scraper diff -format json yesterday.ndjson today.ndjson
+//
+// A threshold marks a change to a field as significant when it is at least
+// that much, either a percentage of the old value or an amount
+func diffCommand(args []string) error {
+	flags := flag.NewFlagSet("diff", flag.ContinueOnError)
+	db := flags.String("db", "", "the database of a sqlite sink to compare runs from")
+	profile := flags.String("profile", "sainsburys", "the profile whose runs to compare, with -db")
+	from := flags.String("from", "", "the run to compare from, with -db, defaults to the one before -to")
+	to := flags.String("to", "", "the run to compare to, with -db, defaults to the latest")
+	identity := flags.String("identity", "productPath", "the field which identifies a record")
+	format := flags.String("format", "table", "table or json")
+	significant := flags.Bool("significant", false, "only report significant changes")
+	thresholds := thresholdFlags{}
+	flags.Var(thresholds, "threshold", "field=10% or field=50, when a change to a field is significant. Can be given more than once")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var old, new []map[string]interface{}
+	var err error
+	switch {
+	case *db != "" && flags.NArg() == 0:
+		old, new, err = loadRuns(*db, tableName(*profile), *from, *to)
+	case *db == "" && flags.NArg() == 2:
+		if old, err = readNDJSON(flags.Arg(0)); err == nil {
+			new, err = readNDJSON(flags.Arg(1))
+		}
+	default:
+		return fmt.Errorf("usage: scraper diff [-identity field] [-threshold field=10%%]... [-significant] [-format table|json] -db scrapes.db [-profile name] [-from run] [-to run]\n       scraper diff [options] old.ndjson new.ndjson")
+	}
+	if err != nil {
+		return err
+	}
+
+	d := diffRecords(old, new, *identity, thresholds)
+	if *significant {
+		d = d.significant()
+	}
+
+	switch *format {
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "    ")
+		return encoder.Encode(d)
+	case "table":
+		return d.writeTable(os.Stdout, *identity)
+	}
+	return fmt.Errorf("unknown format %q", *format)
+}
+
+// A threshold is how much a field has to change by to be significant
+type threshold struct {
+	Amount  float64
+	Percent bool
+}
+
+// The thresholds given with -threshold, by field
+type thresholdFlags map[string]threshold
+
+func (t thresholdFlags) String() string {
+	fields := make([]string, 0, len(t))
+	for field, th := range t {
+		if th.Percent {
+			fields = append(fields, fmt.Sprintf("%s=%v%%", field, th.Amount))
+		} else {
+			fields = append(fields, fmt.Sprintf("%s=%v", field, th.Amount))
+		}
+	}
+	sort.Strings(fields)
+	return strings.Join(fields, ",")
+}
+
+func (t thresholdFlags) Set(value string) error {
+	i := strings.Index(value, "=")
+	if i < 0 {
+		return fmt.Errorf("expected field=amount or field=percent%%")
+	}
+	field, amount := value[:i], value[i+1:]
+	th := threshold{
+		Percent: strings.HasSuffix(amount, "%"),
+	}
+	var err error
+	th.Amount, err = strconv.ParseFloat(strings.TrimSuffix(amount, "%"), 64)
+	if err != nil || th.Amount < 0 {
+		return fmt.Errorf("invalid threshold %q", amount)
+	}
+	t[field] = th
+	return nil
+}
+
+// Whether the change from old to new meets the threshold, only numbers can
+func (th threshold) met(old, new interface{}) bool {
+	o, ok := toNumber(old)
+	if !ok {
+		return false
+	}
+	n, ok := toNumber(new)
+	if !ok {
+		return false
+	}
+	change := math.Abs(n - o)
+	if th.Percent {
+		if o == 0 {
+			return change > 0
+		}
+		return change/math.Abs(o)*100 >= th.Amount
+	}
+	return change >= th.Amount
+}
+
+func toNumber(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// Diff is the difference between the records of two runs
+type Diff struct {
+	Added   []map[string]interface{} `json:"added"`
+	Removed []map[string]interface{} `json:"removed"`
+	Changed []RecordChanges          `json:"changed"`
+}
+
+// RecordChanges are the changes to the fields of a record in both runs
+type RecordChanges struct {
+	Identity interface{} `json:"identity"`
+	Changes  []Change    `json:"changes"`
+}
+
+// A Change is a field which is different between runs. Significant is whether
+// it met the threshold for the field
+type Change struct {
+	Field       string      `json:"field"`
+	Old         interface{} `json:"old"`
+	New         interface{} `json:"new"`
+	Significant bool        `json:"significant"`
+}
+
+// Compares the records of two runs, matched by the identity field. Fields
+// starting with an underscore (such as _provenance and _scraped_at) and
+// records without an identity are left out
+func diffRecords(old, new []map[string]interface{}, identity string, thresholds map[string]threshold) Diff {
+	d := Diff{
+		Added:   make([]map[string]interface{}, 0),
+		Removed: make([]map[string]interface{}, 0),
+		Changed: make([]RecordChanges, 0),
+	}
+
+	byIdentity := func(records []map[string]interface{}) (map[string]map[string]interface{}, []string) {
+		m := make(map[string]map[string]interface{}, len(records))
+		keys := make([]string, 0, len(records))
+		for _, record := range records {
+			id, found := record[identity]
+			if !found || id == nil {
+				continue
+			}
+			key := fmt.Sprint(id)
+			if _, found := m[key]; !found {
+				keys = append(keys, key)
+			}
+			m[key] = record
+		}
+		sort.Strings(keys)
+		return m, keys
+	}
+	oldRecords, oldKeys := byIdentity(old)
+	newRecords, newKeys := byIdentity(new)
+
+	for _, key := range oldKeys {
+		if _, found := newRecords[key]; !found {
+			d.Removed = append(d.Removed, oldRecords[key])
+		}
+	}
+	for _, key := range newKeys {
+		o, found := oldRecords[key]
+		n := newRecords[key]
+		if !found {
+			d.Added = append(d.Added, n)
+			continue
+		}
+
+		fields := make([]string, 0, len(n))
+		for field := range o {
+			fields = append(fields, field)
+		}
+		for field := range n {
+			if _, found := o[field]; !found {
+				fields = append(fields, field)
+			}
+		}
+		sort.Strings(fields)
+
+		changes := make([]Change, 0)
+		for _, field := range fields {
+			if strings.HasPrefix(field, "_") || sameValue(o[field], n[field]) {
+				continue
+			}
+			th, found := thresholds[field]
+			changes = append(changes, Change{
+				Field:       field,
+				Old:         o[field],
+				New:         n[field],
+				Significant: found && th.met(o[field], n[field]),
+			})
+		}
+		if len(changes) > 0 {
+			d.Changed = append(d.Changed, RecordChanges{
+				Identity: n[identity],
+				Changes:  changes,
+			})
+		}
+	}
+	return d
+}
+
+// Whether two values are the same, where numbers are compared as numbers (ints
+// from records, floats from JSON)
+func sameValue(a, b interface{}) bool {
+	an, aok := toNumber(a)
+	bn, bok := toNumber(b)
+	if aok && bok {
+		return an == bn
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// Leaves only the significant changes
+func (d Diff) significant() Diff {
+	changed := make([]RecordChanges, 0, len(d.Changed))
+	for _, record := range d.Changed {
+		changes := make([]Change, 0, len(record.Changes))
+		for _, change := range record.Changes {
+			if change.Significant {
+				changes = append(changes, change)
+			}
+		}
+		if len(changes) > 0 {
+			record.Changes = changes
+			changed = append(changed, record)
+		}
+	}
+	d.Changed = changed
+	return d
+}
+
+// Writes the diff as a table, with significant changes marked with a *
+func (d Diff) writeTable(w io.Writer, identity string) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "CHANGE\tIDENTITY\tFIELD\tOLD\tNEW\tDIFFERENCE")
+	for _, record := range d.Added {
+		fmt.Fprintf(tw, "added\t%v\t\t\t\t\n", record[identity])
+	}
+	for _, record := range d.Removed {
+		fmt.Fprintf(tw, "removed\t%v\t\t\t\t\n", record[identity])
+	}
+	for _, record := range d.Changed {
+		for _, change := range record.Changes {
+			difference := ""
+			o, oldOk := toNumber(change.Old)
+			n, newOk := toNumber(change.New)
+			if oldOk && newOk {
+				difference = fmt.Sprintf("%+g", n-o)
+				if o != 0 {
+					difference += fmt.Sprintf(" (%+.1f%%)", (n-o)/math.Abs(o)*100)
+				}
+			}
+			if change.Significant {
+				difference += " *"
+			}
+			fmt.Fprintf(tw, "changed\t%v\t%s\t%v\t%v\t%s\n", record.Identity, change.Field, printable(change.Old), printable(change.New), difference)
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "\n%d added, %d removed, %d changed\n", len(d.Added), len(d.Removed), len(d.Changed))
+	return err
+}
+
+// How a value is shown in the table, missing values are a dash
+func printable(v interface{}) interface{} {
+	if v == nil {
+		return "-"
+	}
+	return v
+}
+
+// Reads records from a file of JSON, one per line
+func readNDJSON(file string) ([]map[string]interface{}, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("could not open %s: %s", file, err)
+	}
+	defer f.Close()
+
+	records := make([]map[string]interface{}, 0, 100)
+	decoder := json.NewDecoder(bufio.NewReader(f))
+	for {
+		var record map[string]interface{}
+		err := decoder.Decode(&record)
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not decode %s: %s", file, err)
+		}
+		records = append(records, record)
+	}
+}
+
+// Loads the records of two runs from the <table>_runs table of a sqlite sink's
+// database. Without runs given, they are the latest two with records
+func loadRuns(file, table, from, to string) ([]map[string]interface{}, []map[string]interface{}, error) {
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not open %s: %s", file, err)
+	}
+	defer db.Close()
+
+	runs := table + "_runs"
+	if to == "" {
+		if err := db.QueryRow(fmt.Sprintf("SELECT max(%s) FROM %s", quoteIdentifier(runIDColumn), quoteIdentifier(runs))).Scan(&to); err != nil {
+			return nil, nil, fmt.Errorf("could not find the latest run of %s: %s", table, err)
+		}
+	}
+	if from == "" {
+		var previous sql.NullString
+		query := fmt.Sprintf("SELECT max(%s) FROM %s WHERE %s < ?", quoteIdentifier(runIDColumn), quoteIdentifier(runs), quoteIdentifier(runIDColumn))
+		if err := db.QueryRow(query, to).Scan(&previous); err != nil {
+			return nil, nil, fmt.Errorf("could not find the run before %s: %s", to, err)
+		}
+		if !previous.Valid {
+			return nil, nil, fmt.Errorf("there is no run of %s before %s", table, to)
+		}
+		from = previous.String
+	}
+
+	old, err := runRecords(db, runs, from)
+	if err != nil {
+		return nil, nil, err
+	}
+	new, err := runRecords(db, runs, to)
+	if err != nil {
+		return nil, nil, err
+	}
+	return old, new, nil
+}
+
+// Reads the records of a run, leaving out the columns which are null
+func runRecords(db *sql.DB, table, runID string) ([]map[string]interface{}, error) {
+	rows, err := db.Query(fmt.Sprintf("SELECT * FROM %s WHERE %s = ?", quoteIdentifier(table), quoteIdentifier(runIDColumn)), runID)
+	if err != nil {
+		return nil, fmt.Errorf("could not read run %s: %s", runID, err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, fmt.Errorf("could not read run %s: %s", runID, err)
+	}
+	records := make([]map[string]interface{}, 0, 100)
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, fmt.Errorf("could not read run %s: %s", runID, err)
+		}
+
+		record := make(map[string]interface{}, len(columns))
+		for i, column := range columns {
+			switch v := values[i].(type) {
+			case nil:
+			case int64:
+				record[column] = int(v)
+			case []byte:
+				record[column] = string(v)
+			default:
+				record[column] = v
+			}
+		}
+		records = append(records, record)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not read run %s: %s", runID, err)
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("there are no records of run %s in %s", runID, table)
+	}
+	return records, nil
+}
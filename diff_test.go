@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDiffRecords(t *testing.T) {
+	old := []map[string]interface{}{
+		{"productPath": "/apricot", "productName": "Apricot", "pricePerUnit": 350, "_scraped_at": "yesterday"},
+		{"productPath": "/kiwi", "productName": "Kiwi", "pricePerUnit": 175},
+		{"productPath": "/fig", "productName": "Fig", "pricePerUnit": 200},
+		{"productName": "Mystery"},
+	}
+	new := []map[string]interface{}{
+		{"productPath": "/apricot", "productName": "Apricot", "pricePerUnit": 300.0, "_scraped_at": "today"},
+		{"productPath": "/kiwi", "productName": "Kiwi Gold", "pricePerUnit": 170},
+		{"productPath": "/fig", "productName": "Fig", "pricePerUnit": 200.0},
+		{"productPath": "/plum", "productName": "Plum", "pricePerUnit": 90},
+	}
+
+	thresholds := thresholdFlags{}
+	if err := thresholds.Set("pricePerUnit=10%"); err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	if err := thresholds.Set("pricePerUnit=ten"); err == nil {
+		t.Errorf("Expected an invalid threshold to fail")
+	}
+
+	d := diffRecords(old, new, "productPath", thresholds)
+	expected := Diff{
+		Added:   []map[string]interface{}{new[3]},
+		Removed: []map[string]interface{}{},
+		Changed: []RecordChanges{
+			{
+				Identity: "/apricot",
+				Changes: []Change{
+					{Field: "pricePerUnit", Old: 350, New: 300.0, Significant: true},
+				},
+			},
+			{
+				Identity: "/kiwi",
+				Changes: []Change{
+					{Field: "pricePerUnit", Old: 175, New: 170, Significant: false},
+					{Field: "productName", Old: "Kiwi", New: "Kiwi Gold", Significant: false},
+				},
+			},
+		},
+	}
+	if !reflect.DeepEqual(d, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, d)
+	}
+
+	significant := d.significant()
+	if len(significant.Changed) != 1 || significant.Changed[0].Identity != "/apricot" {
+		t.Errorf("Expected only the apricot to change significantly, got %+v", significant.Changed)
+	}
+
+	var buf bytes.Buffer
+	if err := d.writeTable(&buf, "productPath"); err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	// Ignoring the padding at the end of lines
+	lines := strings.Split(buf.String(), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " ")
+	}
+	table := strings.Join(lines, "\n")
+	for _, line := range []string{
+		"CHANGE   IDENTITY  FIELD         OLD   NEW        DIFFERENCE\n",
+		"added    /plum\n",
+		"changed  /apricot  pricePerUnit  350   300        -50 (-14.3%) *\n",
+		"changed  /kiwi     pricePerUnit  175   170        -5 (-2.9%)\n",
+		"changed  /kiwi     productName   Kiwi  Kiwi Gold\n",
+		"1 added, 0 removed, 2 changed",
+	} {
+		if !strings.Contains(table, line) {
+			t.Errorf("Expected the table to contain %q, got\n%s", line, table)
+		}
+	}
+}
+
+func TestLoadRuns(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diff")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "scrapes.db")
+
+	for _, price := range []int{350, 300} {
+		sink, err := openSinks([]string{"sqlite:" + file}, sinkOptions{Identity: "productPath"})
+		if err != nil {
+			t.Fatalf("Did not expect to receive an error, got %s", err)
+		}
+		err = sink.Write(Output{
+			Profile: "sainsburys",
+			Records: []map[string]interface{}{
+				{"productPath": "/apricot", "pricePerUnit": price},
+			},
+		})
+		if err != nil {
+			t.Fatalf("Did not expect to receive an error, got %s", err)
+		}
+		sink.Close()
+	}
+
+	old, new, err := loadRuns(file, "sainsburys", "", "")
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	d := diffRecords(old, new, "productPath", nil)
+	expected := []RecordChanges{
+		{
+			Identity: "/apricot",
+			Changes:  []Change{{Field: "pricePerUnit", Old: 350, New: 300}},
+		},
+	}
+	if !reflect.DeepEqual(d.Changed, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, d.Changed)
+	}
+
+	if _, _, err := loadRuns(file, "sainsburys", "", old[0]["_run_id"].(string)); err == nil {
+		t.Errorf("Expected there to be no run before the first")
+	}
+}
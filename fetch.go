@@ -0,0 +1,159 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+// The flags for how pages are fetched, which the commands that fetch share.
+// The readers of the profiles are wrapped in order from the network out:
+//
+//	http options, sessions, rate limits, robots.txt, retries, the cache, local files,
+//	then the archive, WARC file and fixtures which keep what was fetched
+type fetchFlags struct {
+	httpOptions *string
+	robots      *bool
+	limits      HostLimits
+	attempts    *int
+	retry       RetryPolicy
+	cacheDir    *string
+	cacheOnly   *bool
+	cacheSize   *int64
+	archiveDir  *string
+	warcFile    *string
+	recordDir   *string
+	replayDir   *string
+}
+
+// What has been opened for fetching, which has to be closed after
+type fetching struct {
+	cache *HTTPCache
+	warc  *WARCFile
+	jars  []*CookieJar
+}
+
+// Adds the flags for how pages are fetched
+func newFetchFlags(flags *flag.FlagSet) *fetchFlags {
+	f := &fetchFlags{
+		httpOptions: flags.String("http", "", "a JSON file of options for http requests: headers, user agents, proxy, CA bundle, timeouts and pool sizes"),
+		robots:      flags.Bool("robots", true, "check robots.txt before fetching from a site, and skip what it blocks"),
+	}
+	flags.StringVar(&DefaultUserAgent, "user-agent", DefaultUserAgent, "who we say we are, to sites and to their robots.txt")
+	flags.Float64Var(&f.limits.Rate, "rate", 0, "the most fetches a second from each host, for profiles which don't set it")
+	flags.IntVar(&f.limits.Concurrency, "concurrency", 0, "the most fetches at once from each host, for profiles which don't set it")
+	flags.StringVar(&f.limits.CrawlDelay, "crawl-delay", "", "the least time between fetches from each host, for profiles which don't set it")
+	f.attempts = flags.Int("attempts", DefaultRetryPolicy.Attempts, "the most times to try fetching a page which fails in a way which might not happen again")
+	flags.DurationVar(&f.retry.BaseDelay, "backoff", DefaultRetryPolicy.BaseDelay, "the wait before the first retry, which doubles for each one after")
+	flags.DurationVar(&f.retry.MaxDelay, "max-backoff", DefaultRetryPolicy.MaxDelay, "the longest wait before a retry")
+	f.cacheDir = flags.String("cache", "", "cache pages in this directory, and only fetch them again when they are stale")
+	f.cacheOnly = flags.Bool("cache-only", false, "only serve pages from the cache, without the network")
+	f.cacheSize = flags.Int64("cache-size", 0, "the most MB to keep in the cache, 0 for no limit")
+	f.archiveDir = flags.String("archive", "", "archive the raw pages which are fetched to this directory")
+	f.warcFile = flags.String("warc", "", "write the pages which are fetched to this WARC file (gzipped if it ends in .gz)")
+	f.recordDir = flags.String("record", "", "save the pages which are fetched as fixtures in this directory")
+	f.replayDir = flags.String("replay", "", "serve the pages from the fixtures in this directory, rather than fetching them")
+	return f
+}
+
+// The usage of the fetch flags
+const fetchUsage = "[-http options.json] [-user-agent name] [-robots=false] [-rate n] [-concurrency n] [-crawl-delay d] [-attempts n] [-cache dir [-cache-only] [-cache-size mb]] [-archive dir] [-warc file.warc.gz] [-record dir | -replay dir]"
+
+// Sets up the readers of the profiles as the flags say
+func (f *fetchFlags) apply(profiles []*Profile) (*fetching, error) {
+	if *f.cacheOnly && *f.cacheDir == "" {
+		return nil, fmt.Errorf("-cache-only needs a -cache directory")
+	}
+	if err := f.limits.init(); err != nil {
+		return nil, fmt.Errorf("the flags %s", err)
+	}
+	// Nothing is fetched from the sites when replaying or only using the cache
+	online := *f.replayDir == "" && !*f.cacheOnly
+
+	// Replaying replaces the reader, so it comes before anything which wraps it
+	opened := &fetching{}
+	if *f.replayDir != "" {
+		if err := replayProfiles(profiles, *f.replayDir); err != nil {
+			return nil, err
+		}
+	} else {
+		var options HttpOptions
+		if *f.httpOptions != "" {
+			var err error
+			if options, err = LoadHttpOptions(*f.httpOptions); err != nil {
+				return nil, err
+			}
+		}
+		if err := configureProfiles(profiles, options); err != nil {
+			return nil, err
+		}
+		// Sessions need the reader which makes the requests, to give it
+		// the cookie jar
+		if online {
+			jars, err := sessionProfiles(profiles)
+			if err != nil {
+				return nil, err
+			}
+			opened.jars = jars
+		}
+		limitProfiles(profiles, f.limits)
+		// Below the cache, so that pages it has don't wait for the crawl
+		// delay
+		if *f.robots && online {
+			robotsProfiles(profiles, DefaultUserAgent)
+		}
+	}
+	if *f.attempts > 1 {
+		policy := f.retry
+		policy.Attempts = *f.attempts
+		retryProfiles(profiles, policy)
+	}
+
+	if *f.cacheDir != "" {
+		cache, err := OpenHTTPCache(*f.cacheDir, *f.cacheSize*1024*1024)
+		if err != nil {
+			return nil, err
+		}
+		cacheProfiles(profiles, cache, *f.cacheOnly)
+		opened.cache = cache
+	}
+	localProfiles(profiles)
+
+	if *f.archiveDir != "" {
+		archive, err := OpenArchive(*f.archiveDir)
+		if err != nil {
+			return nil, err
+		}
+		archiveProfiles(profiles, archive)
+	}
+	if *f.warcFile != "" {
+		warc, err := CreateWARC(*f.warcFile)
+		if err != nil {
+			return nil, err
+		}
+		warcProfiles(profiles, warc)
+		opened.warc = warc
+	}
+	if *f.recordDir != "" {
+		if err := recordProfiles(profiles, *f.recordDir); err != nil {
+			opened.Close()
+			return nil, err
+		}
+	}
+	return opened, nil
+}
+
+// Closes what was opened for fetching, and saves the cookies
+func (f *fetching) Close() error {
+	var err error
+	for _, jar := range f.jars {
+		if saveErr := jar.Save(); saveErr != nil && err == nil {
+			err = saveErr
+		}
+	}
+	if f.warc != nil {
+		if closeErr := f.warc.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A Fixture is a response saved by a RecordingReader, one JSON file per URL so
+// that they can be read and edited by hand. Requests other than a GET have
+// their method and body too, and a file of their own for each body
+type Fixture struct {
+	Method      string `json:"method,omitempty"`
+	URL         string `json:"url"`
+	RequestBody string `json:"requestBody,omitempty"`
+
+	StatusCode int         `json:"status,omitempty"`
+	Header     http.Header `json:"header,omitempty"`
+	Body       string      `json:"body"`
+}
+
+// The file in a fixtures directory for a request, readable enough to find by
+// eye and with a hash so that requests which look alike don't clash, e.g.
+//
+//	example.com-shop-apricot.html-5d41402a.json
+func fixtureFile(dir string, req *Request) string {
+	url := req.URL
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '_':
+			return r
+		}
+		return '-'
+	}, strings.TrimPrefix(strings.TrimPrefix(url, "http://"), "https://"))
+	name = strings.Trim(name, "-")
+	if len(name) > 100 {
+		name = name[:100]
+	}
+	// A GET is the URL alone, so that its name stays the same
+	key := url
+	if !req.plain() {
+		key = req.method() + " " + url + "\n" + req.Body
+	}
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(dir, fmt.Sprintf("%s-%x.json", name, sum[:4]))
+}
+
+// RecordingReader is a WebReader which saves every page that another one
+// fetches as a fixture, for a ReplayReader to serve later
+type RecordingReader struct {
+	WebReader
+	dir string
+}
+
+// NewRecordingReader returns a reader which records what webReader fetches to
+// the fixtures directory, creating it if needed
+func NewRecordingReader(webReader WebReader, dir string) (*RecordingReader, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("could not create fixtures directory: %s", err)
+	}
+	return &RecordingReader{
+		WebReader: webReader,
+		dir:       dir,
+	}, nil
+}
+
+// Do makes the request and saves the page as a fixture
+func (r *RecordingReader) Do(req *Request) (*Response, error) {
+	resp, err := doRequest(r.WebReader, req)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.save(req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// GetStream opens the body of the page, and saves it as a fixture once all
+// of it has been read
+func (r *RecordingReader) GetStream(url string) (*Stream, error) {
+	stream, err := getStream(r.WebReader, url)
+	if err != nil {
+		return nil, err
+	}
+	return watchStream(stream, true, func(resp *Response) {
+		if resp == nil {
+			return
+		}
+		if err := r.save(&Request{URL: url}, resp); err != nil {
+			log.Printf("[Warning] %s", err)
+		}
+	}), nil
+}
+
+// Streams when the other reader can
+func (r *RecordingReader) streams(url string) bool {
+	return canStream(r.WebReader, url)
+}
+
+// Saves the page for a request as a fixture
+func (r *RecordingReader) save(req *Request, resp *Response) error {
+	fixture := Fixture{
+		URL:        resp.URL,
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		Body:       resp.Body,
+	}
+	if !req.plain() {
+		fixture.Method = req.method()
+		fixture.RequestBody = req.Body
+	}
+
+	var b bytes.Buffer
+	encoder := json.NewEncoder(&b)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "    ")
+	if err := encoder.Encode(fixture); err != nil {
+		return fmt.Errorf("could not encode fixture: %s", err)
+	}
+
+	// Written atomically, as workers may fetch the same URL at once
+	file := fixtureFile(r.dir, req)
+	tmp, err := ioutil.TempFile(r.dir, ".fixture")
+	if err != nil {
+		return fmt.Errorf("could not write fixture: %s", err)
+	}
+	_, err = tmp.Write(b.Bytes())
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("could not write fixture: %s", err)
+	}
+	return nil
+}
+
+// GetResponse fetches the page and saves it as a fixture
+func (r *RecordingReader) GetResponse(url string) (*Response, error) {
+	return r.Do(&Request{URL: url})
+}
+
+// GetBody fetches the body of the page and saves it as a fixture
+func (r *RecordingReader) GetBody(url string) (string, error) {
+	resp, err := r.GetResponse(url)
+	if err != nil {
+		return "", err
+	}
+	return resp.Body, nil
+}
+
+// ReplayReader is a WebReader which serves the fixtures saved by a
+// RecordingReader, and fails for any URL which wasn't recorded. It never
+// touches the network, so tests can run the whole pipeline offline
+type ReplayReader struct {
+	dir string
+}
+
+// NewReplayReader returns a reader which serves the fixtures in a directory
+func NewReplayReader(dir string) (*ReplayReader, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not open fixtures directory: %s", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("fixtures %s is not a directory", dir)
+	}
+	return &ReplayReader{dir: dir}, nil
+}
+
+// Do returns the recorded response for the request
+func (r *ReplayReader) Do(req *Request) (*Response, error) {
+	b, err := ioutil.ReadFile(fixtureFile(r.dir, req))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no fixture for %s %s in %s, record it with -record", req.method(), req.URL, r.dir)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read fixture: %s", err)
+	}
+	var fixture Fixture
+	if err := json.Unmarshal(b, &fixture); err != nil {
+		return nil, fmt.Errorf("could not read fixture for %s: %s", req.URL, err)
+	}
+	if fixture.URL != req.URL {
+		return nil, fmt.Errorf("the fixture for %s is for %s", req.URL, fixture.URL)
+	}
+	method := fixture.Method
+	if method == "" {
+		method = "GET"
+	}
+	if method != req.method() || fixture.RequestBody != req.Body {
+		return nil, fmt.Errorf("the fixture for %s %s is for a %s with another body", req.method(), req.URL, method)
+	}
+	return &Response{
+		URL:        fixture.URL,
+		StatusCode: fixture.StatusCode,
+		Header:     fixture.Header,
+		Body:       fixture.Body,
+	}, nil
+}
+
+// GetResponse returns the recorded response for the URL
+func (r *ReplayReader) GetResponse(url string) (*Response, error) {
+	return r.Do(&Request{URL: url})
+}
+
+// GetBody returns the recorded body for the URL
+func (r *ReplayReader) GetBody(url string) (string, error) {
+	resp, err := r.GetResponse(url)
+	if err != nil {
+		return "", err
+	}
+	return resp.Body, nil
+}
+
+// Records every page which is fetched for the profiles to the fixtures
+// directory
+func recordProfiles(profiles []*Profile, dir string) error {
+	for _, p := range profiles {
+		recorder, err := NewRecordingReader(p.WebReader(), dir)
+		if err != nil {
+			return err
+		}
+		p.webReader = recorder
+	}
+	return nil
+}
+
+// Serves every page for the profiles from the fixtures directory
+func replayProfiles(profiles []*Profile, dir string) error {
+	replay, err := NewReplayReader(dir)
+	if err != nil {
+		return err
+	}
+	for _, p := range profiles {
+		p.webReader = replay
+	}
+	return nil
+}
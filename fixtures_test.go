@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRecordReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fixtures")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	recorder, err := NewRecordingReader(mapReader{
+		"http://example.com/a?page=1": "<path>a.jpg</path>",
+		"http://example.com/a?page=2": "<path>b.jpg</path>",
+	}, dir)
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	for _, url := range []string{"http://example.com/a?page=1", "http://example.com/a?page=2"} {
+		if _, err := recorder.GetBody(url); err != nil {
+			t.Fatalf("Did not expect to receive an error, got %s", err)
+		}
+	}
+	if _, err := recorder.GetBody("http://example.com/missing"); err == nil {
+		t.Errorf("Expected an error recording a page which couldn't be fetched")
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(files) != 2 {
+		t.Errorf("Expected a fixture for each page, got %v", files)
+	}
+
+	replay, err := NewReplayReader(dir)
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	for url, expected := range map[string]string{
+		"http://example.com/a?page=1": "<path>a.jpg</path>",
+		"http://example.com/a?page=2": "<path>b.jpg</path>",
+	} {
+		if body, err := replay.GetBody(url); err != nil || body != expected {
+			t.Errorf("Expected %s to replay %q, got %q (%v)", url, expected, body, err)
+		}
+	}
+	if _, err := replay.GetBody("http://example.com/missing"); err == nil {
+		t.Errorf("Expected a URL which wasn't recorded to fail")
+	}
+	if _, err := NewReplayReader(filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("Expected an error replaying a directory which doesn't exist")
+	}
+}
+
+func TestReplayResponse(t *testing.T) {
+	replay, err := NewReplayReader("testdata/fixtures")
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	url := "http://hiring-tests.s3-website-eu-west-1.amazonaws.com/2015_Developer_Scrape/5_products.html"
+	resp, err := replay.GetResponse(url)
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	if resp.StatusCode != 200 || !reflect.DeepEqual(resp.Header, http.Header{"Content-Type": {"text/html"}}) {
+		t.Errorf("Expected the status and headers to be replayed, got %d %v", resp.StatusCode, resp.Header)
+	}
+}
+
+// The Sainsburys list page and its product pages, scraped from the fixtures
+// in testdata/fixtures. After changing the definitions, the expected output can
+// be written with
+//
+//	scraper batch -profiles profiles.example.json -replay testdata/fixtures -sink pretty:testdata/5_products.json urls.txt
+func TestSainsburysPipeline(t *testing.T) {
+	profiles, err := LoadProfiles("profiles.example.json")
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	if err := replayProfiles(profiles, "testdata/fixtures"); err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+
+	var b bytes.Buffer
+	sink := sinkFormats["pretty"](&b, sinkOptions{})
+	err = scrapeAll(profiles, []string{
+		"http://hiring-tests.s3-website-eu-west-1.amazonaws.com/2015_Developer_Scrape/5_products.html",
+	}, sink)
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	sink.Close()
+
+	expected, err := ioutil.ReadFile("testdata/5_products.json")
+	if err != nil {
+		t.Fatalf("failed to read expected output: %s", err)
+	}
+	if b.String() != string(expected) {
+		t.Errorf("Output\n%s\ndoes not match expected\n%s", b.String(), expected)
+	}
+}
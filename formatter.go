@@ -0,0 +1,59 @@
+package main
+
+import (
+	"path/filepath"
+
+	"github.com/ganners/scraper/definition"
+)
+
+// The jsonFormatter just passes on what was parsed to be written as JSON, this
+// is the records of a bundle or the list of fields otherwise
+func jsonFormatter(
+	in <-chan Parsed,
+	errors chan<- error,
+	quit chan struct{},
+	profile *Profile,
+) chan Output {
+
+	out := make(chan Output)
+
+	for i := 0; i < NumPresenterWorkers; i++ {
+		go func() {
+			for {
+				select {
+				case <-quit:
+					return
+				case parsed := <-in:
+					output := Output{
+						URL:     parsed.URL,
+						Value:   parsed.Fields,
+						Records: parsed.Fields,
+					}
+					if parsed.Records != nil {
+						output.Value = parsed.Records
+						output.Records = nil
+					}
+					out <- output
+				}
+			}
+		}()
+	}
+	return out
+}
+
+// The schema of what the jsonFormatter prints for a profile
+func jsonSchema(profile *Profile) (*definition.Schema, error) {
+	file := profile.Definitions[PageDefinition]
+	if filepath.Ext(file) == definition.BundleExtension {
+		bundle, err := definition.NewBundle(file)
+		if err != nil {
+			return nil, err
+		}
+		return bundle.Schema(), nil
+	}
+	def, err := definition.NewDefinition(file)
+	if err != nil {
+		return nil, err
+	}
+	return definition.ListOf(def.RecordSchema()), nil
+}
@@ -2,22 +2,55 @@ package main
 
 import "fmt"
 
+// Page is the body of a web page along with the URL it was fetched from
+type Page struct {
+	URL  string
+	Body string
+}
+
 // Getter will take a URL input and perform some action to grab the contents of
-// that web page. There are a number of strategies available for this.
+// that web page. There are a number of strategies available for this. An
+// input can also be a RequestSpec, for a page which has to be posted to
 func getter(
 	in <-chan string,
 	errors chan<- error,
 	quit chan struct{},
-) chan string {
-	out := make(chan string)
+) chan Page {
+	return getterUsing(DefaultWebReader, in, errors, quit)
+}
+
+// GetterUsing is the getter, but with a particular WebReader rather than the
+// DefaultWebReader
+func getterUsing(
+	webReader WebReader,
+	in <-chan string,
+	errors chan<- error,
+	quit chan struct{},
+) chan Page {
+	out := make(chan Page)
 	for i := 0; i < NumGetterWorkers; i++ {
 		go func() {
 			for {
 				select {
 				case <-quit:
 					return
-				case url := <-in:
-					body, err := DefaultWebReader.GetBody(url)
+				case input := <-in:
+					req, err := ParseRequest(input)
+					if err != nil {
+						errors <- err
+						continue
+					}
+					url := req.URL
+					body, err := getBody(webReader, req)
+
+					// A page which robots.txt blocks is skipped rather
+					// than failing the run, it is parsed as empty
+					if blockedErr, ok := blockedError(err); ok {
+						blocked.add(blockedErr)
+						out <- Page{URL: url}
+						continue
+					}
+
 					if err != nil {
 						errors <- fmt.Errorf("could not read url: %s", err)
 					}
@@ -26,10 +59,26 @@ func getter(
 						errors <- fmt.Errorf("Body was empty")
 					}
 
-					out <- body
+					out <- Page{
+						URL:  url,
+						Body: body,
+					}
 				}
 			}
 		}()
 	}
 	return out
 }
+
+// Gets the body of the page for a request, with just the URL when that is all
+// it is so that any reader can get it
+func getBody(webReader WebReader, req *Request) (string, error) {
+	if req.plain() && len(req.Header) == 0 {
+		return webReader.GetBody(req.URL)
+	}
+	resp, err := doRequest(webReader, req)
+	if err != nil {
+		return "", err
+	}
+	return resp.Body, nil
+}
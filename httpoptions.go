@@ -0,0 +1,248 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+// HttpOptions say how an HttpReader makes its requests. They can be loaded
+// from a file (see LoadHttpOptions) and a profile can override them with its
+// own under "http". Anything not set is Go's default
+type HttpOptions struct {
+	// Sent with every request. A profile's headers are added to these
+	Headers map[string]string `json:"headers"`
+
+	// User agents to take turns with, DefaultUserAgent if there are none
+	UserAgents []string `json:"userAgents"`
+
+	// An http://, https:// or socks5:// proxy, otherwise the one from the
+	// HTTP_PROXY and HTTPS_PROXY environment variables
+	Proxy string `json:"proxy"`
+
+	// A PEM file of certificate authorities to trust as well as the system's
+	CABundle string `json:"caBundle"`
+
+	// How long to wait to connect, for the response to start and for the
+	// whole of it, e.g. "10s"
+	ConnectTimeout string `json:"connectTimeout"`
+	ReadTimeout    string `json:"readTimeout"`
+	Timeout        string `json:"timeout"`
+
+	// Sizes of the connection pool
+	MaxIdleConns        int `json:"maxIdleConns"`
+	MaxIdleConnsPerHost int `json:"maxIdleConnsPerHost"`
+	MaxConnsPerHost     int `json:"maxConnsPerHost"`
+}
+
+// LoadHttpOptions reads HttpOptions from a JSON file
+func LoadHttpOptions(file string) (HttpOptions, error) {
+	var options HttpOptions
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return options, fmt.Errorf("could not read http options: %s", err)
+	}
+	if err := json.Unmarshal(b, &options); err != nil {
+		return options, fmt.Errorf("could not decode http options: %s", err)
+	}
+	return options, nil
+}
+
+// Returns the options with those set in override taking their place, and the
+// headers of both
+func (o HttpOptions) merge(override *HttpOptions) HttpOptions {
+	if override == nil {
+		return o
+	}
+	merged := *override
+	merged.Headers = make(map[string]string, len(o.Headers)+len(override.Headers))
+	for name, value := range o.Headers {
+		merged.Headers[name] = value
+	}
+	for name, value := range override.Headers {
+		merged.Headers[name] = value
+	}
+	if merged.UserAgents == nil {
+		merged.UserAgents = o.UserAgents
+	}
+	if merged.Proxy == "" {
+		merged.Proxy = o.Proxy
+	}
+	if merged.CABundle == "" {
+		merged.CABundle = o.CABundle
+	}
+	if merged.ConnectTimeout == "" {
+		merged.ConnectTimeout = o.ConnectTimeout
+	}
+	if merged.ReadTimeout == "" {
+		merged.ReadTimeout = o.ReadTimeout
+	}
+	if merged.Timeout == "" {
+		merged.Timeout = o.Timeout
+	}
+	if merged.MaxIdleConns == 0 {
+		merged.MaxIdleConns = o.MaxIdleConns
+	}
+	if merged.MaxIdleConnsPerHost == 0 {
+		merged.MaxIdleConnsPerHost = o.MaxIdleConnsPerHost
+	}
+	if merged.MaxConnsPerHost == 0 {
+		merged.MaxConnsPerHost = o.MaxConnsPerHost
+	}
+	return merged
+}
+
+// Returns whether any options are set
+func (o HttpOptions) set() bool {
+	return len(o.Headers) > 0 || len(o.UserAgents) > 0 || o.Proxy != "" ||
+		o.CABundle != "" || o.ConnectTimeout != "" || o.ReadTimeout != "" ||
+		o.Timeout != "" || o.MaxIdleConns != 0 || o.MaxIdleConnsPerHost != 0 ||
+		o.MaxConnsPerHost != 0
+}
+
+// NewHttpReaderWithOptions returns a http reader which makes its requests as
+// the options say
+func NewHttpReaderWithOptions(options HttpOptions) (*HttpReader, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if options.ConnectTimeout != "" {
+		d, err := parseTimeout("connectTimeout", options.ConnectTimeout)
+		if err != nil {
+			return nil, err
+		}
+		dialer.Timeout = d
+		transport.TLSHandshakeTimeout = d
+	}
+	transport.DialContext = dialer.DialContext
+
+	if options.ReadTimeout != "" {
+		d, err := parseTimeout("readTimeout", options.ReadTimeout)
+		if err != nil {
+			return nil, err
+		}
+		transport.ResponseHeaderTimeout = d
+	}
+
+	if options.Proxy != "" {
+		u, err := url.Parse(options.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy %q: %s", options.Proxy, err)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return nil, fmt.Errorf("invalid proxy %q, it must be http://, https:// or socks5://", options.Proxy)
+		}
+		transport.Proxy = http.ProxyURL(u)
+	}
+
+	if options.CABundle != "" {
+		pem, err := ioutil.ReadFile(options.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("could not read CA bundle: %s", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in the CA bundle %s", options.CABundle)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	if options.MaxIdleConns != 0 {
+		transport.MaxIdleConns = options.MaxIdleConns
+	}
+	if options.MaxIdleConnsPerHost != 0 {
+		transport.MaxIdleConnsPerHost = options.MaxIdleConnsPerHost
+	}
+	if options.MaxConnsPerHost != 0 {
+		transport.MaxConnsPerHost = options.MaxConnsPerHost
+	}
+
+	client := &http.Client{Transport: transport}
+	if options.Timeout != "" {
+		d, err := parseTimeout("timeout", options.Timeout)
+		if err != nil {
+			return nil, err
+		}
+		client.Timeout = d
+	}
+
+	header := make(http.Header, len(options.Headers))
+	for name, value := range options.Headers {
+		header.Set(name, value)
+	}
+
+	h := &HttpReader{
+		client: client,
+		header: header,
+	}
+	if len(options.UserAgents) > 0 {
+		h.userAgents = &userAgents{agents: options.UserAgents}
+	}
+	return h, nil
+}
+
+// Parses one of the timeouts
+func parseTimeout(name, value string) (time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid %s %q", name, value)
+	}
+	return d, nil
+}
+
+// User agents which requests take turns with
+type userAgents struct {
+	agents []string
+	next   uint32
+}
+
+// Returns the user agent for the next request
+func (u *userAgents) take() string {
+	i := atomic.AddUint32(&u.next, 1) - 1
+	return u.agents[int(i)%len(u.agents)]
+}
+
+// Gives the profiles which fetch with http their own HttpReader, from the
+// options with the profile's own on top. Those which don't use http can't
+// have options of their own, but still use them for what they fetch from the
+// site itself (see Profile.httpReader)
+func configureProfiles(profiles []*Profile, options HttpOptions) error {
+	for _, p := range profiles {
+		merged := options.merge(p.HTTP)
+		if !merged.set() {
+			continue
+		}
+		switch p.Reader {
+		case "", "http", "googlecache":
+		default:
+			if p.HTTP != nil {
+				return fmt.Errorf("profile %s has http options, which the %s reader doesn't use", p.Name, p.Reader)
+			}
+		}
+
+		reader, err := NewHttpReaderWithOptions(merged)
+		if err != nil {
+			return fmt.Errorf("profile %s %s", p.Name, err)
+		}
+		p.http = reader
+		switch p.Reader {
+		case "", "http":
+			p.webReader = reader
+		case "googlecache":
+			p.webReader = &GoogleCacheReader{HttpReader: *reader}
+		}
+	}
+	return nil
+}
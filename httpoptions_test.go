@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHttpOptions(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("User-Agent") + "|" + r.Header.Get("Accept-Language") + "|" + r.Header.Get("X-Profile")))
+	}))
+	defer server.Close()
+
+	// The Go user agent isn't sent without options either
+	if body, err := NewHttpReader().GetBody(server.URL); err != nil || body != DefaultUserAgent+"||" {
+		t.Errorf("Expected the default user agent, got %q (%v)", body, err)
+	}
+
+	defaults := HttpOptions{
+		Headers:    map[string]string{"Accept-Language": "en-GB", "X-Profile": "none"},
+		UserAgents: []string{"agent-a", "agent-b"},
+	}
+	profile := &HttpOptions{Headers: map[string]string{"X-Profile": "sainsburys"}}
+	reader, err := NewHttpReaderWithOptions(defaults.merge(profile))
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	for _, expected := range []string{
+		"agent-a|en-GB|sainsburys",
+		"agent-b|en-GB|sainsburys",
+		"agent-a|en-GB|sainsburys",
+	} {
+		if body, err := reader.GetBody(server.URL); err != nil || body != expected {
+			t.Errorf("Expected %q, got %q (%v)", expected, body, err)
+		}
+	}
+
+	// The request's own headers win
+	resp, err := reader.Do(&Request{URL: server.URL, Header: http.Header{"User-Agent": {"mine"}}})
+	if err != nil || resp.Body != "mine|en-GB|sainsburys" {
+		t.Errorf("Expected the request's user agent, got %+v (%v)", resp, err)
+	}
+}
+
+func TestHttpOptionsTimeouts(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	reader, err := NewHttpReaderWithOptions(HttpOptions{ReadTimeout: "50ms"})
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	_, err = reader.GetResponse(server.URL)
+	if reason, retryable := classify(nil, err); err == nil || reason != "timeout" || !retryable {
+		t.Errorf("Expected a timeout which can be retried, got %v", err)
+	}
+}
+
+func TestHttpOptionsProxy(t *testing.T) {
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+		w.Write([]byte("<path>proxied.jpg</path>"))
+	}))
+	defer proxy.Close()
+
+	reader, err := NewHttpReaderWithOptions(HttpOptions{Proxy: proxy.URL})
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	body, err := reader.GetBody("http://shop.example.com/fruit")
+	if err != nil || body != "<path>proxied.jpg</path>" {
+		t.Errorf("Expected the page from the proxy, got %q (%v)", body, err)
+	}
+	if proxied != "http://shop.example.com/fruit" {
+		t.Errorf("Expected the proxy to be asked for the URL, got %s", proxied)
+	}
+}
+
+func TestHttpOptionsCABundle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "http")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<path>secure.jpg</path>"))
+	}))
+	defer server.Close()
+
+	// Not trusted without the bundle
+	if _, err := NewHttpReader().GetBody(server.URL); err == nil {
+		t.Errorf("Expected the test server's certificate not to be trusted")
+	}
+
+	bundle := filepath.Join(dir, "ca.pem")
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(bundle, cert, 0644); err != nil {
+		t.Fatalf("failed to write CA bundle: %s", err)
+	}
+	reader, err := NewHttpReaderWithOptions(HttpOptions{CABundle: bundle})
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	if body, err := reader.GetBody(server.URL); err != nil || body != "<path>secure.jpg</path>" {
+		t.Errorf("Expected the page with the CA bundle, got %q (%v)", body, err)
+	}
+}
+
+func TestHttpOptionsErrors(t *testing.T) {
+	for _, options := range []HttpOptions{
+		{Proxy: "ftp://proxy.example.com"},
+		{CABundle: "missing.pem"},
+		{ConnectTimeout: "soon"},
+		{ReadTimeout: "-1s"},
+		{Timeout: "forever"},
+	} {
+		if _, err := NewHttpReaderWithOptions(options); err == nil {
+			t.Errorf("Expected an error for the options %+v", options)
+		}
+	}
+}
+
+func TestConfigureProfiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "http")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "http.json")
+	content := `{"headers": {"Accept-Language": "en-GB"}, "timeout": "30s", "maxConnsPerHost": 4}`
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write options: %s", err)
+	}
+	options, err := LoadHttpOptions(file)
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+
+	profiles := []*Profile{
+		{Name: "default"},
+		{Name: "cached", Reader: "googlecache", HTTP: &HttpOptions{Timeout: "1m"}},
+		{Name: "surf", Reader: "surf", webReader: mapReader{}},
+	}
+	if err := configureProfiles(profiles, options); err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	reader, ok := profiles[0].WebReader().(*HttpReader)
+	if !ok || reader.client.Timeout != 30*time.Second || reader.header.Get("Accept-Language") != "en-GB" {
+		t.Errorf("Expected the default profile to get a http reader with the options, got %#v", profiles[0].WebReader())
+	}
+	cached, ok := profiles[1].WebReader().(*GoogleCacheReader)
+	if !ok || cached.client.Timeout != time.Minute || cached.client.Transport.(*http.Transport).MaxConnsPerHost != 4 {
+		t.Errorf("Expected the googlecache profile to get its own options, got %#v", profiles[1].WebReader())
+	}
+	if _, ok := profiles[2].WebReader().(mapReader); !ok {
+		t.Errorf("Expected the surf profile to keep its reader")
+	}
+	if reader := profiles[2].httpReader(); reader.client.Timeout != 30*time.Second {
+		t.Errorf("Expected the surf profile to fetch from the site itself with the options, got %#v", reader)
+	}
+
+	profiles[2].HTTP = &HttpOptions{Proxy: "http://proxy.example.com"}
+	if err := configureProfiles(profiles[2:], options); err == nil {
+		t.Errorf("Expected an error giving http options to a surf profile")
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/ganners/scraper/definition"
+)
+
+// The infer command writes a definition from a saved page and some examples
+// of values to extract from it, e.g.
+//
+//	scraper infer -page saved.html -out product.definition \
+//	    "productName=Apricot Ripe & Ready" "pricePerUnit=£3.50"
+//
+// Examples without a name are named value1, value2 and so on
+func inferCommand(args []string) error {
+	flags := flag.NewFlagSet("infer", flag.ContinueOnError)
+	page := flags.String("page", "", "the saved HTML page to infer from")
+	out := flags.String("out", "", "where to write the definition, defaults to stdout")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *page == "" || flags.NArg() == 0 {
+		return fmt.Errorf("usage: scraper infer -page saved.html [-out file.definition] name=value...")
+	}
+
+	content, err := ioutil.ReadFile(*page)
+	if err != nil {
+		return fmt.Errorf("could not read page: %s", err)
+	}
+
+	examples := make([]definition.Example, 0, flags.NArg())
+	for i, arg := range flags.Args() {
+		example := definition.Example{
+			Name:  fmt.Sprintf("value%d", i+1),
+			Value: arg,
+		}
+		if parts := strings.SplitN(arg, "=", 2); len(parts) == 2 && !strings.ContainsAny(parts[0], " \t") {
+			example.Name = parts[0]
+			example.Value = parts[1]
+		}
+		examples = append(examples, example)
+	}
+
+	def, err := definition.Infer(string(content), examples)
+	if err != nil {
+		return err
+	}
+
+	if *out == "" {
+		_, err = fmt.Fprintln(os.Stdout, def)
+		return err
+	}
+	return ioutil.WriteFile(*out, []byte(def+"\n"), 0644)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HostLimits say how hard a profile's pages may be fetched from each host. They
+// apply to every fetch for the profile, the child pages which formatters
+// fetch included. Nothing set means no limit
+type HostLimits struct {
+	// Requests a second, with bursts of up to Burst (default 1) at once
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+
+	// The most fetches at once
+	Concurrency int `json:"concurrency"`
+
+	// The least time between the start of one fetch and the next, e.g. "2s"
+	CrawlDelay string `json:"crawlDelay"`
+
+	crawlDelay time.Duration
+}
+
+// Checks the limits and parses the crawl delay
+func (l *HostLimits) init() error {
+	if l.Rate < 0 || l.Burst < 0 || l.Concurrency < 0 {
+		return fmt.Errorf("has negative limits")
+	}
+	if l.CrawlDelay != "" {
+		d, err := time.ParseDuration(l.CrawlDelay)
+		if err != nil || d < 0 {
+			return fmt.Errorf("has an invalid crawlDelay %q", l.CrawlDelay)
+		}
+		l.crawlDelay = d
+	}
+	return nil
+}
+
+// Returns whether there are any limits
+func (l HostLimits) limited() bool {
+	return l.Rate > 0 || l.Concurrency > 0 || l.crawlDelay > 0
+}
+
+// Fills in the limits which aren't set from others
+func (l HostLimits) or(defaults HostLimits) HostLimits {
+	if l.Rate == 0 {
+		l.Rate, l.Burst = defaults.Rate, defaults.Burst
+	}
+	if l.Concurrency == 0 {
+		l.Concurrency = defaults.Concurrency
+	}
+	if l.crawlDelay == 0 {
+		l.CrawlDelay, l.crawlDelay = defaults.CrawlDelay, defaults.crawlDelay
+	}
+	return l
+}
+
+// The state of the limits for one host
+type hostLimiter struct {
+	limits HostLimits
+	slots  chan struct{}
+
+	mu sync.Mutex
+	// A token bucket, which can go below 0 when fetches are waiting on it
+	tokens float64
+	filled time.Time
+	// When the next fetch may start, for the crawl delay
+	next time.Time
+}
+
+func newHostLimiter(limits HostLimits, now time.Time) *hostLimiter {
+	h := &hostLimiter{
+		limits: limits,
+		tokens: float64(limits.burst()),
+		filled: now,
+	}
+	if limits.Concurrency > 0 {
+		h.slots = make(chan struct{}, limits.Concurrency)
+	}
+	return h
+}
+
+// The size of the token bucket
+func (l HostLimits) burst() int {
+	if l.Burst < 1 {
+		return 1
+	}
+	return l.Burst
+}
+
+// Takes a turn to fetch, returning how long to wait until it starts
+func (h *hostLimiter) reserve(now time.Time) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	start := now
+	if h.limits.Rate > 0 {
+		h.tokens += now.Sub(h.filled).Seconds() * h.limits.Rate
+		if max := float64(h.limits.burst()); h.tokens > max {
+			h.tokens = max
+		}
+		h.filled = now
+		h.tokens--
+		if h.tokens < 0 {
+			start = now.Add(time.Duration(-h.tokens / h.limits.Rate * float64(time.Second)))
+		}
+	}
+	if h.limits.crawlDelay > 0 {
+		if start.Before(h.next) {
+			start = h.next
+		}
+		h.next = start.Add(h.limits.crawlDelay)
+	}
+	return start.Sub(now)
+}
+
+// LimitedReader is a WebReader which keeps to the HostLimits for each host it
+// fetches from. Every worker of a profile shares one, so the limits are for
+// the profile as a whole
+type LimitedReader struct {
+	WebReader
+	limits HostLimits
+	hosts  *hostLimiters
+
+	// Whether what it fetches is fetched during a fetch of a reader it
+	// shares the limits with, which already has a slot, so it only waits
+	// for its turn
+	within bool
+
+	// The time now and how to wait, which tests replace
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+// The state of the limits for each host, which readers sharing the limits
+// share
+type hostLimiters struct {
+	mu    sync.Mutex
+	hosts map[string]*hostLimiter
+}
+
+// NewLimitedReader returns a reader which keeps what webReader fetches within
+// the limits
+func NewLimitedReader(webReader WebReader, limits HostLimits) *LimitedReader {
+	return &LimitedReader{
+		WebReader: webReader,
+		limits:    limits,
+		hosts:     &hostLimiters{hosts: make(map[string]*hostLimiter)},
+		now:       time.Now,
+		sleep:     time.Sleep,
+	}
+}
+
+// Returns a reader for what is fetched during this reader's fetches with
+// webReader (such as logging in), which takes turns with them
+func (l *LimitedReader) sharing(webReader WebReader) *LimitedReader {
+	shared := *l
+	shared.WebReader = webReader
+	shared.within = true
+	return &shared
+}
+
+// Waits for a turn to fetch from the host of the URL, returning a func to
+// call when the fetch is done
+func (l *LimitedReader) wait(rawurl string) func() {
+	host := ""
+	if u, err := url.Parse(rawurl); err == nil {
+		host = strings.ToLower(u.Host)
+	}
+
+	l.hosts.mu.Lock()
+	h, found := l.hosts.hosts[host]
+	if !found {
+		h = newHostLimiter(l.limits, l.now())
+		l.hosts.hosts[host] = h
+	}
+	l.hosts.mu.Unlock()
+
+	slotted := h.slots != nil && !l.within
+	if slotted {
+		h.slots <- struct{}{}
+	}
+	if wait := h.reserve(l.now()); wait > 0 {
+		l.sleep(wait)
+	}
+	return func() {
+		if slotted {
+			<-h.slots
+		}
+	}
+}
+
+// Do makes the request once it is within the limits of its host
+func (l *LimitedReader) Do(req *Request) (*Response, error) {
+	done := l.wait(req.URL)
+	defer done()
+	return doRequest(l.WebReader, req)
+}
+
+// GetResponse fetches the page once it is within the limits of its host
+func (l *LimitedReader) GetResponse(url string) (*Response, error) {
+	return l.Do(&Request{URL: url})
+}
+
+// GetBody fetches the body of the page once it is within the limits of its
+// host
+func (l *LimitedReader) GetBody(url string) (string, error) {
+	done := l.wait(url)
+	defer done()
+	return l.WebReader.GetBody(url)
+}
+
+// GetStream opens the body of the page once it is within the limits of its
+// host. The fetch isn't done until the stream is closed, so it keeps its slot
+// until then
+func (l *LimitedReader) GetStream(url string) (*Stream, error) {
+	done := l.wait(url)
+	stream, err := getStream(l.WebReader, url)
+	if err != nil {
+		done()
+		return nil, err
+	}
+	return watchStream(stream, false, func(*Response) { done() }), nil
+}
+
+// Streams when the other reader can
+func (l *LimitedReader) streams(url string) bool {
+	return canStream(l.WebReader, url)
+}
+
+// Limits the fetches of every profile by its limits, or the defaults for
+// those it doesn't set. Logging in to a session takes turns with the fetches
+func limitProfiles(profiles []*Profile, defaults HostLimits) {
+	for _, p := range profiles {
+		limits := p.Limits.or(defaults)
+		if !limits.limited() {
+			continue
+		}
+		limited := NewLimitedReader(p.WebReader(), limits)
+		if s, ok := p.WebReader().(*SessionReader); ok {
+			s.http = limited.sharing(s.http)
+		}
+		p.webReader = limited
+	}
+}
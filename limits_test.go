@@ -0,0 +1,147 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHostLimiter(t *testing.T) {
+	start := time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		name   string
+		limits HostLimits
+		at     []time.Duration
+		waits  []time.Duration
+	}{
+		{
+			name:   "rate",
+			limits: HostLimits{Rate: 2},
+			at:     []time.Duration{0, 0, 0, 2 * time.Second},
+			waits:  []time.Duration{0, 500 * time.Millisecond, time.Second, 0},
+		},
+		{
+			name:   "burst",
+			limits: HostLimits{Rate: 1, Burst: 2},
+			at:     []time.Duration{0, 0, 0, 10 * time.Second, 10 * time.Second},
+			waits:  []time.Duration{0, 0, time.Second, 0, 0},
+		},
+		{
+			name:   "crawl delay",
+			limits: HostLimits{CrawlDelay: "2s"},
+			at:     []time.Duration{0, 0, time.Second, 10 * time.Second},
+			waits:  []time.Duration{0, 2 * time.Second, 3 * time.Second, 0},
+		},
+		{
+			name:   "rate and crawl delay",
+			limits: HostLimits{Rate: 1, CrawlDelay: "1500ms"},
+			at:     []time.Duration{0, 0},
+			waits:  []time.Duration{0, 1500 * time.Millisecond},
+		},
+	} {
+		if err := test.limits.init(); err != nil {
+			t.Fatalf("Did not expect to receive an error, got %s", err)
+		}
+		h := newHostLimiter(test.limits, start)
+		for i, at := range test.at {
+			if wait := h.reserve(start.Add(at)); wait != test.waits[i] {
+				t.Errorf("%s: expected fetch %d to wait %s, got %s", test.name, i, test.waits[i], wait)
+			}
+		}
+	}
+
+	for _, limits := range []HostLimits{{CrawlDelay: "soon"}, {CrawlDelay: "-1s"}, {Rate: -1}} {
+		if err := limits.init(); err == nil {
+			t.Errorf("Expected an error for the limits %+v", limits)
+		}
+	}
+}
+
+// Blocks every fetch until it is released, counting how many are at once
+type blockingReader struct {
+	mu      sync.Mutex
+	current map[string]int
+	most    map[string]int
+	release chan struct{}
+}
+
+func (b *blockingReader) GetBody(url string) (string, error) {
+	b.mu.Lock()
+	b.current[url]++
+	if b.current[url] > b.most[url] {
+		b.most[url] = b.current[url]
+	}
+	b.mu.Unlock()
+
+	<-b.release
+
+	b.mu.Lock()
+	b.current[url]--
+	b.mu.Unlock()
+	return "<path>a.jpg</path>", nil
+}
+
+func TestLimitedReaderConcurrency(t *testing.T) {
+	inner := &blockingReader{
+		current: make(map[string]int),
+		most:    make(map[string]int),
+		release: make(chan struct{}),
+	}
+	reader := NewLimitedReader(inner, HostLimits{Concurrency: 2})
+
+	// Four fetches from each host, two of which can be fetched at once
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		for _, url := range []string{"http://a.example.com/", "http://b.example.com/"} {
+			wg.Add(1)
+			go func(url string) {
+				defer wg.Done()
+				if _, err := reader.GetBody(url); err != nil {
+					t.Errorf("Did not expect to receive an error, got %s", err)
+				}
+			}(url)
+		}
+	}
+	for i := 0; i < 8; i++ {
+		time.Sleep(10 * time.Millisecond)
+		inner.release <- struct{}{}
+	}
+	wg.Wait()
+
+	for url, most := range inner.most {
+		if most != 2 {
+			t.Errorf("Expected 2 fetches at once from %s, got %d", url, most)
+		}
+	}
+}
+
+func TestLimitProfiles(t *testing.T) {
+	defaults := HostLimits{Rate: 1, CrawlDelay: "1s"}
+	if err := defaults.init(); err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	profiles := []*Profile{
+		{Name: "own", Limits: HostLimits{Concurrency: 1}, webReader: mapReader{}},
+		{Name: "defaults", webReader: mapReader{}},
+	}
+	limitProfiles(profiles, defaults)
+
+	for _, p := range profiles {
+		reader, ok := p.WebReader().(*LimitedReader)
+		if !ok {
+			t.Fatalf("Expected the %s profile to be limited", p.Name)
+		}
+		if reader.limits.Rate != 1 || reader.limits.crawlDelay != time.Second {
+			t.Errorf("Expected the %s profile to take the default rate and crawl delay, got %+v", p.Name, reader.limits)
+		}
+	}
+	if concurrency := profiles[0].WebReader().(*LimitedReader).limits.Concurrency; concurrency != 1 {
+		t.Errorf("Expected the profile's own concurrency to be kept, got %d", concurrency)
+	}
+
+	unlimited := []*Profile{{Name: "unlimited", webReader: mapReader{}}}
+	limitProfiles(unlimited, HostLimits{})
+	if _, ok := unlimited[0].WebReader().(mapReader); !ok {
+		t.Errorf("Expected a profile without limits to be left alone")
+	}
+}
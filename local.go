@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// The extensions of the files which a directory expands to
+var localExtensions = []string{".html", ".htm"}
+
+// FileReader is a WebReader which reads file:// URLs and plain paths from the
+// disk, such as pages saved from the browser, and passes anything else to
+// another reader (if there is one)
+type FileReader struct {
+	WebReader
+}
+
+// NewFileReader returns a reader which reads local files itself and passes
+// other URLs to webReader, which can be nil to only read local files
+func NewFileReader(webReader WebReader) *FileReader {
+	return &FileReader{
+		WebReader: webReader,
+	}
+}
+
+// Do reads the file, or makes the request with the other reader. A file can
+// only be got
+func (f *FileReader) Do(req *Request) (*Response, error) {
+	if _, local := localPath(req.URL); !local {
+		if f.WebReader == nil {
+			return nil, fmt.Errorf("%s is not a local file", req.URL)
+		}
+		return doRequest(f.WebReader, req)
+	}
+	if !req.plain() {
+		return nil, fmt.Errorf("could not %s %s, it is a local file", req.method(), req.URL)
+	}
+	return f.GetResponse(req.URL)
+}
+
+// GetResponse reads the file, or fetches the URL with the other reader
+func (f *FileReader) GetResponse(rawurl string) (*Response, error) {
+	path, local := localPath(rawurl)
+	if !local {
+		if f.WebReader == nil {
+			return nil, fmt.Errorf("%s is not a local file", rawurl)
+		}
+		return getResponse(f.WebReader, rawurl)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read file: %s", err)
+	}
+	return &Response{
+		URL:    rawurl,
+		Header: http.Header{},
+		Body:   string(b),
+	}, nil
+}
+
+// GetBody reads the file, or fetches the URL with the other reader
+func (f *FileReader) GetBody(rawurl string) (string, error) {
+	if _, local := localPath(rawurl); !local && f.WebReader != nil {
+		return f.WebReader.GetBody(rawurl)
+	}
+	resp, err := f.GetResponse(rawurl)
+	if err != nil {
+		return "", err
+	}
+	return resp.Body, nil
+}
+
+// GetStream opens the file, or streams the URL with the other reader
+func (f *FileReader) GetStream(rawurl string) (*Stream, error) {
+	path, local := localPath(rawurl)
+	if !local {
+		if f.WebReader == nil {
+			return nil, fmt.Errorf("%s is not a local file", rawurl)
+		}
+		return getStream(f.WebReader, rawurl)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read file: %s", err)
+	}
+	return &Stream{
+		ReadCloser: file,
+		URL:        rawurl,
+		Header:     http.Header{},
+	}, nil
+}
+
+// Streams files, and URLs when the other reader can
+func (f *FileReader) streams(rawurl string) bool {
+	if _, local := localPath(rawurl); local || f.WebReader == nil {
+		return true
+	}
+	return canStream(f.WebReader, rawurl)
+}
+
+// Reads local files for every profile, on top of its own reader
+func localProfiles(profiles []*Profile) {
+	for _, p := range profiles {
+		p.webReader = NewFileReader(p.WebReader())
+	}
+}
+
+// Returns the path of a file:// URL or a plain path, and whether it is one.
+// Anything with another scheme isn't local
+func localPath(rawurl string) (string, bool) {
+	if strings.HasPrefix(rawurl, "file://") {
+		u, err := url.Parse(rawurl)
+		if err != nil {
+			return "", false
+		}
+		// file://saved/list.html is taken to be relative, as people write it
+		if u.Host != "" && u.Host != "localhost" {
+			return filepath.FromSlash(u.Host + u.Path), true
+		}
+		return filepath.FromSlash(u.Path), true
+	}
+	if strings.Contains(rawurl, "://") {
+		return "", false
+	}
+	return rawurl, true
+}
+
+// Returns the file:// URL of a path
+func fileURL(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", fmt.Errorf("could not resolve %s: %s", path, err)
+	}
+	u := url.URL{Scheme: "file", Path: filepath.ToSlash(abs)}
+	return u.String(), nil
+}
+
+// Expands the local paths in a list of URLs into the file:// URLs of the
+// pages they stand for: a directory is every page in it (and in the
+// directories within it) and a glob is every file it matches. Other URLs are
+// left as they are
+func expandLocal(urls []string) ([]string, error) {
+	expanded := make([]string, 0, len(urls))
+	for _, rawurl := range urls {
+		path, local := localPath(rawurl)
+		// A RequestSpec is never a file, even when its URL is
+		if !local || strings.HasPrefix(rawurl, "{") {
+			expanded = append(expanded, rawurl)
+			continue
+		}
+
+		var files []string
+		if strings.ContainsAny(path, "*?[") {
+			matches, err := filepath.Glob(path)
+			if err != nil {
+				return nil, fmt.Errorf("invalid glob %s: %s", path, err)
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("no files match %s", path)
+			}
+			files = matches
+		} else if info, err := os.Stat(path); err == nil && info.IsDir() {
+			err := filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				if !info.IsDir() && containsString(localExtensions, strings.ToLower(filepath.Ext(file))) {
+					files = append(files, file)
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, fmt.Errorf("could not read directory: %s", err)
+			}
+			sort.Strings(files)
+		} else {
+			files = []string{path}
+		}
+
+		for _, file := range files {
+			u, err := fileURL(file)
+			if err != nil {
+				return nil, err
+			}
+			expanded = append(expanded, u)
+		}
+	}
+	return expanded, nil
+}
+
+// Resolves a link on a page against the URL of the page, so that relative
+// links on pages read from the disk are read from the disk too
+func resolveURL(base, ref string) string {
+	b, err := url.Parse(base)
+	if err != nil {
+		return ref
+	}
+	r, err := url.Parse(ref)
+	if err != nil {
+		return ref
+	}
+	return b.ResolveReference(r).String()
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFileReader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "local")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "saved page.html")
+	if err := ioutil.WriteFile(file, []byte("<path>a.jpg</path>"), 0644); err != nil {
+		t.Fatalf("failed to write page: %s", err)
+	}
+	u, err := fileURL(file)
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+
+	reader := NewFileReader(mapReader{"http://example.com/": "<path>b.jpg</path>"})
+	for url, expected := range map[string]string{
+		file:                  "<path>a.jpg</path>",
+		u:                     "<path>a.jpg</path>",
+		"http://example.com/": "<path>b.jpg</path>",
+	} {
+		if body, err := reader.GetBody(url); err != nil || body != expected {
+			t.Errorf("Expected %s to be %q, got %q (%v)", url, expected, body, err)
+		}
+		stream, err := reader.GetStream(url)
+		if err != nil {
+			t.Fatalf("Did not expect to receive an error, got %s", err)
+		}
+		b, _ := ioutil.ReadAll(stream)
+		stream.Close()
+		if string(b) != expected {
+			t.Errorf("Expected the stream of %s to be %q, got %q", url, expected, b)
+		}
+	}
+	if _, err := reader.GetBody(filepath.Join(dir, "missing.html")); err == nil {
+		t.Errorf("Expected a file which doesn't exist to fail")
+	}
+	if _, err := NewFileReader(nil).GetBody("http://example.com/"); err == nil {
+		t.Errorf("Expected a reader of only local files to fail for a http URL")
+	}
+}
+
+func TestExpandLocal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "local")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"b.html", "a.htm", "notes.txt", "products/c.html"} {
+		file := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(file), 0755)
+		if err := ioutil.WriteFile(file, []byte(name), 0644); err != nil {
+			t.Fatalf("failed to write %s: %s", name, err)
+		}
+	}
+	local := func(names ...string) []string {
+		urls := make([]string, 0, len(names))
+		for _, name := range names {
+			u, _ := fileURL(filepath.Join(dir, name))
+			urls = append(urls, u)
+		}
+		return urls
+	}
+
+	for _, test := range []struct {
+		urls     []string
+		expected []string
+	}{
+		{urls: []string{"http://example.com/"}, expected: []string{"http://example.com/"}},
+		{urls: []string{dir}, expected: local("a.htm", "b.html", "products/c.html")},
+		{urls: []string{filepath.Join(dir, "*.html")}, expected: local("b.html")},
+		{urls: []string{filepath.Join(dir, "notes.txt"), "http://example.com/"}, expected: append(local("notes.txt"), "http://example.com/")},
+	} {
+		expanded, err := expandLocal(test.urls)
+		if err != nil {
+			t.Fatalf("Did not expect to receive an error, got %s", err)
+		}
+		if !reflect.DeepEqual(expanded, test.expected) {
+			t.Errorf("Expected %v to expand to %v, got %v", test.urls, test.expected, expanded)
+		}
+	}
+	if _, err := expandLocal([]string{filepath.Join(dir, "*.json")}); err == nil {
+		t.Errorf("Expected an error for a glob which matches nothing")
+	}
+}
+
+func TestReaderExpandsLocal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "local")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var expected []string
+	for _, name := range []string{"a.html", "b.html"} {
+		file := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(file, []byte("<path>a.jpg</path>"), 0644); err != nil {
+			t.Fatalf("failed to write page: %s", err)
+		}
+		u, _ := fileURL(file)
+		expected = append(expected, u)
+	}
+
+	// A glob which matches nothing is asked for again
+	input := strings.Join([]string{filepath.Join(dir, "*.pdf"), dir, "q"}, "\n") + "\n"
+	inputReady := make(chan struct{})
+	errors := make(chan error)
+	quit := make(chan struct{})
+	out := readerFrom(strings.NewReader(input), inputReady, errors, quit)
+
+	var got []string
+	for range expected {
+		inputReady <- struct{}{}
+		select {
+		case err := <-errors:
+			t.Fatalf("Did not expect to receive an error, got %s", err)
+		case u := <-out:
+			got = append(got, u)
+		}
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected the pages in the directory %v, got %v", expected, got)
+	}
+	inputReady <- struct{}{}
+	<-quit
+}
+
+func TestResolveURL(t *testing.T) {
+	for _, test := range []struct {
+		base, ref, expected string
+	}{
+		{"file:///saved/list.html", "apricot.html", "file:///saved/apricot.html"},
+		{"file:///saved/list/index.html", "../products/apricot.html", "file:///saved/products/apricot.html"},
+		{"file:///saved/list.html", "http://example.com/apricot.html", "http://example.com/apricot.html"},
+		{"http://example.com/shop/list", "/product/apricot", "http://example.com/product/apricot"},
+	} {
+		if resolved := resolveURL(test.base, test.ref); resolved != test.expected {
+			t.Errorf("Expected %s on %s to be %s, got %s", test.ref, test.base, test.expected, resolved)
+		}
+	}
+}
+
+// A Sainsburys list page saved to the disk with relative links to its
+// product pages, which are read from the disk too
+func TestLocalScrape(t *testing.T) {
+	dir, err := ioutil.TempDir("", "local")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	base := "http://hiring-tests.s3-website-eu-west-1.amazonaws.com/2015_Developer_Scrape/"
+	replay, err := NewReplayReader("testdata/fixtures")
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	for name, file := range map[string]string{
+		"5_products.html": "saved/list.html",
+		"sainsburys-apricot-ripe---ready-320g.html":   "saved/products/sainsburys-apricot-ripe---ready-320g.html",
+		"sainsburys-kiwi-fruit--ripe---ready-x4.html": "saved/products/sainsburys-kiwi-fruit--ripe---ready-x4.html",
+	} {
+		body, err := replay.GetBody(base + name)
+		if err != nil {
+			t.Fatalf("Did not expect to receive an error, got %s", err)
+		}
+		body = strings.Replace(body, base, "products/", -1)
+		file = filepath.Join(dir, file)
+		os.MkdirAll(filepath.Dir(file), 0755)
+		if err := ioutil.WriteFile(file, []byte(body), 0644); err != nil {
+			t.Fatalf("failed to write %s: %s", file, err)
+		}
+	}
+
+	wd, _ := os.Getwd()
+	profiles := fmt.Sprintf(`[{"name": "saved", "hosts": ["*"], "definitions": {"page": %q, "product": %q}, "reader": "file", "formatter": "sainsburys"}]`,
+		filepath.Join(wd, ListDefinition), filepath.Join(wd, ProductDefinition))
+	for name, content := range map[string]string{
+		"profiles.json": profiles,
+		"urls.txt":      filepath.Join(dir, "saved", "list.html"),
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write %s: %s", name, err)
+		}
+	}
+
+	out := filepath.Join(dir, "out.ndjson")
+	err = batchCommand([]string{
+		"-profiles", filepath.Join(dir, "profiles.json"),
+		"-sink", "ndjson:" + out,
+		filepath.Join(dir, "urls.txt"),
+	})
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	records, err := readNDJSON(out)
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	descriptions := make([]interface{}, 0, len(records))
+	for _, record := range records {
+		descriptions = append(descriptions, record["description"])
+	}
+	expected := []interface{}{"Buy Sainsbury's Apricot Ripe & Ready x5 online from Sainsbury's", "Kiwi fruit, ready to eat"}
+	if !reflect.DeepEqual(descriptions, expected) {
+		b, _ := json.Marshal(records)
+		t.Errorf("Expected the descriptions from the product pages on the disk %v, got %s", expected, b)
+	}
+}
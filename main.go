@@ -4,9 +4,12 @@
 package main
 
 import (
-	"encoding/json"
-	"fmt"
+	"flag"
 	"log"
+	"os"
+	"strings"
+
+	"github.com/ganners/scraper/definition"
 )
 
 const (
@@ -20,6 +23,10 @@ const (
 	// the following URL:
 	ListDefinition    = "definitions/sainsburys-list.definition"
 	ProductDefinition = "definitions/sainsburys-product.definition"
+
+	// Profiles of the sites which can be scraped, if this doesn't exist then
+	// the definitions above are used for any URL
+	ProfilesFile = "profiles.json"
 )
 
 var (
@@ -27,17 +34,83 @@ var (
 	// The HttpReader is the most simple
 	// The GoogleCacheReader is useful for grabbing the live site's source
 	DefaultWebReader WebReader = NewHttpReader()
+
+	// Records rejected by the rules of a definition are written here, or
+	// dropped if it is empty
+	QuarantineFile = ""
 )
 
 // Parsed represents the fields and the body size of the page that has
-// been returned
+// been returned. When parsed with a bundle, the results of each definition
+// are in Records rather than Fields. When parsed with a chain of definitions,
+// Definition is the file of the one which was used. Records which broke the
+// rules of the definition are in Rejected rather than Fields
 type Parsed struct {
-	Fields []map[string]interface{}
-	Size   int
+	URL        string
+	Fields     []map[string]interface{}
+	Records    map[string]interface{}
+	Size       int
+	Definition string
+	Rejected   []definition.Rejection
+}
+
+// Output is what a formatter gives for a page, the whole of it in Value and
+// the records within it in Records, for sinks which write records. The router
+// sets the name of the profile which it came from
+type Output struct {
+	URL     string
+	Profile string
+	Value   interface{}
+	Records []map[string]interface{}
+}
+
+// Commands which can be given as the first argument, instead of running the
+// interactive scraper
+var commands = map[string]func(args []string) error{
+	"batch":   batchCommand,
+	"diff":    diffCommand,
+	"infer":   inferCommand,
+	"render":  renderCommand,
+	"reparse": reparseCommand,
+	"schema":  schemaCommand,
 }
 
 func main() {
 
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		command, found := commands[os.Args[1]]
+		if !found {
+			log.Fatalf("Error: unknown command %s", os.Args[1])
+		}
+		if err := command(os.Args[2:]); err != nil {
+			log.Fatalf("Error: %s", err)
+		}
+		return
+	}
+
+	fetch := newFetchFlags(flag.CommandLine)
+	openSink := sinkFlags(flag.CommandLine)
+	provenance := flag.Bool("provenance", false, "attach where each field came from to every record, for every profile")
+	flag.Parse()
+	sink, err := openSink()
+	if err != nil {
+		log.Fatalf("Error: %s", err)
+	}
+	defer sink.Close()
+
+	profiles, err := loadProfiles(ProfilesFile)
+	if err != nil {
+		log.Fatalf("Error: %s", err)
+	}
+	if *provenance {
+		provenanceProfiles(profiles)
+	}
+	fetching, err := fetch.apply(profiles)
+	if err != nil {
+		log.Fatalf("Error: %s", err)
+	}
+	defer fetching.Close()
+
 	// errors will exit the program if an error is received
 	errors := make(chan error)
 
@@ -50,9 +123,7 @@ func main() {
 
 	// Orchestrate the pipeline
 	input := reader(inputReady, errors, quit)
-	webContent := getter(input, errors, quit)
-	parsedContent := parser(webContent, errors, quit, ListDefinition)
-	printable := sainsburysFormatter(parsedContent, errors, quit)
+	printable := router(input, errors, quit, profiles)
 
 	go func() {
 		// Listen to errors and kill the application if one comes in Possibly
@@ -63,9 +134,11 @@ func main() {
 	}()
 
 	go func() {
-		// Print out anything which comes back from the printable str
-		for str := range printable {
-			fmt.Println(str)
+		// Write out anything which comes back from the printable output
+		for output := range printable {
+			if err := sink.Write(output); err != nil {
+				errors <- err
+			}
 			inputReady <- struct{}{} // Ask for another URL
 		}
 	}()
@@ -83,16 +156,19 @@ func main() {
 //
 // This particular worker is tied specifically to the Sainsburys
 // definition file for the price calculation. It will gracefully handle
-// missing fields.
+// missing fields. The quantity of each product is computed by the
+// definition, see sainsburys-list.computed
 //
-// It also handles the fetching of child page descriptions
+// It also handles the fetching of child page descriptions, using the profile's
+// "product" definition
 func sainsburysFormatter(
 	in <-chan Parsed,
 	errors chan<- error,
 	quit chan struct{},
-) chan string {
+	profile *Profile,
+) chan Output {
 
-	out := make(chan string)
+	out := make(chan Output)
 
 	for i := 0; i < NumPresenterWorkers; i++ {
 		go func() {
@@ -103,8 +179,8 @@ func sainsburysFormatter(
 			// Each worker gets it's own pipeline so it can be used synchrously
 			// and in order.
 			subIn := make(chan string)
-			descriptionPageGetter := getter(subIn, errors, quit)
-			descriptionParser := parser(descriptionPageGetter, errors, quit, ProductDefinition)
+			descriptionPageGetter := getterUsing(profile.WebReader(), subIn, errors, quit)
+			descriptionParser := profile.parser("product", descriptionPageGetter, errors, quit)
 
 			for {
 				select {
@@ -134,39 +210,86 @@ func sainsburysFormatter(
 
 						// Grab the description (wait for one element, making
 						// use synchronously)
-						subIn <- product["productPath"].(string)
+						// Relative paths are relative to the list page, which
+						// keeps them on the disk for saved pages
+						productPath, _ := product["productPath"].(string)
+						subIn <- resolveURL(parsed.URL, productPath)
 						description := <-descriptionParser
 
 						if len(description.Fields) == 1 {
 							parsed.Fields[i]["description"] = description.Fields[0]["description"]
 							parsed.Fields[i]["size"] = float64(description.Size) / 1024
+
+							// Carry the description's provenance over too
+							child, ok := description.Fields[0][definition.ProvenanceKey].(map[string]definition.Provenance)
+							if ok {
+								if parent, ok := product[definition.ProvenanceKey].(map[string]definition.Provenance); ok {
+									parent["description"] = child["description"]
+								}
+							}
 						}
 
+						// The rules of the definition should make sure these
+						// are here, but say so if they aren't
 						pricePerMeasure, ok := product["pricePerMeasure"].(int)
 						if !ok {
+							log.Printf("[Warning] %v has no pricePerMeasure, it is left out of the totals", product["productName"])
 							continue
 						}
 						pricePerUnit, ok := product["pricePerUnit"].(int)
 						if !ok {
+							log.Printf("[Warning] %v has no pricePerUnit, it is left out of the totals", product["productName"])
 							continue
 						}
 						presentation.TotalUnit += pricePerUnit
 						presentation.TotalMeasure += pricePerMeasure
-
-						// Set the number of units (the quantity)
-						parsed.Fields[i]["quantity"] = pricePerUnit / pricePerMeasure
 					}
 
-					b, err := json.Marshal(presentation)
-					if err != nil {
-						errors <- fmt.Errorf("unable to marshal presentation into json: %s", err)
+					// Hand it to the sinks, which print out the products
+					// or the whole presentation
+					out <- Output{
+						URL:     parsed.URL,
+						Value:   presentation,
+						Records: parsed.Fields,
 					}
-
-					// Just print it out
-					out <- string(b)
 				}
 			}
 		}()
 	}
 	return out
 }
+
+// The schema of what the sainsburysFormatter prints, which is the products
+// with their descriptions merged in and the totals
+func sainsburysSchema(profile *Profile) (*definition.Schema, error) {
+	list, err := definition.NewDefinition(profile.Definitions[PageDefinition])
+	if err != nil {
+		return nil, err
+	}
+	product, err := definition.NewDefinition(profile.Definitions["product"])
+	if err != nil {
+		return nil, err
+	}
+
+	// The description and size of the product page are merged in, when it
+	// could be fetched
+	products := list.RecordSchema()
+	if description, found := product.RecordSchema().Properties["description"]; found {
+		products.Properties["description"] = description
+	}
+	products.Properties["size"] = &definition.Schema{
+		Type:        "number",
+		Description: "The size of the product page in KB",
+	}
+
+	return &definition.Schema{
+		Type: "object",
+		Properties: map[string]*definition.Schema{
+			"products":          definition.ListOf(products),
+			"totalUnitPrice":    {Type: "integer"},
+			"totalMeasurePrice": {Type: "integer"},
+			"numProducts":       {Type: "integer"},
+		},
+		Required: []string{"numProducts", "products", "totalMeasurePrice", "totalUnitPrice"},
+	}, nil
+}
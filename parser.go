@@ -3,22 +3,105 @@ package main
 import (
 	"encoding/binary"
 	"log"
+	"path/filepath"
 
 	"github.com/ganners/scraper/definition"
 )
 
 // Parser will apply the definition to the html body, to return a series of
-// keys to values
+// keys to values. With provenance, where each field came from is attached to
+// every record, see definition.Provenance
+//
+// The definition file can also be a bundle of definitions, in which case each
+// is applied in the same pass and the results are keyed by name in Records
+//
+// The defaults from the rules of the definition and then its computed fields
+// are added to each record, and then records which break its rules are
+// rejected, see definition.Rules and definition.Computed. Neither are applied
+// to bundles
 func parser(
-	in <-chan string,
+	in <-chan Page,
 	errors chan<- error,
 	quit chan struct{},
 	definitionFile string,
+	provenance bool,
 ) chan Parsed {
 
-	def, err := definition.NewDefinition(definitionFile)
-	if err != nil {
-		log.Fatal("failed to read definition: %s", err)
+	var apply func(page Page, p *Parsed)
+	if filepath.Ext(definitionFile) == definition.BundleExtension {
+		bundle, err := definition.NewBundle(definitionFile)
+		if err != nil {
+			log.Fatalf("failed to read bundle: %s", err)
+		}
+		apply = func(page Page, p *Parsed) {
+			if provenance {
+				p.Records = bundle.ParseWithProvenance(page.Body, page.URL)
+			} else {
+				p.Records = bundle.Parse(page.Body)
+			}
+		}
+	} else {
+		def, err := definition.NewDefinition(definitionFile)
+		if err != nil {
+			log.Fatalf("failed to read definition: %s", err)
+		}
+		apply = func(page Page, p *Parsed) {
+			if provenance {
+				p.Fields = def.ParseWithProvenance(page.Body, page.URL)
+			} else {
+				p.Fields = def.Parse(page.Body)
+			}
+			p.Fields, p.Rejected = finish(def, page.URL, p.Fields)
+		}
+	}
+
+	out := make(chan Parsed)
+
+	for i := 0; i < NumParserWorkers; i++ {
+		go func() {
+			for {
+				select {
+				case <-quit:
+					return
+				case page := <-in:
+					p := Parsed{
+						URL:  page.URL,
+						Size: binary.Size([]byte(page.Body)),
+					}
+					apply(page, &p)
+					rejections.add(p.URL, p.Rejected)
+					out <- p
+				}
+			}
+		}()
+	}
+	return out
+}
+
+// ChainParser is the parser for a list of definitions, the first being the
+// current one and the rest older ones to fall back to. Each page is parsed
+// with the first definition to meet the rules, or the best one when none do,
+// and which one was used is logged so that layout changes get noticed
+func chainParser(
+	in <-chan Page,
+	errors chan<- error,
+	quit chan struct{},
+	definitionFiles []string,
+	rules MatchRules,
+	provenance bool,
+) chan Parsed {
+
+	chain := &definition.Chain{
+		MinRecords: rules.MinRecords,
+		Required:   rules.Required,
+		Best:       rules.Best,
+	}
+	for _, file := range definitionFiles {
+		def, err := definition.NewDefinition(file)
+		if err != nil {
+			log.Fatalf("failed to read definition: %s", err)
+		}
+		chain.Definitions = append(chain.Definitions, def)
 	}
 
 	out := make(chan Parsed)
@@ -29,11 +112,27 @@ func parser(
 				select {
 				case <-quit:
 					return
-				case body := <-in:
+				case page := <-in:
+					var result definition.ChainResult
+					if provenance {
+						result = chain.ParseWithProvenance(page.Body, page.URL)
+					} else {
+						result = chain.Parse(page.Body)
+					}
+					if result.Met {
+						log.Printf("%s matched %s (%d of %d records complete)",
+							page.URL, result.Definition.File, result.Score.Complete, result.Score.Records)
+					} else {
+						log.Printf("[Warning] No definition met the thresholds for %s, using %s (%d of %d records complete)",
+							page.URL, result.Definition.File, result.Score.Complete, result.Score.Records)
+					}
 					p := Parsed{
-						Fields: def.Parse(body),
-						Size:   binary.Size([]byte(body)),
+						URL:        page.URL,
+						Size:       binary.Size([]byte(page.Body)),
+						Definition: result.Definition.File,
 					}
+					p.Fields, p.Rejected = finish(result.Definition, page.URL, result.Fields)
+					rejections.add(p.URL, p.Rejected)
 					out <- p
 				}
 			}
@@ -41,3 +140,20 @@ func parser(
 	}
 	return out
 }
+
+// Fills in the defaults of the rules and adds the computed fields to each
+// record, reporting any which couldn't be, and then checks the records
+// against the rules
+func finish(
+	def *definition.DefinitionParser,
+	url string,
+	records []map[string]interface{},
+) ([]map[string]interface{}, []definition.Rejection) {
+	for i, fields := range records {
+		def.Rules.Defaults(fields)
+		for _, err := range def.Computed.Apply(fields) {
+			log.Printf("[Warning] Could not compute a field of record %d from %s: %s", i, url, err)
+		}
+	}
+	return def.Rules.Check(records)
+}
@@ -2,8 +2,12 @@ package main
 
 import (
 	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
+
+	"github.com/ganners/scraper/definition"
 )
 
 func TestParser(t *testing.T) {
@@ -18,10 +22,10 @@ func TestParser(t *testing.T) {
 	}
 	defer tmpfile.Close()
 
-	input := make(chan string)
+	input := make(chan Page)
 	errors := make(chan error)
 	quit := make(chan struct{})
-	out := parser(input, errors, quit, tmpfile.Name())
+	out := parser(input, errors, quit, tmpfile.Name(), false)
 
 	for _, test := range []struct {
 		input  string
@@ -53,7 +57,7 @@ func TestParser(t *testing.T) {
 			},
 		},
 	} {
-		input <- test.input
+		input <- Page{Body: test.input}
 		output := <-out
 
 		if !reflect.DeepEqual(output, test.output) {
@@ -61,3 +65,220 @@ func TestParser(t *testing.T) {
 		}
 	}
 }
+
+func TestParserBundle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bundle")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range map[string]string{
+		"path.definition":  "<path>{{path}}</path>",
+		"title.definition": "<title>{{title}}</title>",
+		"page.bundle": `{
+			"paths": {"definition": "path.definition"},
+			"title": {"definition": "title.definition", "field": "title"}
+		}`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write %s: %s", name, err)
+		}
+	}
+
+	input := make(chan Page)
+	errors := make(chan error)
+	quit := make(chan struct{})
+	defer close(quit)
+	out := parser(input, errors, quit, filepath.Join(dir, "page.bundle"), false)
+
+	input <- Page{
+		URL:  "http://example.com/",
+		Body: "<title>Paths</title><path>foo.jpg</path><path>bar.jpg</path> EOF",
+	}
+	output := <-out
+
+	expected := Parsed{
+		URL: "http://example.com/",
+		Records: map[string]interface{}{
+			"paths": []map[string]interface{}{
+				{"path": "foo.jpg"},
+				{"path": "bar.jpg"},
+			},
+			"title": "Paths",
+		},
+		Size: 64,
+	}
+	if !reflect.DeepEqual(output, expected) {
+		t.Errorf("Output %+v does not match expected %+v", output, expected)
+	}
+}
+
+func TestChainParser(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chain")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range map[string]string{
+		"v2.definition": "<img src=\"{{path}}\" alt=\"{{alt}}\">",
+		"v1.definition": "<path>{{path}}</path>",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write %s: %s", name, err)
+		}
+	}
+
+	input := make(chan Page)
+	errors := make(chan error)
+	quit := make(chan struct{})
+	defer close(quit)
+	out := chainParser(input, errors, quit, []string{
+		filepath.Join(dir, "v2.definition"),
+		filepath.Join(dir, "v1.definition"),
+	}, MatchRules{Required: []string{"path"}}, false)
+
+	for _, test := range []struct {
+		input  string
+		output Parsed
+	}{
+		{
+			input: "<img src=\"foo.jpg\" alt=\"Foo\"><!-- --> EOF",
+			output: Parsed{
+				Fields: []map[string]interface{}{
+					{"path": "foo.jpg", "alt": "Foo"},
+				},
+				Size:       41,
+				Definition: filepath.Join(dir, "v2.definition"),
+			},
+		},
+		{
+			input: "<path>foo.jpg</path><!-- --> EOF",
+			output: Parsed{
+				Fields: []map[string]interface{}{
+					{"path": "foo.jpg"},
+				},
+				Size:       32,
+				Definition: filepath.Join(dir, "v1.definition"),
+			},
+		},
+	} {
+		input <- Page{Body: test.input}
+		output := <-out
+
+		if !reflect.DeepEqual(output, test.output) {
+			t.Errorf("Output %+v does not match expected %+v", output, test.output)
+		}
+	}
+}
+
+func TestParserRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rules")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range map[string]string{
+		"path.definition": "<path>{{path}}</path>",
+		"path.rules":      `{"path": {"maxLength": 7}}`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write %s: %s", name, err)
+		}
+	}
+
+	input := make(chan Page)
+	errors := make(chan error)
+	quit := make(chan struct{})
+	defer close(quit)
+	out := parser(input, errors, quit, filepath.Join(dir, "path.definition"), false)
+
+	input <- Page{Body: "<path>foo.jpg</path><!-- --><path>foobar.jpg</path> EOF"}
+	output := <-out
+
+	expected := Parsed{
+		Fields: []map[string]interface{}{
+			{"path": "foo.jpg"},
+		},
+		Size: 55,
+		Rejected: []definition.Rejection{
+			{
+				Fields: map[string]interface{}{"path": "foobar.jpg"},
+				Field:  "path",
+				Reason: "path is longer than 7 characters",
+			},
+		},
+	}
+	if !reflect.DeepEqual(output, expected) {
+		t.Errorf("Output %+v does not match expected %+v", output, expected)
+	}
+}
+
+func TestParserProvenance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "provenance")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "path.definition")
+	if err := ioutil.WriteFile(file, []byte("<path>{{path}}</path>"), 0644); err != nil {
+		t.Fatalf("failed to write definition: %s", err)
+	}
+
+	for _, provenance := range []bool{false, true} {
+		input := make(chan Page)
+		errors := make(chan error)
+		quit := make(chan struct{})
+		out := parser(input, errors, quit, file, provenance)
+
+		input <- Page{URL: "http://example.com/", Body: "<path>foo.jpg</path> EOF"}
+		p := <-out
+		close(quit)
+		if len(p.Fields) != 1 {
+			t.Fatalf("Expected one record, got %+v", p.Fields)
+		}
+		attached, ok := p.Fields[0][definition.ProvenanceKey].(map[string]definition.Provenance)
+		if ok != provenance {
+			t.Errorf("Expected provenance to be attached %t, got %+v", provenance, p.Fields[0])
+		}
+		if provenance && attached["path"].Source != "http://example.com/" {
+			t.Errorf("Expected the provenance of path to be from the page, got %+v", attached["path"])
+		}
+	}
+}
+
+func TestParserComputedDefaults(t *testing.T) {
+	dir, err := ioutil.TempDir("", "computed")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range map[string]string{
+		"path.definition": "<path>{{path}}</path>",
+		"path.rules":      `{"size": {"default": "large"}}`,
+		"path.computed":   `label = path + " (" + size + ")"`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write %s: %s", name, err)
+		}
+	}
+
+	input := make(chan Page)
+	errors := make(chan error)
+	quit := make(chan struct{})
+	defer close(quit)
+	out := parser(input, errors, quit, filepath.Join(dir, "path.definition"), false)
+
+	// The default is there for the computed field to use
+	input <- Page{Body: "<path>foo.jpg</path> EOF"}
+	output := <-out
+	expected := []map[string]interface{}{
+		{"path": "foo.jpg", "size": "large", "label": "foo.jpg (large)"},
+	}
+	if !reflect.DeepEqual(output.Fields, expected) {
+		t.Errorf("Output %+v does not match expected %+v", output.Fields, expected)
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ganners/scraper/definition"
+)
+
+// PageDefinition is the role of the definition which is applied to every page
+// of a profile, other roles are up to the formatter
+const PageDefinition = "page"
+
+// Profile describes how to scrape a site: which URLs it is for, how to fetch
+// them, which definitions to apply and how to format the result
+type Profile struct {
+	Name string `json:"name"`
+
+	// Patterns for the host and path of URLs which this profile is for. A *
+	// matches anything (including /), no paths means any path
+	Hosts []string `json:"hosts"`
+	Paths []string `json:"paths"`
+
+	// Definitions (or bundles) by role, relative to the profiles file. The
+	// "page" definition is required
+	Definitions map[string]string `json:"definitions"`
+
+	// Older definitions by role, tried in order when the definition for
+	// that role doesn't meet the thresholds in Match. They can't be bundles
+	Fallbacks map[string][]string   `json:"fallbacks"`
+	Match     map[string]MatchRules `json:"match"`
+
+	// Parse each page as it is read rather than once it has all been, for
+	// pages which are too large to hold in memory. The page definition
+	// can't be a bundle or have fallbacks
+	Stream bool `json:"stream"`
+
+	// Attach where each field came from (the raw text, its position, the
+	// URL and the definition) to every record under "_provenance"
+	Provenance bool `json:"provenance"`
+
+	// The name of the WebReader and the formatter to use. No reader means
+	// the DefaultWebReader
+	Reader    string `json:"reader"`
+	Formatter string `json:"formatter"`
+
+	// How hard to fetch from each host, see HostLimits
+	Limits HostLimits `json:"limits"`
+
+	// How to make requests, on top of the -http options, when the reader is
+	// http (or googlecache)
+	HTTP *HttpOptions `json:"http"`
+
+	// The cookies to keep and how to log in, see Session
+	Session *Session `json:"session"`
+
+	// Requests which inputs can make by name, with {placeholders} in them
+	// filled in from the input, see RequestSpec
+	Requests map[string]RequestSpec `json:"requests"`
+
+	// The version of the schema of what the profile prints, which has to be
+	// bumped whenever the schema changes, see the schema command
+	SchemaVersion string `json:"schemaVersion"`
+
+	webReader WebReader
+
+	// Makes requests to the site itself with the http options, whatever
+	// the reader is, such as for robots.txt
+	http *HttpReader
+}
+
+// MatchRules are the thresholds which a definition has to meet for a page
+// before it is used over the fallbacks
+type MatchRules struct {
+	// At least this many records (default 1) with all of the required fields
+	MinRecords int      `json:"minRecords"`
+	Required   []string `json:"required"`
+
+	// Try every definition and use the one with the most complete records,
+	// rather than the first to meet the thresholds
+	Best bool `json:"best"`
+}
+
+// A formatter is the final stage of a profile's pipeline, turning what has
+// been parsed into something which can be printed
+type formatter func(
+	in <-chan Parsed,
+	errors chan<- error,
+	quit chan struct{},
+	profile *Profile,
+) chan Output
+
+// The formatters which profiles can name
+var formatters = map[string]formatter{
+	"sainsburys": sainsburysFormatter,
+	"json":       jsonFormatter,
+}
+
+// The schema of what each formatter prints, for a profile
+var formatterSchemas = map[string]func(profile *Profile) (*definition.Schema, error){
+	"sainsburys": sainsburysSchema,
+	"json":       jsonSchema,
+}
+
+// The definition roles which formatters need, on top of the page definition
+var formatterDefinitions = map[string][]string{
+	"sainsburys": {"product"},
+}
+
+// The WebReaders which profiles can name
+var webReaders = map[string]func() WebReader{
+	"http":        func() WebReader { return NewHttpReader() },
+	"surf":        func() WebReader { return NewSurfReader() },
+	"phantom":     func() WebReader { return NewPhantomReader() },
+	"googlecache": func() WebReader { return NewGoogleCacheReader() },
+	"file":        func() WebReader { return NewFileReader(nil) },
+}
+
+// LoadProfiles reads a profiles file, which is a JSON list of profiles. When
+// a URL matches more than one, the first is used
+func LoadProfiles(profilesFile string) ([]*Profile, error) {
+	b, err := ioutil.ReadFile(profilesFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read profiles: %s", err)
+	}
+
+	profiles := make([]*Profile, 0, 10)
+	if err := json.Unmarshal(b, &profiles); err != nil {
+		return nil, fmt.Errorf("could not decode profiles: %s", err)
+	}
+	if len(profiles) == 0 {
+		return nil, fmt.Errorf("no profiles in %s", profilesFile)
+	}
+
+	for i, p := range profiles {
+		if err := p.init(filepath.Dir(profilesFile)); err != nil {
+			return nil, fmt.Errorf("profile %d (%s) %s", i, p.Name, err)
+		}
+	}
+	return profiles, nil
+}
+
+// The profile used when there is no profiles file, which is the Sainsburys
+// scraper for any URL
+func defaultProfiles() []*Profile {
+	p := &Profile{
+		Name:  "sainsburys",
+		Hosts: []string{"*"},
+		Definitions: map[string]string{
+			PageDefinition: ListDefinition,
+			"product":      ProductDefinition,
+		},
+		Formatter:     "sainsburys",
+		SchemaVersion: "1.0.0",
+	}
+	p.init("")
+	return []*Profile{p}
+}
+
+// Loads the ProfilesFile if there is one, or the default profiles if not
+func loadProfiles(profilesFile string) ([]*Profile, error) {
+	if _, err := os.Stat(profilesFile); os.IsNotExist(err) {
+		return defaultProfiles(), nil
+	}
+	return LoadProfiles(profilesFile)
+}
+
+// Checks the profile and resolves what it names
+func (p *Profile) init(dir string) error {
+	if len(p.Hosts) == 0 {
+		return fmt.Errorf("has no hosts")
+	}
+	if _, found := p.Definitions[PageDefinition]; !found {
+		return fmt.Errorf("has no %s definition", PageDefinition)
+	}
+	for role, file := range p.Definitions {
+		if !filepath.IsAbs(file) {
+			p.Definitions[role] = filepath.Join(dir, file)
+		}
+	}
+	for role, files := range p.Fallbacks {
+		if _, found := p.Definitions[role]; !found {
+			return fmt.Errorf("has fallbacks but no %s definition", role)
+		}
+		if filepath.Ext(p.Definitions[role]) == definition.BundleExtension {
+			return fmt.Errorf("has fallbacks for the %s bundle, which isn't supported", role)
+		}
+		for i, file := range files {
+			if filepath.Ext(file) == definition.BundleExtension {
+				return fmt.Errorf("has a bundle in the %s fallbacks, which isn't supported", role)
+			}
+			if !filepath.IsAbs(file) {
+				files[i] = filepath.Join(dir, file)
+			}
+		}
+	}
+	if p.Stream && (len(p.Fallbacks[PageDefinition]) > 0 || filepath.Ext(p.Definitions[PageDefinition]) == definition.BundleExtension) {
+		return fmt.Errorf("streams, which its %s definition doesn't support", PageDefinition)
+	}
+	if _, found := formatters[p.Formatter]; !found {
+		return fmt.Errorf("has an unknown formatter %q", p.Formatter)
+	}
+	for _, role := range formatterDefinitions[p.Formatter] {
+		if _, found := p.Definitions[role]; !found {
+			return fmt.Errorf("has no %s definition, which the %s formatter needs", role, p.Formatter)
+		}
+	}
+	if err := p.Limits.init(); err != nil {
+		return err
+	}
+	if p.Session != nil {
+		if err := p.Session.init(dir); err != nil {
+			return err
+		}
+	}
+	for name, spec := range p.Requests {
+		if spec.URL == "" {
+			return fmt.Errorf("has the request %s with no url", name)
+		}
+		if spec.Template != "" || spec.Params != nil {
+			return fmt.Errorf("has the request %s, which can't be a template itself", name)
+		}
+	}
+	if p.Reader != "" {
+		newWebReader, found := webReaders[p.Reader]
+		if !found {
+			return fmt.Errorf("has an unknown reader %q", p.Reader)
+		}
+		p.webReader = newWebReader()
+	}
+	return nil
+}
+
+// Starts a parser stage for the definition of a role, which tries the
+// fallbacks when there are any
+func (p *Profile) parser(
+	role string,
+	in <-chan Page,
+	errors chan<- error,
+	quit chan struct{},
+) chan Parsed {
+	if len(p.Fallbacks[role]) == 0 {
+		return parser(in, errors, quit, p.Definitions[role], p.Provenance)
+	}
+	files := append([]string{p.Definitions[role]}, p.Fallbacks[role]...)
+	return chainParser(in, errors, quit, files, p.Match[role], p.Provenance)
+}
+
+// Starts the stages which fetch and parse each page with the page
+// definition, which is the streamer when the profile streams
+func (p *Profile) pages(
+	in <-chan string,
+	errors chan<- error,
+	quit chan struct{},
+) chan Parsed {
+	if p.Stream {
+		return streamer(p.WebReader(), in, errors, quit, p.Definitions[PageDefinition], p.Provenance)
+	}
+	webContent := getterUsing(p.WebReader(), in, errors, quit)
+	return p.parser(PageDefinition, webContent, errors, quit)
+}
+
+// Has every profile attach provenance, for the -provenance flag
+func provenanceProfiles(profiles []*Profile) {
+	for _, p := range profiles {
+		p.Provenance = true
+	}
+}
+
+// Returns a plain http reader with the profile's http options, for what has
+// to come from the site itself rather than through the profile's reader
+func (p *Profile) httpReader() *HttpReader {
+	if p.http == nil {
+		p.http = NewHttpReader()
+	}
+	return p.http
+}
+
+// WebReader returns the reader to fetch pages for this profile with
+func (p *Profile) WebReader() WebReader {
+	if p.webReader == nil {
+		return DefaultWebReader
+	}
+	return p.webReader
+}
+
+// Matches returns whether the URL is one this profile is for
+func (p *Profile) Matches(u *url.URL) bool {
+	host := strings.ToLower(u.Hostname())
+	hostMatched := false
+	for _, pattern := range p.Hosts {
+		if globMatch(strings.ToLower(pattern), host) {
+			hostMatched = true
+			break
+		}
+	}
+	if !hostMatched {
+		return false
+	}
+
+	if len(p.Paths) == 0 {
+		return true
+	}
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	for _, pattern := range p.Paths {
+		if globMatch(pattern, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the first profile which the URL matches
+func matchProfile(profiles []*Profile, rawurl string) (*Profile, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse url: %s", err)
+	}
+	for _, p := range profiles {
+		if p.Matches(u) {
+			return p, nil
+		}
+	}
+	return nil, fmt.Errorf("no profile matches %s", rawurl)
+}
+
+// Matches a string against a pattern where * matches any run of characters
+func globMatch(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == s
+	}
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return strings.HasSuffix(s, parts[len(parts)-1])
+}
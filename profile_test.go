@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGlobMatch(t *testing.T) {
+	for _, test := range []struct {
+		pattern string
+		str     string
+		matches bool
+	}{
+		{pattern: "*", str: "anything", matches: true},
+		{pattern: "www.example.com", str: "www.example.com", matches: true},
+		{pattern: "www.example.com", str: "example.com", matches: false},
+		{pattern: "*.example.com", str: "shop.example.com", matches: true},
+		{pattern: "*.example.com", str: "example.com", matches: false},
+		{pattern: "/shop/*/list", str: "/shop/fruit/veg/list", matches: true},
+		{pattern: "/shop/*/list", str: "/shop/fruit/veg", matches: false},
+		{pattern: "/shop/*", str: "/shop/", matches: true},
+	} {
+		if matches := globMatch(test.pattern, test.str); matches != test.matches {
+			t.Errorf("Expected %q matching %q to be %t, got %t", test.pattern, test.str, test.matches, matches)
+		}
+	}
+}
+
+func TestLoadProfiles(t *testing.T) {
+	profiles, err := LoadProfiles("profiles.example.json")
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+
+	for rawurl, name := range map[string]string{
+		"http://hiring-tests.s3-website-eu-west-1.amazonaws.com/2015_Developer_Scrape/5_products.html": "sainsburys-test",
+		"http://www.sainsburys.co.uk/shop/gb/groceries/fruit-veg/ripe---ready":                         "sainsburys",
+		"https://shop.sainsburys.co.uk:8080/":                                                          "sainsburys",
+		"http://hiring-tests.s3-website-eu-west-1.amazonaws.com/other.html":                            "",
+		"http://example.com/": "",
+	} {
+		profile, err := matchProfile(profiles, rawurl)
+		if name == "" {
+			if err == nil {
+				t.Errorf("Expected no profile to match %s, got %s", rawurl, profile.Name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Expected %s to match %s, got %s", rawurl, name, err)
+		} else if profile.Name != name {
+			t.Errorf("Expected %s to match %s, got %s", rawurl, name, profile.Name)
+		}
+	}
+
+	u, _ := url.Parse("http://www.sainsburys.co.uk/")
+	if _, ok := profiles[1].WebReader().(*GoogleCacheReader); !ok || !profiles[1].Matches(u) {
+		t.Errorf("Expected the sainsburys profile to use the google cache reader")
+	}
+}
+
+func TestLoadProfilesErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "profiles")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, content := range []string{
+		`[]`,
+		`[{"name": "a", "definitions": {"page": "a.definition"}, "formatter": "json"}]`,
+		`[{"name": "a", "hosts": ["*"], "definitions": {}, "formatter": "json"}]`,
+		`[{"name": "a", "hosts": ["*"], "definitions": {"page": "a.definition"}, "formatter": "nope"}]`,
+		`[{"name": "a", "hosts": ["*"], "definitions": {"page": "a.definition"}, "formatter": "sainsburys"}]`,
+		`[{"name": "a", "hosts": ["*"], "definitions": {"page": "a.definition"}, "formatter": "json", "reader": "nope"}]`,
+		`[{"name": "a", "hosts": ["*"], "definitions": {"page": "a.definition"}, "fallbacks": {"list": ["b.definition"]}, "formatter": "json"}]`,
+		`[{"name": "a", "hosts": ["*"], "definitions": {"page": "a.definition"}, "fallbacks": {"page": ["b.bundle"]}, "formatter": "json"}]`,
+		`[{"name": "a", "hosts": ["*"], "definitions": {"page": "a.definition"}, "formatter": "json", "limits": {"crawlDelay": "soon"}}]`,
+	} {
+		file := filepath.Join(dir, "profiles.json")
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write profiles: %s", err)
+		}
+		if _, err := LoadProfiles(file); err == nil {
+			t.Errorf("Expected an error loading %s", content)
+		}
+	}
+}
+
+func TestRouter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "profiles")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range map[string]string{
+		"path.definition":  "<path>{{path}}</path>",
+		"title.definition": "<title>{{title}}</title>",
+		"profiles.json": `[
+			{"name": "paths", "hosts": ["paths.example.com"], "definitions": {"page": "path.definition"}, "formatter": "json"},
+			{"name": "titles", "hosts": ["*"], "definitions": {"page": "title.definition"}, "formatter": "json"}
+		]`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write %s: %s", name, err)
+		}
+	}
+	profiles, err := LoadProfiles(filepath.Join(dir, "profiles.json"))
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+
+	body := "<title>Paths</title><path>foo.jpg</path><path>bar.jpg</path> EOF"
+	defaultWebReader := DefaultWebReader
+	defer func() { DefaultWebReader = defaultWebReader }()
+	DefaultWebReader = mapReader{
+		"http://paths.example.com/":  body,
+		"http://titles.example.com/": body,
+	}
+
+	input := make(chan string)
+	errors := make(chan error)
+	quit := make(chan struct{})
+	defer close(quit)
+	out := router(input, errors, quit, profiles)
+
+	for url, expected := range map[string]string{
+		"http://paths.example.com/":  `[{"path":"foo.jpg"},{"path":"bar.jpg"}]`,
+		"http://titles.example.com/": `[{"title":"Paths"}]`,
+	} {
+		input <- url
+		select {
+		case err := <-errors:
+			t.Fatalf("Did not expect to receive an error, got %s", err)
+		case output := <-out:
+			b, err := json.Marshal(output.Value)
+			if err != nil {
+				t.Fatalf("Did not expect to receive an error, got %s", err)
+			}
+			if string(b) != expected {
+				t.Errorf("Output %s does not match expected %s", b, expected)
+			}
+		}
+	}
+}
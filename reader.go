@@ -3,6 +3,8 @@ package main
 import (
 	"bufio"
 	"fmt"
+	"io"
+	"log"
 	"os"
 	"strings"
 )
@@ -14,9 +16,21 @@ func reader(
 	errors chan<- error,
 	quit chan struct{},
 ) chan string {
+	return readerFrom(os.Stdin, inputReady, errors, quit)
+}
+
+// ReaderFrom is the reader, but reading the input from r rather than stdin.
+// A directory or glob is every page it stands for (see expandLocal), which
+// are sent one at a time as each is ready for
+func readerFrom(
+	r io.Reader,
+	inputReady chan struct{},
+	errors chan<- error,
+	quit chan struct{},
+) chan string {
 
 	out := make(chan string)
-	reader := bufio.NewReader(os.Stdin)
+	reader := bufio.NewReader(r)
 
 	go func() {
 		for {
@@ -47,7 +61,23 @@ func reader(
 					return
 				}
 
-				out <- text
+				// A directory or glob which has no pages is asked for
+				// again rather than ending the run
+				inputs, err := expandLocal([]string{text})
+				if err != nil {
+					log.Printf("[Warning] %s", err)
+					goto Retry
+				}
+				for i, input := range inputs {
+					if i > 0 {
+						select {
+						case <-quit:
+							return
+						case <-inputReady:
+						}
+					}
+					out <- input
+				}
 			}
 		}
 	}()
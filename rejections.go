@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ganners/scraper/definition"
+)
+
+// Counts the records rejected by the rules of the definitions during a run,
+// by the field which they failed on, and quarantines them
+type rejectionCounter struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+var rejections = &rejectionCounter{
+	counts: make(map[string]int),
+}
+
+// Records the rejected records of a page. They are logged, and written to the
+// QuarantineFile (as a JSON line each) if there is one, otherwise dropped
+func (c *rejectionCounter) add(url string, rejected []definition.Rejection) {
+	if len(rejected) == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, r := range rejected {
+		c.counts[r.Field]++
+		log.Printf("[Warning] Rejected a record from %s: %s", url, r.Reason)
+	}
+
+	if QuarantineFile == "" {
+		return
+	}
+	f, err := os.OpenFile(QuarantineFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		log.Printf("[Error] Could not open quarantine file: %s", err)
+		return
+	}
+	defer f.Close()
+
+	encoder := json.NewEncoder(f)
+	for _, r := range rejected {
+		quarantined := struct {
+			URL string `json:"url"`
+			definition.Rejection
+		}{url, r}
+		if err := encoder.Encode(quarantined); err != nil {
+			log.Printf("[Error] Could not quarantine record: %s", err)
+			return
+		}
+	}
+}
+
+// Summarises the rejections so far, e.g. "3 (pricePerUnit: 2, productName: 1)"
+func (c *rejectionCounter) String() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	total := 0
+	fields := make([]string, 0, len(c.counts))
+	for field, count := range c.counts {
+		total += count
+		fields = append(fields, field)
+	}
+	if total == 0 {
+		return "0"
+	}
+	sort.Strings(fields)
+	for i, field := range fields {
+		fields[i] = fmt.Sprintf("%s: %d", field, c.counts[field])
+	}
+	return fmt.Sprintf("%d (%s)", total, strings.Join(fields, ", "))
+}
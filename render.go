@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/ganners/scraper/definition"
+)
+
+// The render command runs a definition forwards over some records, producing
+// content which the definition will parse back into those records. This is
+// useful for fixtures, e.g.
+//
+//	scraper render -definition product.definition -records records.json -repeat 1000
+//
+// The records are a JSON array of objects
+func renderCommand(args []string) error {
+	flags := flag.NewFlagSet("render", flag.ContinueOnError)
+	definitionFile := flags.String("definition", "", "the definition to render")
+	recordsFile := flags.String("records", "", "a JSON file of records to render")
+	repeat := flags.Int("repeat", 1, "how many times to repeat the records")
+	out := flags.String("out", "", "where to write the content, defaults to stdout")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *definitionFile == "" || *recordsFile == "" || *repeat < 1 {
+		return fmt.Errorf("usage: scraper render -definition file.definition -records records.json [-repeat n] [-out file.html]")
+	}
+
+	def, err := definition.NewDefinition(*definitionFile)
+	if err != nil {
+		return err
+	}
+
+	b, err := ioutil.ReadFile(*recordsFile)
+	if err != nil {
+		return fmt.Errorf("could not read records: %s", err)
+	}
+	records := make([]map[string]interface{}, 0, 10)
+	if err := json.Unmarshal(b, &records); err != nil {
+		return fmt.Errorf("could not decode records: %s", err)
+	}
+
+	repeated := make([]map[string]interface{}, 0, len(records)*(*repeat))
+	for i := 0; i < *repeat; i++ {
+		repeated = append(repeated, records...)
+	}
+
+	content, err := def.Render(repeated)
+	if err != nil {
+		return err
+	}
+
+	if *out == "" {
+		_, err = fmt.Fprint(os.Stdout, content)
+		return err
+	}
+	return ioutil.WriteFile(*out, []byte(content), 0644)
+}
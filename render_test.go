@@ -0,0 +1,38 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRenderCommandRepeat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "render")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range map[string]string{
+		"path.definition": "<path>{{path}}</path>",
+		"records.json":    `[{"path": "foo.jpg"}]`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write %s: %s", name, err)
+		}
+	}
+
+	out := filepath.Join(dir, "out.html")
+	for repeat, fails := range map[string]bool{"2": false, "0": true, "-1": true} {
+		err := renderCommand([]string{
+			"-definition", filepath.Join(dir, "path.definition"),
+			"-records", filepath.Join(dir, "records.json"),
+			"-repeat", repeat,
+			"-out", out,
+		})
+		if (err != nil) != fails {
+			t.Errorf("Expected failing with -repeat %s to be %t, got %v", repeat, fails, err)
+		}
+	}
+}
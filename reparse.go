@@ -0,0 +1,120 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+// The reparse command runs definitions over the pages in an archive (see
+// batch -archive) or a WARC file, without touching the network. The pages are
+// either those in a file of URLs or every page in the archive which matches
+// the -url patterns, e.g.
+//
+//	scraper reparse -archive archive -profiles profiles.json urls.txt
+//	scraper reparse -archive archive -definition new.definition -url "*/ripe---ready*"
+//	scraper reparse -warc crawl.warc.gz -definition new.definition
+//
+// Child pages (such as product descriptions) come from the archive too. Pages
+// fetched with requests other than a GET (such as a POST of a form) are only
+// reparsed when the file has their requests, as they can't be matched by URL
+func reparseCommand(args []string) error {
+	flags := flag.NewFlagSet("reparse", flag.ContinueOnError)
+	archiveDir := flags.String("archive", "", "the archive of raw pages")
+	warcFile := flags.String("warc", "", "a WARC file of raw pages, rather than an archive")
+	profilesFile := flags.String("profiles", ProfilesFile, "the profiles to route URLs with")
+	definitionFile := flags.String("definition", "", "parse every page with this definition (or bundle) rather than the profiles")
+	patterns := &listFlag{}
+	flags.Var(patterns, "url", "only the archived URLs matching this pattern, where * matches anything. Can be given more than once")
+	flags.StringVar(&QuarantineFile, "quarantine", QuarantineFile, "where to write records which break the rules")
+	provenance := flags.Bool("provenance", false, "attach where each field came from to every record, for every profile")
+	openSink := sinkFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if (*archiveDir == "") == (*warcFile == "") || flags.NArg() > 1 {
+		return fmt.Errorf("usage: scraper reparse -archive dir|-warc file.warc [-profiles profiles.json | -definition file] [-url pattern]... [-sink format[:file]]... [urls.txt]")
+	}
+
+	// Where the pages come from, and which pages there are
+	var source WebReader
+	var archived []string
+	if *archiveDir != "" {
+		archive, err := OpenArchive(*archiveDir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range archive.Entries() {
+			if entry.Method == "" {
+				archived = append(archived, entry.URL)
+			}
+		}
+		source = archive
+	} else {
+		warc, err := OpenWARC(*warcFile)
+		if err != nil {
+			return err
+		}
+		archived = warc.URLs()
+		source = warc
+	}
+
+	var profiles []*Profile
+	var err error
+	if *definitionFile != "" {
+		p := &Profile{
+			Name:        "reparse",
+			Hosts:       []string{"*"},
+			Definitions: map[string]string{PageDefinition: *definitionFile},
+			Formatter:   "json",
+		}
+		if err := p.init(""); err != nil {
+			return err
+		}
+		profiles = []*Profile{p}
+	} else if profiles, err = loadProfiles(*profilesFile); err != nil {
+		return err
+	}
+	for _, p := range profiles {
+		p.webReader = source
+	}
+	if *provenance {
+		provenanceProfiles(profiles)
+	}
+
+	var urls []string
+	if flags.NArg() == 1 {
+		if urls, err = readURLs(flags.Arg(0)); err != nil {
+			return err
+		}
+	} else {
+		for _, url := range archived {
+			if matchesAny(*patterns, url) {
+				urls = append(urls, url)
+			}
+		}
+	}
+	if len(urls) == 0 {
+		return fmt.Errorf("there are no pages to reparse")
+	}
+
+	sink, err := openSink()
+	if err != nil {
+		return err
+	}
+	defer sink.Close()
+
+	return scrapeAll(profiles, urls, sink)
+}
+
+// Whether the URL matches any of the patterns, or there are none
+func matchesAny(patterns []string, url string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if globMatch(pattern, url) {
+			return true
+		}
+	}
+	return false
+}
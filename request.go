@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// RequestSpec is an input which is a whole request rather than a URL, for
+// pages which are only reached by submitting a form. It is given as JSON in
+// place of the URL, e.g.
+//
+//	{"method": "POST", "url": "https://example.com/search", "form": {"q": "apricot"}}
+//
+// The page it gives is parsed by the profile which matches the URL, like any
+// other
+//
+// A profile can also have requests of its own, which inputs name as a
+// template along with the params to fill in its {placeholders}, e.g.
+//
+//	{"template": "search", "params": {"q": "apricot"}}
+//
+// The page it gives is parsed by that profile
+type RequestSpec struct {
+	// GET unless there is a form or JSON, then POST
+	Method string `json:"method,omitempty"`
+	URL    string `json:"url,omitempty"`
+
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// The body, either a form (which goes in the query of a GET) or JSON
+	Form map[string]string `json:"form,omitempty"`
+	JSON json.RawMessage   `json:"json,omitempty"`
+
+	// Retry it when it fails, although it is a POST (or another method
+	// which can't always be sent twice), for sites where that is safe
+	Retry bool `json:"retry,omitempty"`
+
+	// The name of a profile's request to make in place of the rest, and
+	// what to fill in its placeholders with
+	Template string            `json:"template,omitempty"`
+	Params   map[string]string `json:"params,omitempty"`
+}
+
+// ParseRequest parses an input, which is either a URL or a RequestSpec
+func ParseRequest(input string) (*Request, error) {
+	spec, err := decodeRequest(input)
+	if err != nil {
+		return nil, err
+	}
+	if spec == nil {
+		return &Request{URL: strings.TrimSpace(input)}, nil
+	}
+	if spec.Template != "" {
+		return nil, fmt.Errorf("no profile has the request %s", spec.Template)
+	}
+	return spec.request()
+}
+
+// Decodes an input which is a RequestSpec, or gives nil if it is a URL
+func decodeRequest(input string) (*RequestSpec, error) {
+	input = strings.TrimSpace(input)
+	if !strings.HasPrefix(input, "{") {
+		return nil, nil
+	}
+
+	var spec RequestSpec
+	decoder := json.NewDecoder(strings.NewReader(input))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&spec); err != nil {
+		return nil, fmt.Errorf("could not decode request %s: %s", input, err)
+	}
+	return &spec, nil
+}
+
+// Returns the request which the spec describes
+func (s RequestSpec) request() (*Request, error) {
+	if s.Params != nil {
+		return nil, fmt.Errorf("the request for %s has params but no template", s.URL)
+	}
+	if s.URL == "" {
+		return nil, fmt.Errorf("the request has no url")
+	}
+	if s.Form != nil && s.JSON != nil {
+		return nil, fmt.Errorf("the request for %s has both a form and JSON", s.URL)
+	}
+
+	req := &Request{
+		Method: strings.ToUpper(s.Method),
+		URL:    s.URL,
+		Header: http.Header{},
+		Retry:  s.Retry,
+	}
+	if req.Method == "" && (s.Form != nil || s.JSON != nil) {
+		req.Method = "POST"
+	}
+	for name, value := range s.Headers {
+		req.Header.Set(name, value)
+	}
+
+	switch {
+	case s.Form != nil && req.method() == "GET":
+		u, err := url.Parse(s.URL)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse url: %s", err)
+		}
+		query := u.Query()
+		for name, value := range s.Form {
+			query.Set(name, value)
+		}
+		u.RawQuery = query.Encode()
+		req.URL = u.String()
+	case s.Form != nil:
+		form := url.Values{}
+		for name, value := range s.Form {
+			form.Set(name, value)
+		}
+		req.Body = form.Encode()
+		setDefault(req.Header, "Content-Type", "application/x-www-form-urlencoded")
+	case s.JSON != nil:
+		if req.method() == "GET" {
+			return nil, fmt.Errorf("the request for %s can't GET with JSON", s.URL)
+		}
+		var body bytes.Buffer
+		if err := json.Compact(&body, s.JSON); err != nil {
+			return nil, fmt.Errorf("could not encode JSON of the request for %s: %s", s.URL, err)
+		}
+		req.Body = body.String()
+		setDefault(req.Header, "Content-Type", "application/json")
+	}
+	return req, nil
+}
+
+// Sets the header unless it already has a value
+func setDefault(header http.Header, name, value string) {
+	if header.Get(name) == "" {
+		header.Set(name, value)
+	}
+}
+
+// The placeholders in a request template, such as {q}
+var placeholder = regexp.MustCompile(`\{(\w+)\}`)
+
+// Returns the template with its placeholders filled in with the params. A
+// placeholder in the JSON is filled in as the inside of a JSON string
+func (s RequestSpec) fill(params map[string]string) (RequestSpec, error) {
+	var missing []string
+	replace := func(escape func(string) string) func(string) string {
+		return func(match string) string {
+			name := placeholder.FindStringSubmatch(match)[1]
+			value, found := params[name]
+			if !found {
+				missing = append(missing, name)
+				return match
+			}
+			return escape(value)
+		}
+	}
+	text := replace(func(value string) string { return value })
+	query := replace(url.QueryEscape)
+	inJSON := replace(func(value string) string {
+		b, _ := json.Marshal(value)
+		return string(b[1 : len(b)-1])
+	})
+
+	filled := s
+	filled.Method = placeholder.ReplaceAllStringFunc(s.Method, text)
+	filled.URL = placeholder.ReplaceAllStringFunc(s.URL, query)
+	if s.Headers != nil {
+		filled.Headers = make(map[string]string, len(s.Headers))
+		for name, value := range s.Headers {
+			filled.Headers[name] = placeholder.ReplaceAllStringFunc(value, text)
+		}
+	}
+	if s.Form != nil {
+		filled.Form = make(map[string]string, len(s.Form))
+		for name, value := range s.Form {
+			filled.Form[name] = placeholder.ReplaceAllStringFunc(value, text)
+		}
+	}
+	if s.JSON != nil {
+		filled.JSON = json.RawMessage(placeholder.ReplaceAllStringFunc(string(s.JSON), inJSON))
+	}
+
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return filled, fmt.Errorf("the request for %s needs the params %s", s.URL, strings.Join(missing, ", "))
+	}
+	return filled, nil
+}
+
+// Returns the input to send down the pipeline of the profile which it is for,
+// along with the profile. An input naming a request of a profile is filled in
+// and sent to that profile, the rest go to the profile which matches the URL
+func routeInput(profiles []*Profile, input string) (string, *Profile, error) {
+	spec, err := decodeRequest(input)
+	if err != nil {
+		return "", nil, err
+	}
+	if spec != nil && spec.Template != "" {
+		for _, p := range profiles {
+			template, found := p.Requests[spec.Template]
+			if !found {
+				continue
+			}
+			filled, err := template.fill(spec.Params)
+			if err != nil {
+				return "", nil, fmt.Errorf("could not make the request %s: %s", spec.Template, err)
+			}
+			b, err := json.Marshal(filled)
+			if err != nil {
+				return "", nil, fmt.Errorf("could not encode the request %s: %s", spec.Template, err)
+			}
+			return string(b), p, nil
+		}
+		return "", nil, fmt.Errorf("no profile has the request %s", spec.Template)
+	}
+
+	req, err := ParseRequest(input)
+	if err != nil {
+		return "", nil, err
+	}
+	profile, err := matchProfile(profiles, req.URL)
+	if err != nil {
+		return "", nil, err
+	}
+	return input, profile, nil
+}
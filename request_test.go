@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseRequest(t *testing.T) {
+	form := http.Header{"Content-Type": {"application/x-www-form-urlencoded"}}
+	for input, expected := range map[string]Request{
+		"http://example.com/shop": {URL: "http://example.com/shop"},
+		`{"url": "http://example.com/shop"}`: {
+			URL:    "http://example.com/shop",
+			Header: http.Header{},
+		},
+		`{"url": "http://example.com/search", "form": {"q": "apricot", "store": "2"}}`: {
+			Method: "POST",
+			URL:    "http://example.com/search",
+			Header: form,
+			Body:   "q=apricot&store=2",
+		},
+		`{"method": "get", "url": "http://example.com/search?page=2", "form": {"q": "kiwi fruit"}}`: {
+			Method: "GET",
+			URL:    "http://example.com/search?page=2&q=kiwi+fruit",
+			Header: http.Header{},
+		},
+		`{"url": "http://example.com/search", "form": {"q": "apricot"}, "retry": true}`: {
+			Method: "POST",
+			URL:    "http://example.com/search",
+			Header: form,
+			Body:   "q=apricot",
+			Retry:  true,
+		},
+		`{"method": "PUT", "url": "http://example.com/api", "json": {"q": "apricot", "limit": 10}, "headers": {"X-Store": "2"}}`: {
+			Method: "PUT",
+			URL:    "http://example.com/api",
+			Header: http.Header{"Content-Type": {"application/json"}, "X-Store": {"2"}},
+			Body:   `{"q":"apricot","limit":10}`,
+		},
+	} {
+		req, err := ParseRequest(input)
+		if err != nil {
+			t.Errorf("Did not expect to receive an error for %s, got %s", input, err)
+			continue
+		}
+		if !reflect.DeepEqual(*req, expected) {
+			t.Errorf("Expected %s to be %+v, got %+v", input, expected, *req)
+		}
+	}
+
+	for _, input := range []string{
+		`{"method": "POST"}`,
+		`{"url": "http://example.com/search", "form": {"q": "apricot"}, "json": {"q": "apricot"}}`,
+		`{"method": "GET", "url": "http://example.com/search", "json": {"q": "apricot"}}`,
+		`{"url": "http://example.com/search", "from": {"q": "apricot"}}`,
+		`{"url": "http://example.com/search"`,
+		`{"url": "http://example.com/search", "params": {"q": "apricot"}}`,
+		`{"template": "search", "params": {"q": "apricot"}}`,
+	} {
+		if _, err := ParseRequest(input); err == nil {
+			t.Errorf("Expected an error for the request %s", input)
+		}
+	}
+}
+
+func TestRequestPipeline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "request")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Write([]byte("<path>search-form.jpg</path> EOF"))
+			return
+		}
+		r.ParseForm()
+		w.Write([]byte("<path>" + r.Form.Get("q") + ".jpg</path> EOF"))
+	}))
+	defer server.Close()
+
+	for name, content := range map[string]string{
+		"path.definition": "<path>{{path}}</path>",
+		"profiles.json":   `[{"name": "search", "hosts": ["*"], "definitions": {"page": "path.definition"}, "formatter": "json"}]`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write %s: %s", name, err)
+		}
+	}
+
+	inputs := map[string]string{
+		server.URL + "/search": `[{"path":"search-form.jpg"}]`,
+		`{"url": "` + server.URL + `/search", "form": {"q": "apricot"}}`: `[{"path":"apricot.jpg"}]`,
+		`{"url": "` + server.URL + `/search", "form": {"q": "kiwi"}}`:    `[{"path":"kiwi.jpg"}]`,
+	}
+	scrape := func(profiles []*Profile) {
+		input := make(chan string)
+		errors := make(chan error)
+		quit := make(chan struct{})
+		defer close(quit)
+		out := router(input, errors, quit, profiles)
+
+		for in, expected := range inputs {
+			input <- in
+			select {
+			case err := <-errors:
+				t.Fatalf("Did not expect to receive an error, got %s", err)
+			case output := <-out:
+				b, _ := json.Marshal(output.Value)
+				if string(b) != expected {
+					t.Errorf("Expected %s to give %s, got %s", in, expected, b)
+				}
+			}
+		}
+	}
+
+	// Each search is recorded as a fixture of its own, and replayed
+	fixtures := filepath.Join(dir, "fixtures")
+	profiles, err := LoadProfiles(filepath.Join(dir, "profiles.json"))
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	localProfiles(profiles)
+	if err := recordProfiles(profiles, fixtures); err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	scrape(profiles)
+	if files, _ := filepath.Glob(filepath.Join(fixtures, "*.json")); len(files) != len(inputs) {
+		t.Errorf("Expected a fixture for each request, got %v", files)
+	}
+
+	server.Close()
+	profiles, _ = LoadProfiles(filepath.Join(dir, "profiles.json"))
+	if err := replayProfiles(profiles, fixtures); err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	scrape(profiles)
+}
+
+func TestRequestReaders(t *testing.T) {
+	search := &Request{Method: "POST", URL: "http://example.com/search", Body: "q=apricot"}
+
+	// Readers which can only GET say so rather than getting the page
+	if _, err := doRequest(mapReader{"http://example.com/search": "<path>a.jpg</path>"}, search); err == nil {
+		t.Errorf("Expected an error posting with a reader which can only GET")
+	}
+	if _, err := NewFileReader(nil).Do(&Request{Method: "POST", URL: "saved/list.html"}); err == nil {
+		t.Errorf("Expected an error posting to a local file")
+	}
+	if _, err := NewGoogleCacheReader().Do(search); err == nil {
+		t.Errorf("Expected an error posting through the google cache")
+	}
+
+	// Nor does the cache answer them, or keep what they give
+	dir, err := ioutil.TempDir("", "request")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	cache, err := OpenHTTPCache(dir, 0)
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	posts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posts++
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Write([]byte("<path>a.jpg</path>"))
+	}))
+	defer server.Close()
+
+	reader := NewCachingReader(NewHttpReader(), cache, "", false)
+	for i := 0; i < 2; i++ {
+		resp, err := reader.Do(&Request{Method: "POST", URL: server.URL, Body: "q=apricot"})
+		if err != nil || resp.Body != "<path>a.jpg</path>" {
+			t.Errorf("Expected the page from the post, got %+v (%v)", resp, err)
+		}
+	}
+	if posts != 2 {
+		t.Errorf("Expected every post to be sent, got %d", posts)
+	}
+	if _, err := NewCachingReader(NewHttpReader(), cache, "", true).Do(search); err == nil {
+		t.Errorf("Expected an error posting with only the cache")
+	}
+}
+
+func TestRequestTemplates(t *testing.T) {
+	search := RequestSpec{
+		URL:     "http://example.com/search/{store}",
+		Headers: map[string]string{"X-Store": "{store}"},
+		Form:    map[string]string{"q": "{q}", "sort": "price"},
+	}
+	filled, err := search.fill(map[string]string{"q": "kiwi fruit", "store": "camden town"})
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	expected := RequestSpec{
+		URL:     "http://example.com/search/camden+town",
+		Headers: map[string]string{"X-Store": "camden town"},
+		Form:    map[string]string{"q": "kiwi fruit", "sort": "price"},
+	}
+	if !reflect.DeepEqual(filled, expected) {
+		t.Errorf("Expected the template to be filled in as %+v, got %+v", expected, filled)
+	}
+	if _, err := search.fill(map[string]string{"q": "kiwi"}); err == nil {
+		t.Errorf("Expected an error for a template missing a param")
+	}
+
+	api := RequestSpec{URL: "http://example.com/api", JSON: json.RawMessage(`{"q": "{q}", "limit": 10}`)}
+	filled, err = api.fill(map[string]string{"q": `"kiwi"`})
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	if string(filled.JSON) != `{"q": "\"kiwi\"", "limit": 10}` {
+		t.Errorf("Expected the param to be escaped in the JSON, got %s", filled.JSON)
+	}
+
+	// An input naming a template goes to the profile which has it, whatever
+	// the URL
+	profiles := []*Profile{
+		{Name: "other", Hosts: []string{"*"}},
+		{Name: "shop", Hosts: []string{"shop.example.com"}, Requests: map[string]RequestSpec{"search": search}},
+	}
+	input, profile, err := routeInput(profiles, `{"template": "search", "params": {"q": "apricot", "store": "2"}}`)
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	if profile != profiles[1] {
+		t.Errorf("Expected the profile with the template, got %s", profile.Name)
+	}
+	req, err := ParseRequest(input)
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	if req.Method != "POST" || req.URL != "http://example.com/search/2" || req.Body != "q=apricot&sort=price" || req.Header.Get("X-Store") != "2" {
+		t.Errorf("Expected the filled in request, got %+v", req)
+	}
+	if _, _, err := routeInput(profiles, `{"template": "checkout"}`); err == nil {
+		t.Errorf("Expected an error for a template which no profile has")
+	}
+}
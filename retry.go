@@ -0,0 +1,264 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy says how often and how long to wait to try a fetch again
+type RetryPolicy struct {
+	// The most times to try, 1 means no retries
+	Attempts int
+
+	// The wait before the first retry, which doubles for each one after up to
+	// MaxDelay. A random half of each wait is taken off so that workers don't
+	// retry in step. A Retry-After from the site is waited instead, up to
+	// MaxDelay too
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+// DefaultRetryPolicy is used unless the flags say otherwise
+var DefaultRetryPolicy = RetryPolicy{
+	Attempts:  3,
+	BaseDelay: time.Second,
+	MaxDelay:  30 * time.Second,
+}
+
+// Counts the retries during a run, by why they were retried, and the fetches
+// which were given up on
+type retryCounter struct {
+	mu      sync.Mutex
+	counts  map[string]int
+	gaveUp  int
+	retried int
+}
+
+var retries = &retryCounter{
+	counts: make(map[string]int),
+}
+
+// Records a retry and why
+func (c *retryCounter) add(reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[reason]++
+	c.retried++
+}
+
+// Records a fetch which failed every attempt
+func (c *retryCounter) giveUp() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gaveUp++
+}
+
+// Summarises the retries so far, e.g. "3 (503: 2, timeout: 1), gave up on 1"
+func (c *retryCounter) String() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.retried == 0 {
+		return "0"
+	}
+	reasons := make([]string, 0, len(c.counts))
+	for reason := range c.counts {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for i, reason := range reasons {
+		reasons[i] = fmt.Sprintf("%s: %d", reason, c.counts[reason])
+	}
+	return fmt.Sprintf("%d (%s), gave up on %d", c.retried, strings.Join(reasons, ", "), c.gaveUp)
+}
+
+// RetryingReader is a WebReader which tries a fetch again when it fails in a
+// way which might not happen next time: a timeout, a dropped connection, a
+// DNS lookup which failed for now, 408, 429 or a 5xx. Anything else, such as
+// a 404 or a host which doesn't exist, is given back straight away. Only
+// requests which can be sent more than once (such as a GET, but not a POST)
+// are retried, unless the request says it can be
+type RetryingReader struct {
+	WebReader
+	policy RetryPolicy
+
+	// How to wait, which tests replace
+	sleep func(time.Duration)
+}
+
+// NewRetryingReader returns a reader which retries what webReader fetches
+func NewRetryingReader(webReader WebReader, policy RetryPolicy) *RetryingReader {
+	return &RetryingReader{
+		WebReader: webReader,
+		policy:    policy,
+		sleep:     time.Sleep,
+	}
+}
+
+// Do makes the request, trying again while it fails in a retryable way. A
+// status which is still retryable after the last attempt is an error
+func (r *RetryingReader) Do(req *Request) (*Response, error) {
+	if !req.idempotent() {
+		return doRequest(r.WebReader, req)
+	}
+	for attempt := 1; ; attempt++ {
+		resp, err := doRequest(r.WebReader, req)
+		reason, retryable := classify(resp, err)
+		if !retryable {
+			return resp, err
+		}
+		if attempt >= r.policy.Attempts {
+			retries.giveUp()
+			if err != nil {
+				return nil, fmt.Errorf("gave up on %s after %d attempts: %w", req.URL, attempt, err)
+			}
+			return nil, fmt.Errorf("gave up on %s after %d attempts: %d %s", req.URL, attempt, resp.StatusCode, http.StatusText(resp.StatusCode))
+		}
+
+		retries.add(reason)
+		delay := r.policy.delay(attempt, resp)
+		log.Printf("[Warning] Retrying %s in %s (%s)", req.URL, delay, reason)
+		r.sleep(delay)
+	}
+}
+
+// GetResponse fetches the page, trying again while it fails in a retryable
+// way
+func (r *RetryingReader) GetResponse(url string) (*Response, error) {
+	return r.Do(&Request{URL: url})
+}
+
+// GetBody fetches the body of the page, trying again while it fails in a
+// retryable way
+func (r *RetryingReader) GetBody(url string) (string, error) {
+	resp, err := r.GetResponse(url)
+	if err != nil {
+		return "", err
+	}
+	return resp.Body, nil
+}
+
+// GetStream opens the body of the page, trying again while opening it fails
+// in a retryable way. Once it is open it isn't retried, as some of it may
+// have been read
+func (r *RetryingReader) GetStream(url string) (*Stream, error) {
+	for attempt := 1; ; attempt++ {
+		stream, err := getStream(r.WebReader, url)
+		if err == nil {
+			return stream, nil
+		}
+		reason, retryable := classify(nil, err)
+		if !retryable {
+			return nil, err
+		}
+		if attempt >= r.policy.Attempts {
+			retries.giveUp()
+			return nil, fmt.Errorf("gave up on %s after %d attempts: %w", url, attempt, err)
+		}
+
+		// The site may say how long to wait
+		var resp *Response
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) {
+			resp = &Response{StatusCode: statusErr.StatusCode, Header: statusErr.Header}
+		}
+		retries.add(reason)
+		delay := r.policy.delay(attempt, resp)
+		log.Printf("[Warning] Retrying %s in %s (%s)", url, delay, reason)
+		r.sleep(delay)
+	}
+}
+
+// Streams when the other reader can
+func (r *RetryingReader) streams(url string) bool {
+	return canStream(r.WebReader, url)
+}
+
+// The wait before the retry after an attempt
+func (p RetryPolicy) delay(attempt int, resp *Response) time.Duration {
+	if resp != nil {
+		if wait, ok := retryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+			if wait > p.MaxDelay {
+				return p.MaxDelay
+			}
+			return wait
+		}
+	}
+
+	delay := p.BaseDelay
+	for i := 1; i < attempt && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Parses a Retry-After header, which is either seconds or a date
+func retryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if wait := date.Sub(now); wait > 0 {
+			return wait, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// Returns why a fetch failed and whether it is worth trying again. A fetch
+// which worked has no reason
+func classify(resp *Response, err error) (string, bool) {
+	if err != nil {
+		var dnsErr *net.DNSError
+		var netErr net.Error
+		var statusErr *StatusError
+		switch {
+		case errors.As(err, &statusErr):
+			return classify(&Response{StatusCode: statusErr.StatusCode}, nil)
+		case errors.As(err, &dnsErr):
+			// A host which doesn't exist won't next time either
+			return "dns", !dnsErr.IsNotFound
+		case errors.As(err, &netErr) && netErr.Timeout():
+			return "timeout", true
+		case errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.ECONNRESET),
+			errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, io.EOF):
+			return "connection", true
+		}
+		return "error", false
+	}
+
+	switch code := resp.StatusCode; {
+	case code == http.StatusRequestTimeout, code == http.StatusTooManyRequests,
+		code >= 500 && code != http.StatusNotImplemented:
+		return strconv.Itoa(code), true
+	}
+	return "", false
+}
+
+// Retries the fetches of every profile
+func retryProfiles(profiles []*Profile, policy RetryPolicy) {
+	for _, p := range profiles {
+		p.webReader = NewRetryingReader(p.WebReader(), policy)
+	}
+}
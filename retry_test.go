@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Gives each of its results in turn, then the last one again
+type flakyReader struct {
+	results []interface{}
+	calls   int
+}
+
+func (f *flakyReader) GetResponse(url string) (*Response, error) {
+	result := f.results[len(f.results)-1]
+	if f.calls < len(f.results) {
+		result = f.results[f.calls]
+	}
+	f.calls++
+	switch result := result.(type) {
+	case error:
+		return nil, result
+	case *Response:
+		return result, nil
+	}
+	return &Response{URL: url, StatusCode: result.(int), Header: http.Header{}, Body: "<path>a.jpg</path>"}, nil
+}
+
+func (f *flakyReader) GetBody(url string) (string, error) {
+	resp, err := f.GetResponse(url)
+	if err != nil {
+		return "", err
+	}
+	return resp.Body, nil
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestRetryingReader(t *testing.T) {
+	policy := RetryPolicy{Attempts: 3, BaseDelay: time.Second, MaxDelay: 10 * time.Second}
+	for _, test := range []struct {
+		name    string
+		results []interface{}
+		calls   int
+		fails   bool
+	}{
+		{name: "works", results: []interface{}{200}, calls: 1},
+		{name: "unavailable then works", results: []interface{}{503, 503, 200}, calls: 3},
+		{name: "always unavailable", results: []interface{}{503}, calls: 3, fails: true},
+		{name: "rate limited", results: []interface{}{429, 200}, calls: 2},
+		{name: "not found", results: []interface{}{404}, calls: 1},
+		{name: "not implemented", results: []interface{}{501}, calls: 1},
+		{name: "timeout", results: []interface{}{fmt.Errorf("could not get from url: %w", timeoutError{}), 200}, calls: 2},
+		{name: "connection refused", results: []interface{}{fmt.Errorf("could not get from url: %w", syscall.ECONNREFUSED), 200}, calls: 2},
+		{name: "dns failed for now", results: []interface{}{&net.DNSError{Err: "server misbehaving", Name: "example.com", IsTemporary: true}, 200}, calls: 2},
+		{name: "no such host", results: []interface{}{&net.DNSError{Err: "no such host", Name: "example.com", IsNotFound: true}}, calls: 1, fails: true},
+		{name: "other error", results: []interface{}{errors.New("unsupported protocol scheme")}, calls: 1, fails: true},
+	} {
+		inner := &flakyReader{results: test.results}
+		reader := NewRetryingReader(inner, policy)
+		var waits []time.Duration
+		reader.sleep = func(d time.Duration) { waits = append(waits, d) }
+
+		_, err := reader.GetBody("http://example.com/")
+		if (err != nil) != test.fails {
+			t.Errorf("%s: expected failing to be %t, got %v", test.name, test.fails, err)
+		}
+		if inner.calls != test.calls {
+			t.Errorf("%s: expected %d attempts, got %d", test.name, test.calls, inner.calls)
+		}
+		if len(waits) != test.calls-1 {
+			t.Errorf("%s: expected to wait between each attempt, got %v", test.name, waits)
+		}
+	}
+}
+
+func TestRetryingReaderPost(t *testing.T) {
+	sent := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sent++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	reader := NewRetryingReader(NewHttpReader(), RetryPolicy{Attempts: 3})
+	reader.sleep = func(time.Duration) {}
+
+	// A post could do what it does twice, so it is only sent once
+	resp, err := reader.Do(&Request{Method: "POST", URL: server.URL, Body: "q=apricot"})
+	if err != nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected the 503 to be given back, got %+v (%v)", resp, err)
+	}
+	if sent != 1 {
+		t.Errorf("Expected the post to be sent once, got %d", sent)
+	}
+
+	// Unless the request says it can be retried
+	sent = 0
+	if _, err := reader.Do(&Request{Method: "POST", URL: server.URL, Body: "q=apricot", Retry: true}); err == nil {
+		t.Errorf("Expected an error giving up on the post")
+	}
+	if sent != 3 {
+		t.Errorf("Expected the post to be sent 3 times, got %d", sent)
+	}
+}
+
+func TestRetryingReaderStream(t *testing.T) {
+	served := []int{http.StatusServiceUnavailable, http.StatusOK}
+	sent := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := served[len(served)-1]
+		if sent < len(served) {
+			status = served[sent]
+		}
+		sent++
+		w.Header().Set("Retry-After", "2")
+		w.WriteHeader(status)
+		w.Write([]byte("<path>a.jpg</path>"))
+	}))
+	defer server.Close()
+
+	reader := NewRetryingReader(NewHttpReader(), RetryPolicy{Attempts: 3, MaxDelay: time.Minute})
+	var waits []time.Duration
+	reader.sleep = func(d time.Duration) { waits = append(waits, d) }
+
+	// Opening the stream is retried as a fetch is, waiting as the site says
+	stream, err := reader.GetStream(server.URL)
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	body, _ := ioutil.ReadAll(stream)
+	stream.Close()
+	if string(body) != "<path>a.jpg</path>" || sent != 2 {
+		t.Errorf("Expected the page after 2 attempts, got %q after %d", body, sent)
+	}
+	if len(waits) != 1 || waits[0] != 2*time.Second {
+		t.Errorf("Expected to wait the Retry-After, got %v", waits)
+	}
+
+	// An error page isn't streamed as the page, and a 404 isn't retried
+	served, sent = []int{http.StatusNotFound}, 0
+	_, err = reader.GetStream(server.URL)
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected a 404 StatusError, got %v", err)
+	}
+	if sent != 1 {
+		t.Errorf("Expected the 404 to be fetched once, got %d", sent)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	policy := RetryPolicy{Attempts: 10, BaseDelay: time.Second, MaxDelay: 10 * time.Second}
+	for attempt, max := range map[int]time.Duration{
+		1: time.Second,
+		2: 2 * time.Second,
+		3: 4 * time.Second,
+		4: 8 * time.Second,
+		5: 10 * time.Second,
+		9: 10 * time.Second,
+	} {
+		for i := 0; i < 20; i++ {
+			if delay := policy.delay(attempt, nil); delay < max/2 || delay > max {
+				t.Errorf("Expected the wait after attempt %d to be between %s and %s, got %s", attempt, max/2, max, delay)
+			}
+		}
+	}
+
+	now := time.Now()
+	for _, test := range []struct {
+		retryAfter string
+		expected   time.Duration
+	}{
+		{retryAfter: "5", expected: 5 * time.Second},
+		{retryAfter: "120", expected: 10 * time.Second},
+		{retryAfter: "0", expected: 0},
+	} {
+		resp := &Response{Header: http.Header{"Retry-After": {test.retryAfter}}}
+		if delay := policy.delay(1, resp); delay != test.expected {
+			t.Errorf("Expected Retry-After %s to wait %s, got %s", test.retryAfter, test.expected, delay)
+		}
+	}
+
+	date := now.Add(30 * time.Second).UTC().Format(http.TimeFormat)
+	if wait, ok := retryAfter(date, now); !ok || wait < 29*time.Second || wait > 30*time.Second {
+		t.Errorf("Expected Retry-After %s to wait 30s, got %s", date, wait)
+	}
+	if _, ok := retryAfter("soon", now); ok {
+		t.Errorf("Expected an invalid Retry-After to be ignored")
+	}
+}
+
+func TestRetryStats(t *testing.T) {
+	counter := &retryCounter{counts: make(map[string]int)}
+	if s := counter.String(); s != "0" {
+		t.Errorf("Expected no retries, got %s", s)
+	}
+	counter.add("503")
+	counter.add("timeout")
+	counter.add("503")
+	counter.giveUp()
+	if s := counter.String(); s != "3 (503: 2, timeout: 1), gave up on 1" {
+		t.Errorf("Expected the retries to be summarised, got %s", s)
+	}
+}
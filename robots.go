@@ -0,0 +1,346 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultUserAgent is who we say we are, to sites and to their robots.txt
+var DefaultUserAgent = "scraper"
+
+// BlockedError is the error for a URL which robots.txt doesn't allow us to
+// fetch
+type BlockedError struct {
+	URL  string
+	Rule string
+}
+
+func (e *BlockedError) Error() string {
+	return fmt.Sprintf("%s is blocked by robots.txt (%s)", e.URL, e.Rule)
+}
+
+// Returns the BlockedError within an error, if there is one
+func blockedError(err error) (*BlockedError, bool) {
+	var blocked *BlockedError
+	ok := errors.As(err, &blocked)
+	return blocked, ok
+}
+
+// Counts the URLs blocked by robots.txt during a run, by host
+type blockedCounter struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+var blocked = &blockedCounter{
+	counts: make(map[string]int),
+}
+
+// Records a blocked URL, which is logged
+func (c *blockedCounter) add(err *BlockedError) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	host := err.URL
+	if u, parseErr := url.Parse(err.URL); parseErr == nil {
+		host = u.Host
+	}
+	c.counts[host]++
+	log.Printf("[Warning] Skipped %s", err)
+}
+
+// Summarises the blocked URLs so far, e.g. "3 (www.example.com: 3)"
+func (c *blockedCounter) String() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	total := 0
+	hosts := make([]string, 0, len(c.counts))
+	for host, count := range c.counts {
+		total += count
+		hosts = append(hosts, host)
+	}
+	if total == 0 {
+		return "0"
+	}
+	sort.Strings(hosts)
+	for i, host := range hosts {
+		hosts[i] = fmt.Sprintf("%s: %d", host, c.counts[host])
+	}
+	return fmt.Sprintf("%d (%s)", total, strings.Join(hosts, ", "))
+}
+
+// The rules of a robots.txt for one user agent
+type robotsRules struct {
+	rules      []robotsRule
+	crawlDelay time.Duration
+
+	// Everything is disallowed, when robots.txt couldn't be fetched
+	disallowAll bool
+}
+
+// An Allow or Disallow line
+type robotsRule struct {
+	allow   bool
+	pattern string
+}
+
+func (r robotsRule) String() string {
+	if r.allow {
+		return "Allow: " + r.pattern
+	}
+	return "Disallow: " + r.pattern
+}
+
+// Parses a robots.txt, keeping the group of rules for the user agent. That is
+// the group naming the longest part of it, or the * group if none do
+func parseRobots(content, userAgent string) *robotsRules {
+	type group struct {
+		agents []string
+		rules  robotsRules
+	}
+	var groups []*group
+	var current *group
+	inAgents := false
+
+	for _, line := range strings.Split(content, "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		field := strings.ToLower(strings.TrimSpace(line[:i]))
+		value := strings.TrimSpace(line[i+1:])
+
+		switch field {
+		case "user-agent":
+			// User-agent lines in a row share a group
+			if !inAgents {
+				current = &group{}
+				groups = append(groups, current)
+			}
+			current.agents = append(current.agents, strings.ToLower(value))
+			inAgents = true
+			continue
+		case "allow", "disallow":
+			// An empty Disallow allows everything, so is no rule
+			if current != nil && value != "" {
+				current.rules.rules = append(current.rules.rules, robotsRule{
+					allow:   field == "allow",
+					pattern: value,
+				})
+			}
+		case "crawl-delay":
+			if seconds, err := strconv.ParseFloat(value, 64); current != nil && err == nil && seconds > 0 {
+				current.rules.crawlDelay = time.Duration(seconds * float64(time.Second))
+			}
+		}
+		inAgents = false
+	}
+
+	// Our name is the product token of the user agent, e.g. scraper in
+	// scraper/1.0 (+http://example.com)
+	name := strings.ToLower(userAgent)
+	if i := strings.IndexAny(name, "/ "); i >= 0 {
+		name = name[:i]
+	}
+	var best *group
+	bestLength := -1
+	for _, g := range groups {
+		for _, agent := range g.agents {
+			length := -1
+			if agent == "*" {
+				length = 0
+			} else if agent != "" && strings.Contains(name, agent) {
+				length = len(agent)
+			}
+			if length > bestLength {
+				best, bestLength = g, length
+			}
+		}
+	}
+	if best == nil {
+		return &robotsRules{}
+	}
+	return &best.rules
+}
+
+// Returns whether a path (with its query) may be fetched, and the rule which
+// decided it. The rule with the longest pattern which matches wins, and
+// Allow wins a tie
+func (r *robotsRules) allowed(path string) (bool, string) {
+	if r.disallowAll {
+		return false, "it could not be fetched"
+	}
+	var match *robotsRule
+	for i, rule := range r.rules {
+		if !robotsMatch(rule.pattern, path) {
+			continue
+		}
+		if match == nil || len(rule.pattern) > len(match.pattern) ||
+			(len(rule.pattern) == len(match.pattern) && rule.allow) {
+			match = &r.rules[i]
+		}
+	}
+	if match == nil {
+		return true, ""
+	}
+	return match.allow, match.String()
+}
+
+// Matches a path against a robots.txt pattern, which matches the start of the
+// path. A * matches anything and a $ at the end matches the end
+func robotsMatch(pattern, path string) bool {
+	if strings.HasSuffix(pattern, "$") {
+		return globMatch(strings.TrimSuffix(pattern, "$"), path)
+	}
+	return globMatch(pattern+"*", path)
+}
+
+// RobotsReader is a WebReader which checks robots.txt before fetching a URL,
+// giving a BlockedError for those it disallows for the user agent. Each host's
+// robots.txt is fetched once, from the site itself rather than with the other
+// reader (which could be fetching something else, such as Google's cache), and
+// its Crawl-delay is waited between fetches from the host. A robots.txt which
+// doesn't exist allows everything, and one which fails to fetch allows nothing
+type RobotsReader struct {
+	WebReader
+	userAgent string
+
+	// What fetches robots.txt
+	robots WebReader
+
+	mu    sync.Mutex
+	hosts map[string]*robotsHost
+
+	// The time now and how to wait, which tests replace
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+// The robots.txt of a host, and the turns to fetch from it
+type robotsHost struct {
+	once    sync.Once
+	rules   *robotsRules
+	limiter *hostLimiter
+}
+
+// NewRobotsReader returns a reader which checks robots.txt for the user agent
+// before webReader fetches anything, fetching robots.txt with robotsReader
+func NewRobotsReader(webReader, robotsReader WebReader, userAgent string) *RobotsReader {
+	return &RobotsReader{
+		WebReader: webReader,
+		userAgent: userAgent,
+		robots:    robotsReader,
+		hosts:     make(map[string]*robotsHost),
+		now:       time.Now,
+		sleep:     time.Sleep,
+	}
+}
+
+// Checks the URL against the robots.txt of its host, and waits for its crawl
+// delay
+func (r *RobotsReader) check(rawurl string) error {
+	u, err := url.Parse(rawurl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		// Only sites have a robots.txt
+		return nil
+	}
+	host := strings.ToLower(u.Host)
+
+	r.mu.Lock()
+	h, found := r.hosts[host]
+	if !found {
+		h = &robotsHost{}
+		r.hosts[host] = h
+	}
+	r.mu.Unlock()
+
+	h.once.Do(func() {
+		h.rules = r.fetch(u.Scheme + "://" + u.Host + "/robots.txt")
+		limits := HostLimits{crawlDelay: h.rules.crawlDelay}
+		h.limiter = newHostLimiter(limits, r.now())
+	})
+
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	if u.RawQuery != "" {
+		path += "?" + u.RawQuery
+	}
+	if ok, rule := h.rules.allowed(path); !ok {
+		return &BlockedError{URL: rawurl, Rule: rule}
+	}
+	if wait := h.limiter.reserve(r.now()); wait > 0 {
+		r.sleep(wait)
+	}
+	return nil
+}
+
+// Fetches and parses a robots.txt
+func (r *RobotsReader) fetch(robotsURL string) *robotsRules {
+	resp, err := getResponse(r.robots, robotsURL)
+	if err != nil {
+		log.Printf("[Warning] Could not fetch %s, so nothing on the host will be fetched: %s", robotsURL, err)
+		return &robotsRules{disallowAll: true}
+	}
+	switch {
+	case resp.StatusCode >= 500:
+		log.Printf("[Warning] Could not fetch %s (%d), so nothing on the host will be fetched", robotsURL, resp.StatusCode)
+		return &robotsRules{disallowAll: true}
+	case resp.StatusCode >= 400:
+		return &robotsRules{}
+	}
+	return parseRobots(resp.Body, r.userAgent)
+}
+
+// Do makes the request if robots.txt allows it
+func (r *RobotsReader) Do(req *Request) (*Response, error) {
+	if err := r.check(req.URL); err != nil {
+		return nil, err
+	}
+	return doRequest(r.WebReader, req)
+}
+
+// GetResponse fetches the page if robots.txt allows it
+func (r *RobotsReader) GetResponse(url string) (*Response, error) {
+	return r.Do(&Request{URL: url})
+}
+
+// GetBody fetches the body of the page if robots.txt allows it
+func (r *RobotsReader) GetBody(url string) (string, error) {
+	if err := r.check(url); err != nil {
+		return "", err
+	}
+	return r.WebReader.GetBody(url)
+}
+
+// GetStream opens the body of the page if robots.txt allows it
+func (r *RobotsReader) GetStream(url string) (*Stream, error) {
+	if err := r.check(url); err != nil {
+		return nil, err
+	}
+	return getStream(r.WebReader, url)
+}
+
+// Streams when the other reader can
+func (r *RobotsReader) streams(url string) bool {
+	return canStream(r.WebReader, url)
+}
+
+// Checks robots.txt for every fetch of the profiles, fetching it with their
+// http options
+func robotsProfiles(profiles []*Profile, userAgent string) {
+	for _, p := range profiles {
+		p.webReader = NewRobotsReader(p.WebReader(), p.httpReader(), userAgent)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+const testRobots = `# Robots for example.com
+User-agent: *
+Disallow: /checkout
+Disallow: /*.pdf$
+Allow: /checkout/help
+
+User-agent: scraper
+User-agent: otherbot
+Disallow: /shop/*/offers
+Disallow: /search
+Allow: /search?page=
+Crawl-delay: 2.5
+
+User-agent: scraper-images
+Disallow: /
+`
+
+func TestRobotsRules(t *testing.T) {
+	for _, test := range []struct {
+		userAgent string
+		path      string
+		allowed   bool
+	}{
+		// The * group
+		{"somebot/2.0", "/", true},
+		{"somebot/2.0", "/checkout/pay", false},
+		{"somebot/2.0", "/checkout/help/faq", true},
+		{"somebot/2.0", "/files/terms.pdf", false},
+		{"somebot/2.0", "/files/terms.pdf?download=1", true},
+		{"somebot/2.0", "/shop/fruit/offers", true},
+
+		// Our group, which replaces the * group
+		{"scraper/1.0 (+http://example.com)", "/checkout/pay", true},
+		{"scraper/1.0 (+http://example.com)", "/shop/fruit/veg/offers/today", false},
+		{"Scraper", "/shop/fruit", true},
+		{"scraper", "/search?q=apricot", false},
+		{"scraper", "/search?page=2", true},
+
+		// The group naming more of the agent
+		{"scraper-images", "/shop/fruit", false},
+	} {
+		rules := parseRobots(testRobots, test.userAgent)
+		if allowed, rule := rules.allowed(test.path); allowed != test.allowed {
+			t.Errorf("Expected %s for %s to be allowed %t, got %t (%s)", test.path, test.userAgent, test.allowed, allowed, rule)
+		}
+	}
+
+	if delay := parseRobots(testRobots, "scraper").crawlDelay; delay != 2500*time.Millisecond {
+		t.Errorf("Expected a crawl delay of 2.5s, got %s", delay)
+	}
+	if allowed, _ := parseRobots("", "scraper").allowed("/anything"); !allowed {
+		t.Errorf("Expected an empty robots.txt to allow everything")
+	}
+	if allowed, _ := parseRobots("User-agent: *\nDisallow:\n", "scraper").allowed("/anything"); !allowed {
+		t.Errorf("Expected an empty Disallow to allow everything")
+	}
+}
+
+func TestRobotsReader(t *testing.T) {
+	robotsFetches := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
+		robotsFetches++
+		w.Write([]byte(testRobots))
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<path>" + r.URL.Path + "</path>"))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	reader := NewRobotsReader(NewHttpReader(), NewHttpReader(), "scraper/1.0")
+	var waits []time.Duration
+	reader.sleep = func(d time.Duration) { waits = append(waits, d) }
+	now := time.Now()
+	reader.now = func() time.Time { return now }
+
+	for _, path := range []string{"/shop/fruit", "/shop/veg"} {
+		if body, err := reader.GetBody(server.URL + path); err != nil || body != "<path>"+path+"</path>" {
+			t.Errorf("Expected %s to be fetched, got %q (%v)", path, body, err)
+		}
+	}
+	_, err := reader.GetBody(server.URL + "/shop/fruit/offers")
+	blockedErr, ok := blockedError(err)
+	if !ok {
+		t.Fatalf("Expected a blocked URL to give a BlockedError, got %v", err)
+	}
+	if blockedErr.Rule != "Disallow: /shop/*/offers" {
+		t.Errorf("Expected the rule which blocked it, got %s", blockedErr.Rule)
+	}
+	if robotsFetches != 1 {
+		t.Errorf("Expected robots.txt to be fetched once, got %d", robotsFetches)
+	}
+	if len(waits) != 1 || waits[0] != 2500*time.Millisecond {
+		t.Errorf("Expected the crawl delay between the fetches, got %v", waits)
+	}
+}
+
+func TestRobotsReaderBelowCache(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testRobots))
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Write([]byte("<path>" + r.URL.Path + "</path>"))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "robots")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	cache, err := OpenHTTPCache(dir, 0)
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+
+	robots := NewRobotsReader(NewHttpReader(), NewHttpReader(), "scraper/1.0")
+	var waits []time.Duration
+	robots.sleep = func(d time.Duration) { waits = append(waits, d) }
+	now := time.Now()
+	robots.now = func() time.Time { return now }
+	reader := NewCachingReader(robots, cache, "", false)
+
+	// Only the pages which aren't cached wait for the crawl delay
+	for _, path := range []string{"/shop/fruit", "/shop/fruit", "/shop/fruit", "/shop/veg"} {
+		if _, err := reader.GetBody(server.URL + path); err != nil {
+			t.Fatalf("Did not expect to receive an error, got %s", err)
+		}
+	}
+	if len(waits) != 1 {
+		t.Errorf("Expected only the fetch of a page which isn't cached to wait, got %v", waits)
+	}
+}
+
+func TestRobotsReaderMissing(t *testing.T) {
+	for status, allowed := range map[int]bool{
+		http.StatusNotFound:            true,
+		http.StatusForbidden:           true,
+		http.StatusInternalServerError: false,
+	} {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+		})
+		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("<path>a.jpg</path>"))
+		})
+		server := httptest.NewServer(mux)
+
+		_, err := NewRobotsReader(NewHttpReader(), NewHttpReader(), "scraper").GetBody(server.URL + "/shop")
+		if _, blocked := blockedError(err); blocked == allowed {
+			t.Errorf("Expected a robots.txt which gives %d to allow everything to be %t, got %v", status, allowed, err)
+		}
+		server.Close()
+	}
+
+	// Local files have no robots.txt
+	reader := NewRobotsReader(mapReader{"file:///saved/list.html": "<path>a.jpg</path>"}, mapReader{}, "scraper")
+	if _, err := reader.GetBody("file:///saved/list.html"); err != nil {
+		t.Errorf("Did not expect to receive an error, got %s", err)
+	}
+}
+
+func TestGetterSkipsBlocked(t *testing.T) {
+	webReader := NewRobotsReader(mapReader{
+		"http://example.com/public": "<path>a.jpg</path>",
+	}, mapReader{
+		"http://example.com/robots.txt": "User-agent: *\nDisallow: /private",
+	}, "scraper")
+
+	in := make(chan string)
+	errors := make(chan error)
+	quit := make(chan struct{})
+	defer close(quit)
+	out := getterUsing(webReader, in, errors, quit)
+
+	for url, expected := range map[string]string{
+		"http://example.com/public":  "<path>a.jpg</path>",
+		"http://example.com/private": "",
+	} {
+		in <- url
+		select {
+		case err := <-errors:
+			t.Fatalf("Did not expect to receive an error, got %s", err)
+		case page := <-out:
+			if page.Body != expected {
+				t.Errorf("Expected %s to have the body %q, got %q", url, expected, page.Body)
+			}
+		}
+	}
+	if s := blocked.String(); s == "0" {
+		t.Errorf("Expected the blocked URL to be counted")
+	}
+}
+
+func TestRobotsProfiles(t *testing.T) {
+	profiles := []*Profile{
+		{Name: "cached", Reader: "googlecache", HTTP: &HttpOptions{Timeout: "1m"}},
+		{Name: "surf", Reader: "surf", webReader: mapReader{}},
+	}
+	if err := configureProfiles(profiles, HttpOptions{}); err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	robotsProfiles(profiles, "scraper")
+
+	// robots.txt comes from the site itself, rather than from Google's copy
+	reader := profiles[0].WebReader().(*RobotsReader)
+	if h, ok := reader.robots.(*HttpReader); !ok || h.client.Timeout != time.Minute {
+		t.Errorf("Expected robots.txt to be fetched with a http reader with the profile's options, got %#v", reader.robots)
+	}
+	reader = profiles[1].WebReader().(*RobotsReader)
+	if _, ok := reader.robots.(*HttpReader); !ok {
+		t.Errorf("Expected robots.txt to be fetched with a http reader, got %#v", reader.robots)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+// Router will build a pipeline for each of the profiles, and send each URL
+// (or RequestSpec) down the pipeline of the profile which matches its URL, or
+// which has the request it names. Everything which comes out of the pipelines
+// is merged into one
+func router(
+	in <-chan string,
+	errors chan<- error,
+	quit chan struct{},
+	profiles []*Profile,
+) chan Output {
+
+	out := make(chan Output)
+
+	inputs := make(map[*Profile]chan string, len(profiles))
+	for _, profile := range profiles {
+		input := make(chan string)
+		inputs[profile] = input
+
+		parsedContent := profile.pages(input, errors, quit)
+		printable := formatters[profile.Formatter](parsedContent, errors, quit, profile)
+
+		go func(name string) {
+			for {
+				select {
+				case <-quit:
+					return
+				case output := <-printable:
+					output.Profile = name
+					out <- output
+				}
+			}
+		}(profile.Name)
+	}
+
+	go func() {
+		for {
+			select {
+			case <-quit:
+				return
+			case input := <-in:
+				input, profile, err := routeInput(profiles, input)
+				if err != nil {
+					errors <- err
+					continue
+				}
+				inputs[profile] <- input
+			}
+		}
+	}()
+	return out
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/ganners/scraper/definition"
+)
+
+// The schema command prints the JSON Schema of what a profile prints, or of
+// the records of a definition or bundle, e.g.
+//
+//	scraper schema -profiles profiles.json sainsburys
+//	scraper schema -go -package products sainsburys-list.definition
+//
+// The schemas of every profile can be written to a directory, and checked
+// against it (in CI), which fails if they are out of date:
+//
+//	scraper schema -write schemas
+//	scraper schema -check schemas
+//
+// A schema which has changed can't be written unless the profile's
+// schemaVersion has been bumped
+func schemaCommand(args []string) error {
+	flags := flag.NewFlagSet("schema", flag.ContinueOnError)
+	profilesFile := flags.String("profiles", ProfilesFile, "the profiles to generate schemas for")
+	goTypes := flags.Bool("go", false, "print Go types rather than JSON Schema")
+	pkg := flags.String("package", "main", "the package of the Go types")
+	write := flags.String("write", "", "write the schema of every profile to this directory")
+	check := flags.String("check", "", "check the schemas in this directory are up to date")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	profiles, err := loadProfiles(*profilesFile)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case *write != "":
+		return writeSchemas(*write, profiles)
+	case *check != "":
+		return checkSchemas(*check, profiles)
+	case flags.NArg() != 1:
+		return fmt.Errorf("usage: scraper schema [-profiles profiles.json] [-go] [-package name] profile|file.definition|file.bundle\n       scraper schema [-profiles profiles.json] -write|-check dir")
+	}
+
+	name := flags.Arg(0)
+	s, err := namedSchema(profiles, name)
+	if err != nil {
+		return err
+	}
+
+	if *goTypes {
+		name = filepath.Base(name)
+		name = name[:len(name)-len(filepath.Ext(name))]
+		types, err := s.GoTypes(*pkg, name)
+		if err != nil {
+			return err
+		}
+		fmt.Print(types)
+		return nil
+	}
+
+	b, err := marshalSchema(s)
+	if err != nil {
+		return err
+	}
+	fmt.Print(string(b))
+	return nil
+}
+
+// Returns the schema of the profile with the name, or of the definition or
+// bundle file
+func namedSchema(profiles []*Profile, name string) (*definition.Schema, error) {
+	for _, p := range profiles {
+		if p.Name == name {
+			return profileSchema(p)
+		}
+	}
+
+	switch filepath.Ext(name) {
+	case definition.BundleExtension:
+		bundle, err := definition.NewBundle(name)
+		if err != nil {
+			return nil, err
+		}
+		return bundle.Schema(), nil
+	default:
+		if _, err := os.Stat(name); err != nil {
+			return nil, fmt.Errorf("%s is not a profile or a definition", name)
+		}
+		def, err := definition.NewDefinition(name)
+		if err != nil {
+			return nil, err
+		}
+		return definition.ListOf(def.RecordSchema()), nil
+	}
+}
+
+// Returns the schema of what the profile prints
+func profileSchema(p *Profile) (*definition.Schema, error) {
+	schemaOf, found := formatterSchemas[p.Formatter]
+	if !found {
+		return nil, fmt.Errorf("the %s formatter has no schema", p.Formatter)
+	}
+	s, err := schemaOf(p)
+	if err != nil {
+		return nil, fmt.Errorf("could not generate the schema of %s: %s", p.Name, err)
+	}
+	s.Draft = definition.SchemaDraft
+	s.Title = p.Name
+	s.Version = p.SchemaVersion
+	return s, nil
+}
+
+func marshalSchema(s *definition.Schema) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "    ")
+	if err := encoder.Encode(s); err != nil {
+		return nil, fmt.Errorf("could not marshal schema: %s", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// The file in dir which the schema of a profile is written to
+func schemaFile(dir string, p *Profile) string {
+	return filepath.Join(dir, p.Name+".schema.json")
+}
+
+// Reads the version of a schema which has been written
+func readSchemaVersion(file string) ([]byte, string, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, "", err
+	}
+	var s definition.Schema
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, "", fmt.Errorf("could not decode %s: %s", file, err)
+	}
+	return b, s.Version, nil
+}
+
+// Writes the schema of every profile to the directory, refusing to change a
+// schema without a new version
+func writeSchemas(dir string, profiles []*Profile) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("could not create %s: %s", dir, err)
+	}
+	for _, p := range profiles {
+		s, err := profileSchema(p)
+		if err != nil {
+			return err
+		}
+		b, err := marshalSchema(s)
+		if err != nil {
+			return err
+		}
+
+		file := schemaFile(dir, p)
+		old, version, err := readSchemaVersion(file)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err == nil && !bytes.Equal(old, b) && version == p.SchemaVersion {
+			return fmt.Errorf("the schema of %s has changed, bump its schemaVersion (%q) first", p.Name, version)
+		}
+		if err := ioutil.WriteFile(file, b, 0644); err != nil {
+			return fmt.Errorf("could not write %s: %s", file, err)
+		}
+	}
+	return nil
+}
+
+// Checks that the schema of every profile is the one in the directory
+func checkSchemas(dir string, profiles []*Profile) error {
+	for _, p := range profiles {
+		s, err := profileSchema(p)
+		if err != nil {
+			return err
+		}
+		b, err := marshalSchema(s)
+		if err != nil {
+			return err
+		}
+
+		file := schemaFile(dir, p)
+		old, version, err := readSchemaVersion(file)
+		switch {
+		case os.IsNotExist(err):
+			return fmt.Errorf("there is no schema for %s, run scraper schema -write %s", p.Name, dir)
+		case err != nil:
+			return err
+		case bytes.Equal(old, b):
+			continue
+		case version == p.SchemaVersion:
+			return fmt.Errorf("the schema of %s has changed without a new schemaVersion (still %q)", p.Name, version)
+		default:
+			return fmt.Errorf("the schema of %s is out of date, run scraper schema -write %s", p.Name, dir)
+		}
+	}
+	return nil
+}
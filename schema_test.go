@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The schemas of the example profiles have to be kept up to date, so that a
+// change to them can't go unnoticed
+func TestSchemasUpToDate(t *testing.T) {
+	profiles, err := LoadProfiles("profiles.example.json")
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	if err := checkSchemas("schemas", profiles); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWriteSchemas(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schemas")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range map[string]string{
+		"path.definition": "<path>{{path}}</path>",
+		"size.definition": "<path>{{path}}</path><size>{{size|pence}}</size>",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write %s: %s", name, err)
+		}
+	}
+
+	p := &Profile{
+		Name:          "paths",
+		Hosts:         []string{"*"},
+		Definitions:   map[string]string{PageDefinition: "path.definition"},
+		Formatter:     "json",
+		SchemaVersion: "1",
+	}
+	if err := p.init(dir); err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	profiles := []*Profile{p}
+
+	schemas := filepath.Join(dir, "schemas")
+	if err := checkSchemas(schemas, profiles); err == nil || !strings.Contains(err.Error(), "no schema") {
+		t.Errorf("Expected a missing schema to fail the check, got %v", err)
+	}
+	if err := writeSchemas(schemas, profiles); err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	if err := checkSchemas(schemas, profiles); err != nil {
+		t.Errorf("Did not expect to receive an error, got %s", err)
+	}
+
+	// Changing the definition changes the schema, which needs a new version
+	p.Definitions[PageDefinition] = filepath.Join(dir, "size.definition")
+	if err := checkSchemas(schemas, profiles); err == nil || !strings.Contains(err.Error(), "without a new schemaVersion") {
+		t.Errorf("Expected a changed schema to fail the check, got %v", err)
+	}
+	if err := writeSchemas(schemas, profiles); err == nil {
+		t.Errorf("Expected writing a changed schema without a new version to fail")
+	}
+
+	p.SchemaVersion = "2"
+	if err := checkSchemas(schemas, profiles); err == nil || !strings.Contains(err.Error(), "out of date") {
+		t.Errorf("Expected an out of date schema to fail the check, got %v", err)
+	}
+	if err := writeSchemas(schemas, profiles); err != nil {
+		t.Errorf("Did not expect to receive an error, got %s", err)
+	}
+	if err := checkSchemas(schemas, profiles); err != nil {
+		t.Errorf("Did not expect to receive an error, got %s", err)
+	}
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// Session is how a profile keeps a session with its site, for pages which
+// are only shown to those logged in or who have chosen a store
+type Session struct {
+	// A JSON file to keep the cookies in between runs, relative to the
+	// profiles file. Without one they are only kept for the run
+	Cookies string `json:"cookies"`
+
+	// How to log in, if the site needs it
+	Login *Login `json:"login"`
+}
+
+// Login is how to log in to a site: fetch the page with the form, fill in
+// the fields, submit it and check that the page it gives says so
+type Login struct {
+	// The page with the login form, and a CSS selector for the form on it
+	// ("form" if there is none, which is the first)
+	URL  string `json:"url"`
+	Form string `json:"form"`
+
+	// The fields to fill in, by name. $NAME is replaced by the environment
+	// variable, so that passwords don't have to be in the profiles file.
+	// The other fields of the form (such as hidden tokens) are sent as they
+	// are
+	Fields map[string]string `json:"fields"`
+
+	// Text on the page which submitting the form gives when logging in
+	// worked
+	Success string `json:"success"`
+
+	// Text on any page which means the session has expired, when there is
+	// any then it is logged in to again and the page fetched again. With
+	// this the session from the last run is tried before logging in
+	LoggedOut string `json:"loggedOut"`
+}
+
+// Checks the session and resolves the cookies file
+func (s *Session) init(dir string) error {
+	if s.Cookies != "" && !filepath.IsAbs(s.Cookies) {
+		s.Cookies = filepath.Join(dir, s.Cookies)
+	}
+	if s.Login != nil {
+		if s.Login.URL == "" {
+			return fmt.Errorf("has a login with no url")
+		}
+		if s.Login.Success == "" {
+			return fmt.Errorf("has a login with no success text to check for")
+		}
+	}
+	return nil
+}
+
+// CookieJar is a cookie jar which can be saved to a file and opened again,
+// so that a session lasts between runs
+type CookieJar struct {
+	file string
+	jar  *cookiejar.Jar
+
+	// Every cookie which has been set, by the site it was set for and then
+	// by its name, domain and path, as the jar can't list them
+	mu      sync.Mutex
+	cookies map[string]map[string]*http.Cookie
+
+	now func() time.Time
+}
+
+// OpenCookieJar returns a jar with the cookies saved in the file, if it
+// exists. An empty file keeps them in memory only
+func OpenCookieJar(file string) (*CookieJar, error) {
+	jar, _ := cookiejar.New(nil)
+	c := &CookieJar{
+		file:    file,
+		jar:     jar,
+		cookies: map[string]map[string]*http.Cookie{},
+		now:     time.Now,
+	}
+	if file == "" {
+		return c, nil
+	}
+
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read cookies: %s", err)
+	}
+	saved := map[string][]*http.Cookie{}
+	if err := json.Unmarshal(b, &saved); err != nil {
+		return nil, fmt.Errorf("could not decode cookies in %s: %s", file, err)
+	}
+	for site, cookies := range saved {
+		u, err := url.Parse(site)
+		if err != nil {
+			return nil, fmt.Errorf("invalid site %q in %s", site, file)
+		}
+		c.SetCookies(u, cookies)
+	}
+	return c, nil
+}
+
+// SetCookies keeps the cookies which the URL set
+func (c *CookieJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	c.jar.SetCookies(u, cookies)
+
+	site := u.Scheme + "://" + u.Host
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cookies[site] == nil {
+		c.cookies[site] = map[string]*http.Cookie{}
+	}
+	for _, cookie := range cookies {
+		saved := *cookie
+		// The max age is from now, which won't be when it is opened again
+		if saved.MaxAge > 0 {
+			saved.Expires = c.now().Add(time.Duration(saved.MaxAge) * time.Second)
+			saved.MaxAge = 0
+		}
+		key := saved.Name + ";" + saved.Domain + ";" + saved.Path
+		if saved.MaxAge < 0 || (!saved.Expires.IsZero() && saved.Expires.Before(c.now())) {
+			delete(c.cookies[site], key)
+			continue
+		}
+		c.cookies[site][key] = &saved
+	}
+}
+
+// Cookies returns the cookies to send to the URL
+func (c *CookieJar) Cookies(u *url.URL) []*http.Cookie {
+	return c.jar.Cookies(u)
+}
+
+// Save writes the cookies which haven't expired to the file
+func (c *CookieJar) Save() error {
+	if c.file == "" {
+		return nil
+	}
+
+	c.mu.Lock()
+	saved := map[string][]*http.Cookie{}
+	for site, cookies := range c.cookies {
+		for _, cookie := range cookies {
+			if cookie.Expires.IsZero() || cookie.Expires.After(c.now()) {
+				saved[site] = append(saved[site], cookie)
+			}
+		}
+	}
+	c.mu.Unlock()
+
+	b, err := json.MarshalIndent(saved, "", "    ")
+	if err != nil {
+		return fmt.Errorf("could not encode cookies: %s", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(c.file), 0755); err != nil {
+		return fmt.Errorf("could not create cookies directory: %s", err)
+	}
+	// Only the owner can read them, they are as good as the password
+	if err := ioutil.WriteFile(c.file, b, 0600); err != nil {
+		return fmt.Errorf("could not write cookies: %s", err)
+	}
+	return nil
+}
+
+// SessionReader is a WebReader which keeps cookies in a jar, and logs in
+// before the first fetch (and again whenever the session has expired). As a
+// profile has one reader, every worker for the site shares the session
+type SessionReader struct {
+	WebReader
+	jar   *CookieJar
+	login *Login
+
+	// What logs in, which can post the form
+	http WebReader
+
+	// How many times it has logged in, so that workers which find the
+	// session expired at the same time only log in again once
+	mu     sync.Mutex
+	logins int
+}
+
+// NewSessionReader returns a reader which fetches with webReader keeping the
+// cookies in jar, and logs in first if there is a login. The webReader has
+// to be able to keep cookies. Logging in is done with webReader if it is a
+// HttpReader, otherwise with httpReader
+func NewSessionReader(webReader WebReader, httpReader *HttpReader, jar *CookieJar, login *Login) (*SessionReader, error) {
+	cookieReader, ok := webReader.(CookieReader)
+	if !ok {
+		return nil, fmt.Errorf("the reader can't keep cookies")
+	}
+	s := &SessionReader{
+		WebReader: cookieReader.WithCookies(jar),
+		jar:       jar,
+		login:     login,
+	}
+	if h, ok := s.WebReader.(*HttpReader); ok {
+		s.http = h
+	} else {
+		s.http = httpReader.WithCookies(jar)
+	}
+
+	// The session from the last run is used until it turns out to have
+	// expired, which can only be told with the logged out text
+	if login != nil && login.LoggedOut != "" {
+		if u, err := url.Parse(login.URL); err == nil && len(jar.Cookies(u)) > 0 {
+			s.logins = 1
+		}
+	}
+	return s, nil
+}
+
+// Logs in, unless it has been since the caller saw it had logged in that
+// many times. Returns the number of times it has logged in
+func (s *SessionReader) logIn(seen int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.login == nil || s.logins != seen {
+		return s.logins, nil
+	}
+
+	page, err := getResponse(s.http, s.login.URL)
+	if err != nil {
+		return s.logins, fmt.Errorf("could not log in: %s", err)
+	}
+	if page.StatusCode >= 400 {
+		return s.logins, fmt.Errorf("could not log in, %s gave %d", s.login.URL, page.StatusCode)
+	}
+	action, values, err := fillForm(page, s.login)
+	if err != nil {
+		return s.logins, fmt.Errorf("could not log in: %s", err)
+	}
+	resp, err := doRequest(s.http, &Request{
+		Method: "POST",
+		URL:    action,
+		Header: http.Header{"Content-Type": {"application/x-www-form-urlencoded"}},
+		Body:   values.Encode(),
+	})
+	if err != nil {
+		return s.logins, fmt.Errorf("could not log in: %s", err)
+	}
+	if !strings.Contains(resp.Body, s.login.Success) {
+		return s.logins, fmt.Errorf("could not log in to %s, %q is not on the page it gave (%d)", action, s.login.Success, resp.StatusCode)
+	}
+
+	s.logins++
+	log.Printf("Logged in to %s", s.login.URL)
+	if err := s.jar.Save(); err != nil {
+		log.Printf("[Warning] %s", err)
+	}
+	return s.logins, nil
+}
+
+// Returns where the login form on the page is submitted to and the values
+// to submit, which are those already in the form with the fields filled in
+func fillForm(page *Response, login *Login) (string, url.Values, error) {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(page.Body))
+	if err != nil {
+		return "", nil, fmt.Errorf("could not parse %s: %s", page.URL, err)
+	}
+	selector := login.Form
+	if selector == "" {
+		selector = "form"
+	}
+	form := doc.Find(selector).First()
+	if form.Length() == 0 {
+		return "", nil, fmt.Errorf("no %s form on %s", selector, page.URL)
+	}
+
+	values := url.Values{}
+	form.Find("input[name], select[name], textarea[name]").Each(func(_ int, field *goquery.Selection) {
+		name, _ := field.Attr("name")
+		switch goquery.NodeName(field) {
+		case "textarea":
+			values.Add(name, field.Text())
+		case "select":
+			option := field.Find("option[selected]").First()
+			if option.Length() == 0 {
+				option = field.Find("option").First()
+			}
+			if option.Length() > 0 {
+				values.Add(name, option.AttrOr("value", option.Text()))
+			}
+		default:
+			switch strings.ToLower(field.AttrOr("type", "text")) {
+			case "submit", "button", "image", "reset", "file":
+			case "checkbox", "radio":
+				if _, checked := field.Attr("checked"); checked {
+					values.Add(name, field.AttrOr("value", "on"))
+				}
+			default:
+				values.Add(name, field.AttrOr("value", ""))
+			}
+		}
+	})
+	for name, value := range login.Fields {
+		values.Set(name, os.ExpandEnv(value))
+	}
+
+	return resolveURL(page.URL, form.AttrOr("action", "")), values, nil
+}
+
+// Do makes the request in the session, logging in first if it needs to
+func (s *SessionReader) Do(req *Request) (*Response, error) {
+	s.mu.Lock()
+	logins := s.logins
+	s.mu.Unlock()
+	if logins == 0 {
+		var err error
+		if logins, err = s.logIn(0); err != nil {
+			return nil, err
+		}
+	}
+
+	resp, err := doRequest(s.WebReader, req)
+	if err != nil || s.login == nil || s.login.LoggedOut == "" || !strings.Contains(resp.Body, s.login.LoggedOut) {
+		return resp, err
+	}
+
+	log.Printf("[Warning] The session has expired at %s, logging in again", req.URL)
+	if _, err := s.logIn(logins); err != nil {
+		return nil, err
+	}
+	return doRequest(s.WebReader, req)
+}
+
+// GetResponse fetches the page in the session
+func (s *SessionReader) GetResponse(url string) (*Response, error) {
+	return s.Do(&Request{URL: url})
+}
+
+// GetBody fetches the body of the page in the session
+func (s *SessionReader) GetBody(url string) (string, error) {
+	resp, err := s.Do(&Request{URL: url})
+	if err != nil {
+		return "", err
+	}
+	return resp.Body, nil
+}
+
+// GetStream opens the body of the page in the session, logging in first if it
+// needs to. When the session can expire the page has to be read in full, to
+// look for the logged out text
+func (s *SessionReader) GetStream(url string) (*Stream, error) {
+	if s.login != nil && s.login.LoggedOut != "" {
+		resp, err := s.Do(&Request{URL: url})
+		if err != nil {
+			return nil, err
+		}
+		return responseStream(resp)
+	}
+
+	s.mu.Lock()
+	logins := s.logins
+	s.mu.Unlock()
+	if logins == 0 {
+		if _, err := s.logIn(0); err != nil {
+			return nil, err
+		}
+	}
+	return getStream(s.WebReader, url)
+}
+
+// Streams when the other reader can, and the session can't expire
+func (s *SessionReader) streams(url string) bool {
+	if s.login != nil && s.login.LoggedOut != "" {
+		return false
+	}
+	return canStream(s.WebReader, url)
+}
+
+// Gives the profiles with a session a SessionReader, which logs in with the
+// profile's http options. Profiles with the same cookies file share a jar, as
+// do those without one. Returns the jars, which have to be saved after
+func sessionProfiles(profiles []*Profile) ([]*CookieJar, error) {
+	jars := map[string]*CookieJar{}
+	opened := []*CookieJar{}
+	for _, p := range profiles {
+		if p.Session == nil {
+			continue
+		}
+		jar, found := jars[p.Session.Cookies]
+		if !found {
+			var err error
+			if jar, err = OpenCookieJar(p.Session.Cookies); err != nil {
+				return nil, err
+			}
+			jars[p.Session.Cookies] = jar
+			opened = append(opened, jar)
+		}
+		reader, err := NewSessionReader(p.WebReader(), p.httpReader(), jar, p.Session.Login)
+		if err != nil {
+			return nil, fmt.Errorf("profile %s has a session, but %s", p.Name, err)
+		}
+		p.webReader = reader
+	}
+	return opened, nil
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A site which shows prices to those logged in
+type loginSite struct {
+	mu       sync.Mutex
+	logins   int
+	sessions map[string]bool
+}
+
+func (s *loginSite) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			w.Write([]byte(`<html><body>
+				<form id="search" action="/search"><input name="q"></form>
+				<form id="login" method="post" action="/login">
+					<input type="hidden" name="token" value="t0k3n">
+					<input name="username">
+					<input type="password" name="password">
+					<select name="store"><option value="1">Holborn</option><option value="2" selected>Camden</option></select>
+					<input type="checkbox" name="remember" checked>
+					<input type="submit" name="go" value="Sign in">
+				</form>
+			</body></html>`))
+			return
+		}
+		r.ParseForm()
+		if r.Form.Get("token") != "t0k3n" || r.Form.Get("username") != "mark" || r.Form.Get("password") != "secret" ||
+			r.Form.Get("store") != "2" || r.Form.Get("remember") != "on" || r.Form.Get("go") != "" {
+			w.Write([]byte("Wrong username or password"))
+			return
+		}
+		s.mu.Lock()
+		s.logins++
+		id := fmt.Sprintf("session-%d", s.logins)
+		s.sessions[id] = true
+		s.mu.Unlock()
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: id, Path: "/", MaxAge: 3600})
+		http.Redirect(w, r, "/account", http.StatusSeeOther)
+	})
+	mux.HandleFunc("/account", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello mark, Sign out"))
+	})
+	mux.HandleFunc("/prices", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if cookie, err := r.Cookie("session"); err == nil && s.sessions[cookie.Value] {
+			w.Write([]byte("<path>member-price.jpg</path>"))
+			return
+		}
+		w.Write([]byte("Sign in to see prices"))
+	})
+	return mux
+}
+
+func TestSessionReader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "session")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	site := &loginSite{sessions: map[string]bool{}}
+	server := httptest.NewServer(site.handler())
+	defer server.Close()
+
+	os.Setenv("SCRAPER_TEST_PASSWORD", "secret")
+	defer os.Unsetenv("SCRAPER_TEST_PASSWORD")
+	login := &Login{
+		URL:       server.URL + "/login",
+		Form:      "#login",
+		Fields:    map[string]string{"username": "mark", "password": "$SCRAPER_TEST_PASSWORD"},
+		Success:   "Sign out",
+		LoggedOut: "Sign in to see prices",
+	}
+	cookies := filepath.Join(dir, "cookies", "site.json")
+	jar, err := OpenCookieJar(cookies)
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	reader, err := NewSessionReader(NewHttpReader(), NewHttpReader(), jar, login)
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+
+	// Every worker shares the one session
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if body, err := reader.GetBody(server.URL + "/prices"); err != nil || body != "<path>member-price.jpg</path>" {
+				t.Errorf("Expected the prices for members, got %q (%v)", body, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if site.logins != 1 {
+		t.Errorf("Expected to log in once, got %d", site.logins)
+	}
+
+	// The next run carries on with the saved session
+	jar, err = OpenCookieJar(cookies)
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	reader, err = NewSessionReader(NewHttpReader(), NewHttpReader(), jar, login)
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	if body, err := reader.GetBody(server.URL + "/prices"); err != nil || body != "<path>member-price.jpg</path>" {
+		t.Errorf("Expected the prices with the saved session, got %q (%v)", body, err)
+	}
+	if site.logins != 1 {
+		t.Errorf("Expected the saved session to be used, got %d logins", site.logins)
+	}
+
+	// Until it expires
+	site.mu.Lock()
+	site.sessions = map[string]bool{}
+	site.mu.Unlock()
+	if body, err := reader.GetBody(server.URL + "/prices"); err != nil || body != "<path>member-price.jpg</path>" {
+		t.Errorf("Expected the prices after logging in again, got %q (%v)", body, err)
+	}
+	if site.logins != 2 {
+		t.Errorf("Expected to log in again, got %d logins", site.logins)
+	}
+
+	// Wrong details are an error
+	jar, _ = OpenCookieJar("")
+	login.Fields["password"] = "wrong"
+	reader, _ = NewSessionReader(NewHttpReader(), NewHttpReader(), jar, login)
+	if _, err := reader.GetBody(server.URL + "/prices"); err == nil {
+		t.Errorf("Expected an error logging in with the wrong password")
+	}
+}
+
+func TestCookieJar(t *testing.T) {
+	dir, err := ioutil.TempDir("", "session")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "cookies.json")
+	jar, err := OpenCookieJar(file)
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	site, _ := http.NewRequest("GET", "http://shop.example.com/", nil)
+	jar.SetCookies(site.URL, []*http.Cookie{
+		{Name: "store", Value: "camden", Path: "/"},
+		{Name: "basket", Value: "1", Path: "/", MaxAge: 60},
+		{Name: "old", Value: "1", Path: "/", MaxAge: -1},
+	})
+	jar.SetCookies(site.URL, []*http.Cookie{{Name: "basket", Value: "2", Path: "/", MaxAge: 60}})
+	if err := jar.Save(); err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+
+	jar, err = OpenCookieJar(file)
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	got := map[string]string{}
+	for _, cookie := range jar.Cookies(site.URL) {
+		got[cookie.Name] = cookie.Value
+	}
+	if len(got) != 2 || got["store"] != "camden" || got["basket"] != "2" {
+		t.Errorf("Expected the cookies to be opened again, got %v", got)
+	}
+}
+
+func TestSessionProfiles(t *testing.T) {
+	profiles := []*Profile{
+		{Name: "shop", Session: &Session{}},
+		{Name: "shop-search", Session: &Session{}},
+		{Name: "other"},
+	}
+	jars, err := sessionProfiles(profiles)
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	if len(jars) != 1 {
+		t.Errorf("Expected the profiles to share a jar, got %d", len(jars))
+	}
+	if _, ok := profiles[0].WebReader().(*SessionReader); !ok {
+		t.Errorf("Expected the profile with a session to get a session reader")
+	}
+	if _, ok := profiles[2].WebReader().(*SessionReader); ok {
+		t.Errorf("Expected the profile without a session to keep its reader")
+	}
+
+	// Logging in is done with the profile's http options, not through the
+	// google cache
+	profiles = []*Profile{{Name: "cached", Reader: "googlecache", Session: &Session{}, HTTP: &HttpOptions{Timeout: "1m"}}}
+	if err := configureProfiles(profiles, HttpOptions{}); err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	if _, err := sessionProfiles(profiles); err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	if h, ok := profiles[0].WebReader().(*SessionReader).http.(*HttpReader); !ok || h.client.Timeout != time.Minute {
+		t.Errorf("Expected to log in with a http reader with the profile's options, got %#v", profiles[0].WebReader().(*SessionReader).http)
+	}
+
+	profiles = []*Profile{{Name: "saved", Session: &Session{}, webReader: NewFileReader(nil)}}
+	if _, err := sessionProfiles(profiles); err == nil {
+		t.Errorf("Expected an error for a session with a reader which can't keep cookies")
+	}
+}
+
+func TestSessionLoginLimited(t *testing.T) {
+	site := &loginSite{sessions: map[string]bool{}}
+	server := httptest.NewServer(site.handler())
+	defer server.Close()
+
+	profiles := []*Profile{{
+		Name: "shop",
+		Session: &Session{Login: &Login{
+			URL:     server.URL + "/login",
+			Form:    "#login",
+			Fields:  map[string]string{"username": "mark", "password": "secret"},
+			Success: "Sign out",
+		}},
+		Limits: HostLimits{Concurrency: 1, CrawlDelay: "1s"},
+	}}
+	if err := profiles[0].Limits.init(); err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	if _, err := sessionProfiles(profiles); err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	limitProfiles(profiles, HostLimits{})
+
+	// Logging in takes turns with the fetch it is done for
+	var waits []time.Duration
+	now := time.Now()
+	limited := profiles[0].WebReader().(*LimitedReader)
+	login := limited.WebReader.(*SessionReader).http.(*LimitedReader)
+	for _, l := range []*LimitedReader{limited, login} {
+		l.now = func() time.Time { return now }
+		l.sleep = func(d time.Duration) { waits = append(waits, d) }
+	}
+	if body, err := limited.GetBody(server.URL + "/prices"); err != nil || body != "<path>member-price.jpg</path>" {
+		t.Errorf("Expected the prices for members, got %q (%v)", body, err)
+	}
+	if len(waits) != 2 || waits[0] != time.Second || waits[1] != 2*time.Second {
+		t.Errorf("Expected the login page and form to wait for the crawl delay, got %v", waits)
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// A Sink is somewhere output is written to, in some format
+type Sink interface {
+	Write(output Output) error
+	Close() error
+}
+
+// The options of sinks, from flags
+type sinkOptions struct {
+	// The columns of csv and tsv sinks
+	Columns []string
+
+	// The field which identifies a record, for storage sinks
+	Identity string
+}
+
+// The sinks which can be named with -sink, by format
+var sinkFormats = map[string]func(w io.Writer, options sinkOptions) Sink{
+	// The whole output for a page on one line, as it always has been
+	"json": func(w io.Writer, options sinkOptions) Sink { return &jsonSink{w: w} },
+
+	// The whole output for a page, indented
+	"pretty": func(w io.Writer, options sinkOptions) Sink { return &jsonSink{w: w, indent: "    "} },
+
+	// A line for each record
+	"ndjson": func(w io.Writer, options sinkOptions) Sink { return &ndjsonSink{w: w} },
+
+	// A row for each record, under a header of the columns
+	"csv": func(w io.Writer, options sinkOptions) Sink { return newCSVSink(w, ',', options.Columns) },
+	"tsv": func(w io.Writer, options sinkOptions) Sink { return newCSVSink(w, '\t', options.Columns) },
+}
+
+// The sinks which store records in a file of their own, rather than writing
+// to one
+var storageFormats = map[string]func(file string, options sinkOptions) (Sink, error){
+	"sqlite": openSQLiteSink,
+}
+
+// A flag which can be given more than once, such as -sink
+type listFlag []string
+
+func (s *listFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *listFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// Adds the -sink and -columns flags to a flag set. The function returned
+// opens the sinks once the flags have been parsed
+func sinkFlags(flags *flag.FlagSet) func() (Sink, error) {
+	specs := &listFlag{}
+	flags.Var(specs, "sink", "where to write output as format[:file], where the format is "+
+		"json, pretty, ndjson, csv, tsv or sqlite and the file defaults to stdout. Can be given more than once")
+	columns := flags.String("columns", "", "the columns of csv and tsv sinks, in order, e.g. productName,pricePerUnit")
+	identity := flags.String("identity", "productPath", "the field which identifies a record, for sqlite sinks")
+
+	return func() (Sink, error) {
+		if len(*specs) == 0 {
+			*specs = listFlag{"json"}
+		}
+		options := sinkOptions{
+			Identity: *identity,
+		}
+		if *columns != "" {
+			options.Columns = strings.Split(*columns, ",")
+		}
+		return openSinks(*specs, options)
+	}
+}
+
+// Opens a sink for each of the specs (format[:file]) which writes to all of
+// them
+func openSinks(specs []string, options sinkOptions) (Sink, error) {
+	sinks := make(multiSink, 0, len(specs))
+	for _, spec := range specs {
+		format, file := spec, ""
+		if i := strings.Index(spec, ":"); i >= 0 {
+			format, file = spec[:i], spec[i+1:]
+		}
+
+		if openStorage, found := storageFormats[format]; found {
+			if file == "" {
+				sinks.Close()
+				return nil, fmt.Errorf("the %s sink needs a file", format)
+			}
+			sink, err := openStorage(file, options)
+			if err != nil {
+				sinks.Close()
+				return nil, err
+			}
+			sinks = append(sinks, sink)
+			continue
+		}
+
+		newSink, found := sinkFormats[format]
+		if !found {
+			sinks.Close()
+			return nil, fmt.Errorf("unknown sink format %q", format)
+		}
+
+		if file == "" || file == "-" {
+			sinks = append(sinks, newSink(os.Stdout, options))
+			continue
+		}
+		f, err := os.Create(file)
+		if err != nil {
+			sinks.Close()
+			return nil, fmt.Errorf("could not create %s: %s", file, err)
+		}
+		sinks = append(sinks, &fileSink{
+			Sink: newSink(f, options),
+			f:    f,
+		})
+	}
+	return sinks, nil
+}
+
+// Writes to each of the sinks
+type multiSink []Sink
+
+func (m multiSink) Write(output Output) error {
+	for _, s := range m {
+		if err := s.Write(output); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m multiSink) Close() error {
+	var first error
+	for _, s := range m {
+		if err := s.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// A sink which writes to a file, closing it along with the sink
+type fileSink struct {
+	Sink
+	f *os.File
+}
+
+func (s *fileSink) Close() error {
+	if err := s.Sink.Close(); err != nil {
+		s.f.Close()
+		return err
+	}
+	return s.f.Close()
+}
+
+type jsonSink struct {
+	w      io.Writer
+	indent string
+}
+
+func (s *jsonSink) Write(output Output) error {
+	var b []byte
+	var err error
+	if s.indent != "" {
+		b, err = json.MarshalIndent(output.Value, "", s.indent)
+	} else {
+		b, err = json.Marshal(output.Value)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to marshal %s into json: %s", output.URL, err)
+	}
+	_, err = fmt.Fprintln(s.w, string(b))
+	return err
+}
+
+func (s *jsonSink) Close() error {
+	return nil
+}
+
+type ndjsonSink struct {
+	w io.Writer
+}
+
+// Writes each record on its own line, or the whole output when it has no
+// records (as with bundles)
+func (s *ndjsonSink) Write(output Output) error {
+	bw := bufio.NewWriter(s.w)
+	encoder := json.NewEncoder(bw)
+	if output.Records == nil {
+		if err := encoder.Encode(output.Value); err != nil {
+			return fmt.Errorf("unable to marshal %s into json: %s", output.URL, err)
+		}
+	}
+	for _, record := range output.Records {
+		if err := encoder.Encode(record); err != nil {
+			return fmt.Errorf("unable to marshal %s into json: %s", output.URL, err)
+		}
+	}
+	return bw.Flush()
+}
+
+func (s *ndjsonSink) Close() error {
+	return nil
+}
+
+type csvSink struct {
+	w       *csv.Writer
+	columns []string
+	header  bool
+}
+
+func newCSVSink(w io.Writer, comma rune, columns []string) *csvSink {
+	cw := csv.NewWriter(w)
+	cw.Comma = comma
+	return &csvSink{
+		w:       cw,
+		columns: columns,
+	}
+}
+
+// Writes a row for each record. Without columns they are the fields of the
+// first record, in alphabetical order. Values which aren't strings or
+// numbers are written as JSON
+func (s *csvSink) Write(output Output) error {
+	if len(output.Records) == 0 {
+		return nil
+	}
+
+	if !s.header {
+		if s.columns == nil {
+			for field := range output.Records[0] {
+				s.columns = append(s.columns, field)
+			}
+			sort.Strings(s.columns)
+		}
+		if err := s.w.Write(s.columns); err != nil {
+			return err
+		}
+		s.header = true
+	}
+
+	row := make([]string, len(s.columns))
+	for _, record := range output.Records {
+		for i, column := range s.columns {
+			switch v := record[column].(type) {
+			case nil:
+				row[i] = ""
+			case string:
+				row[i] = v
+			case int, float64, bool:
+				row[i] = fmt.Sprint(v)
+			default:
+				b, err := json.Marshal(v)
+				if err != nil {
+					return fmt.Errorf("unable to marshal %s of %s into json: %s", column, output.URL, err)
+				}
+				row[i] = string(b)
+			}
+		}
+		if err := s.w.Write(row); err != nil {
+			return err
+		}
+	}
+	s.w.Flush()
+	return s.w.Error()
+}
+
+func (s *csvSink) Close() error {
+	s.w.Flush()
+	return s.w.Error()
+}
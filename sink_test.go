@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSinks(t *testing.T) {
+	outputs := []Output{
+		{
+			URL: "http://example.com/1",
+			Value: map[string]interface{}{
+				"products": []map[string]interface{}{
+					{"name": "Apricot", "price": 350},
+					{"name": "Kiwi, Gold", "price": 175, "tags": []string{"new"}},
+				},
+			},
+			Records: []map[string]interface{}{
+				{"name": "Apricot", "price": 350},
+				{"name": "Kiwi, Gold", "price": 175, "tags": []string{"new"}},
+			},
+		},
+		{
+			URL:     "http://example.com/2",
+			Value:   map[string]interface{}{"total": 2},
+			Records: nil,
+		},
+	}
+
+	for _, test := range []struct {
+		format   string
+		columns  []string
+		expected string
+	}{
+		{
+			format: "json",
+			expected: `{"products":[{"name":"Apricot","price":350},{"name":"Kiwi, Gold","price":175,"tags":["new"]}]}` + "\n" +
+				`{"total":2}` + "\n",
+		},
+		{
+			format:   "pretty",
+			expected: "{\n    \"products\": [\n        {\n            \"name\": \"Apricot\",\n            \"price\": 350\n        },\n        {\n            \"name\": \"Kiwi, Gold\",\n            \"price\": 175,\n            \"tags\": [\n                \"new\"\n            ]\n        }\n    ]\n}\n{\n    \"total\": 2\n}\n",
+		},
+		{
+			format: "ndjson",
+			expected: `{"name":"Apricot","price":350}` + "\n" +
+				`{"name":"Kiwi, Gold","price":175,"tags":["new"]}` + "\n" +
+				`{"total":2}` + "\n",
+		},
+		{
+			format:   "csv",
+			columns:  []string{"price", "name", "tags"},
+			expected: "price,name,tags\n350,Apricot,\n175,\"Kiwi, Gold\",\"[\"\"new\"\"]\"\n",
+		},
+		{
+			format:   "tsv",
+			expected: "name\tprice\nApricot\t350\nKiwi, Gold\t175\n",
+		},
+	} {
+		var buf bytes.Buffer
+		sink := sinkFormats[test.format](&buf, sinkOptions{Columns: test.columns})
+		for _, output := range outputs {
+			if err := sink.Write(output); err != nil {
+				t.Fatalf("Did not expect to receive an error, got %s", err)
+			}
+		}
+		if err := sink.Close(); err != nil {
+			t.Fatalf("Did not expect to receive an error, got %s", err)
+		}
+		if buf.String() != test.expected {
+			t.Errorf("Expected %s to write %q, got %q", test.format, test.expected, buf.String())
+		}
+	}
+}
+
+func TestOpenSinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sinks")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := openSinks([]string{"xml"}, sinkOptions{}); err == nil {
+		t.Errorf("Expected an unknown format to fail")
+	}
+
+	sink, err := openSinks([]string{
+		"ndjson:" + filepath.Join(dir, "out.ndjson"),
+		"csv:" + filepath.Join(dir, "out.csv"),
+	}, sinkOptions{Columns: []string{"name"}})
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	output := Output{
+		Records: []map[string]interface{}{{"name": "Apricot"}},
+	}
+	if err := sink.Write(output); err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+
+	for file, expected := range map[string]string{
+		"out.ndjson": `{"name":"Apricot"}` + "\n",
+		"out.csv":    "name\nApricot\n",
+	} {
+		b, err := ioutil.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			t.Fatalf("failed to read %s: %s", file, err)
+		}
+		if string(b) != expected {
+			t.Errorf("Expected %s to be %q, got %q", file, expected, b)
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// The columns which the sqlite sink adds to every record, prefixed like
+// _provenance so they don't clash with variables
+const (
+	runIDColumn     = "_run_id"
+	urlColumn       = "_url"
+	firstSeenColumn = "_first_seen"
+	scrapedAtColumn = "_scraped_at"
+)
+
+// The sqliteSink stores records in a SQLite database, with a table for each
+// profile. The columns are the fields of the records, and are added as new
+// fields turn up
+//
+// Each table holds the latest of each record, keyed on the identity field,
+// and <table>_runs holds every run's copy of it keyed on the run too. Runs are
+// listed in the runs table:
+//
+//	SELECT * FROM sainsburys_runs WHERE _run_id = (SELECT max(id) FROM runs)
+type sqliteSink struct {
+	db       *sql.DB
+	identity string
+	runID    string
+
+	// The columns of each table which exist
+	columns map[string]map[string]bool
+}
+
+// Opens the database, creating it if needed, and starts a run
+func openSQLiteSink(file string, options sinkOptions) (Sink, error) {
+	if options.Identity == "" {
+		return nil, fmt.Errorf("the sqlite sink needs an identity field")
+	}
+
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		return nil, fmt.Errorf("could not open %s: %s", file, err)
+	}
+
+	s := &sqliteSink{
+		db:       db,
+		identity: options.Identity,
+		runID:    newRunID(time.Now()),
+		columns:  make(map[string]map[string]bool),
+	}
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS runs (
+		id TEXT PRIMARY KEY,
+		started_at TEXT NOT NULL,
+		finished_at TEXT
+	)`); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not create the runs table: %s", err)
+	}
+	if _, err := db.Exec(`INSERT INTO runs (id, started_at) VALUES (?, ?)`, s.runID, timestamp(time.Now())); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not start a run: %s", err)
+	}
+	return s, nil
+}
+
+// Run IDs sort in the order they were started
+func newRunID(now time.Time) string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return now.UTC().Format("20060102T150405.000000Z") + "-" + hex.EncodeToString(b)
+}
+
+// Timestamps are RFC 3339 in UTC with a fixed number of decimals, so they sort
+func timestamp(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000000Z07:00")
+}
+
+// Upserts each of the records, in one transaction for the page
+func (s *sqliteSink) Write(output Output) error {
+	if len(output.Records) == 0 {
+		return nil
+	}
+	table := tableName(output.Profile)
+	if err := s.ensureColumns(table, output.Records); err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("could not start a transaction: %s", err)
+	}
+	now := timestamp(time.Now())
+	for _, record := range output.Records {
+		id, found := record[s.identity]
+		if !found || id == nil {
+			log.Printf("[Warning] A record from %s has no %s, it isn't stored", output.URL, s.identity)
+			continue
+		}
+
+		fields := make([]string, 0, len(record))
+		for field := range record {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+
+		columns := []string{runIDColumn, urlColumn, scrapedAtColumn}
+		values := []interface{}{s.runID, output.URL, now}
+		for _, field := range fields {
+			columns = append(columns, field)
+			values = append(values, columnValue(record[field]))
+		}
+
+		// The latest copy keeps when it was first seen
+		latest := append(columns, firstSeenColumn)
+		if _, err := tx.Exec(upsert(table, latest, []string{s.identity}, firstSeenColumn), append(values, now)...); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("could not store a record from %s: %s", output.URL, err)
+		}
+		if _, err := tx.Exec(upsert(table+"_runs", columns, []string{runIDColumn, s.identity}), values...); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("could not store a record from %s: %s", output.URL, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("could not store the records from %s: %s", output.URL, err)
+	}
+	return nil
+}
+
+// Finishes the run
+func (s *sqliteSink) Close() error {
+	_, err := s.db.Exec(`UPDATE runs SET finished_at = ? WHERE id = ?`, timestamp(time.Now()), s.runID)
+	if closeErr := s.db.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("could not finish the run: %s", err)
+	}
+	return nil
+}
+
+// Creates the tables, and adds any columns which the records have that the
+// tables don't
+func (s *sqliteSink) ensureColumns(table string, records []map[string]interface{}) error {
+	if _, found := s.columns[table]; !found {
+		for _, t := range []struct {
+			name    string
+			columns []string
+			key     []string
+		}{
+			{table, []string{quoteIdentifier(firstSeenColumn) + " TEXT"}, []string{s.identity}},
+			{table + "_runs", nil, []string{runIDColumn, s.identity}},
+		} {
+			columns := []string{
+				quoteIdentifier(runIDColumn) + " TEXT NOT NULL",
+				quoteIdentifier(urlColumn) + " TEXT",
+				quoteIdentifier(scrapedAtColumn) + " TEXT NOT NULL",
+				quoteIdentifier(s.identity),
+			}
+			columns = append(columns, t.columns...)
+			create := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s, PRIMARY KEY (%s))",
+				quoteIdentifier(t.name),
+				strings.Join(columns, ", "),
+				quoteIdentifiers(t.key),
+			)
+			if _, err := s.db.Exec(create); err != nil {
+				return fmt.Errorf("could not create table %s: %s", t.name, err)
+			}
+		}
+
+		rows, err := s.db.Query(fmt.Sprintf("SELECT name FROM pragma_table_info('%s')", table))
+		if err != nil {
+			return fmt.Errorf("could not read the columns of %s: %s", table, err)
+		}
+		defer rows.Close()
+		existing := make(map[string]bool)
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				return fmt.Errorf("could not read the columns of %s: %s", table, err)
+			}
+			existing[name] = true
+		}
+		s.columns[table] = existing
+	}
+
+	existing := s.columns[table]
+	for _, record := range records {
+		for field, value := range record {
+			if existing[field] {
+				continue
+			}
+			for _, t := range []string{table, table + "_runs"} {
+				alter := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", quoteIdentifier(t), quoteIdentifier(field), columnType(value))
+				if _, err := s.db.Exec(alter); err != nil && !strings.Contains(err.Error(), "duplicate column") {
+					return fmt.Errorf("could not add %s to %s: %s", field, t, err)
+				}
+			}
+			existing[field] = true
+		}
+	}
+	return nil
+}
+
+// An INSERT which updates every column but those kept when the key exists
+func upsert(table string, columns, key []string, keep ...string) string {
+	quoted := make([]string, len(columns))
+	placeholders := make([]string, len(columns))
+	updates := make([]string, 0, len(columns))
+	for i, column := range columns {
+		quoted[i] = quoteIdentifier(column)
+		placeholders[i] = "?"
+		if !containsString(key, column) && !containsString(keep, column) {
+			updates = append(updates, fmt.Sprintf("%s = excluded.%s", quoted[i], quoted[i]))
+		}
+	}
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) ON CONFLICT (%s) DO UPDATE SET %s",
+		quoteIdentifier(table),
+		strings.Join(quoted, ", "),
+		strings.Join(placeholders, ", "),
+		quoteIdentifiers(key),
+		strings.Join(updates, ", "),
+	)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// The type of the column for a value, anything which isn't a number is text
+func columnType(v interface{}) string {
+	switch v.(type) {
+	case int:
+		return "INTEGER"
+	case float64:
+		return "REAL"
+	}
+	return "TEXT"
+}
+
+// The value to store, values which aren't numbers or strings are stored as
+// JSON
+func columnValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case nil, int, float64, string:
+		return v
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
+
+// The table for a profile's records, which is its name with anything other
+// than letters, digits and underscores replaced
+func tableName(profile string) string {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, profile)
+	if name == "" || name == "runs" {
+		name = "records_" + name
+	}
+	return name
+}
+
+func quoteIdentifier(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+func quoteIdentifiers(names []string) string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = quoteIdentifier(name)
+	}
+	return strings.Join(quoted, ", ")
+}
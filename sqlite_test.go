@@ -0,0 +1,79 @@
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSQLiteSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlite")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "scrapes.db")
+
+	for _, outputs := range [][]Output{
+		{
+			{
+				URL:     "http://example.com/fruit",
+				Profile: "sainsburys-test",
+				Records: []map[string]interface{}{
+					{"productPath": "/apricot", "productName": "Apricot", "pricePerUnit": 350},
+					{"productPath": "/kiwi", "productName": "Kiwi", "pricePerUnit": 175},
+				},
+			},
+		},
+		{
+			{
+				URL:     "http://example.com/fruit",
+				Profile: "sainsburys-test",
+				Records: []map[string]interface{}{
+					// A new price, and a new field
+					{"productPath": "/apricot", "productName": "Apricot", "pricePerUnit": 300, "size": 1.5},
+					// No identity
+					{"productName": "Mystery"},
+				},
+			},
+		},
+	} {
+		sink, err := openSinks([]string{"sqlite:" + file}, sinkOptions{Identity: "productPath"})
+		if err != nil {
+			t.Fatalf("Did not expect to receive an error, got %s", err)
+		}
+		for _, output := range outputs {
+			if err := sink.Write(output); err != nil {
+				t.Fatalf("Did not expect to receive an error, got %s", err)
+			}
+		}
+		if err := sink.Close(); err != nil {
+			t.Fatalf("Did not expect to receive an error, got %s", err)
+		}
+	}
+
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	defer db.Close()
+
+	for query, expected := range map[string]int{
+		`SELECT count(*) FROM runs WHERE finished_at IS NOT NULL`:                 2,
+		`SELECT count(*) FROM sainsburys_test`:                                    2,
+		`SELECT count(*) FROM sainsburys_test_runs`:                               3,
+		`SELECT pricePerUnit FROM sainsburys_test WHERE productPath = '/apricot'`: 300,
+		`SELECT count(*) FROM sainsburys_test l JOIN sainsburys_test_runs r ON r.productPath = l.productPath AND r._run_id = (SELECT min(id) FROM runs) WHERE l._first_seen = r._scraped_at`: 2,
+		`SELECT pricePerUnit FROM sainsburys_test_runs WHERE productPath = '/apricot' AND _run_id = (SELECT min(id) FROM runs)`:                                                              350,
+		`SELECT count(*) FROM sainsburys_test_runs WHERE size IS NOT NULL`:                                                                                                                   1,
+	} {
+		var n int
+		if err := db.QueryRow(query).Scan(&n); err != nil {
+			t.Errorf("Did not expect %s to fail, got %s", query, err)
+		} else if n != expected {
+			t.Errorf("Expected %s to be %d, got %d", query, expected, n)
+		}
+	}
+}
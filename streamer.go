@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/ganners/scraper/definition"
+)
+
+// Streamer is the getter and parser in one, for pages which are too large to
+// hold in memory. The body is parsed as it is read rather than once it has all
+// been, so the body itself is never held (unless a reader keeps it, such as
+// the cache). The records are still gathered until the end of the page, which
+// is sent on as one Parsed like any other
+//
+// If the webReader can't stream a page then its body is read in full as the
+// getter would, which is warned about
+func streamer(
+	webReader WebReader,
+	in <-chan string,
+	errors chan<- error,
+	quit chan struct{},
+	definitionFile string,
+	provenance bool,
+) chan Parsed {
+
+	def, err := definition.NewDefinition(definitionFile)
+	if err != nil {
+		log.Fatalf("failed to read definition: %s", err)
+	}
+
+	out := make(chan Parsed)
+	var warnOnce sync.Once
+
+	for i := 0; i < NumGetterWorkers; i++ {
+		go func() {
+			for {
+				select {
+				case <-quit:
+					return
+				case input := <-in:
+					req, err := ParseRequest(input)
+					if err != nil {
+						errors <- err
+						continue
+					}
+					p := Parsed{
+						URL:    req.URL,
+						Fields: make([]map[string]interface{}, 0, 10),
+					}
+					if !streamable(webReader, req) {
+						warnOnce.Do(func() {
+							log.Printf("[Warning] The reader can't stream %s, so it and pages like it are read in full", req.URL)
+						})
+					}
+					stream, err := openStream(webReader, req)
+
+					// A page which robots.txt blocks is skipped rather
+					// than failing the run, it is parsed as empty
+					if blockedErr, ok := blockedError(err); ok {
+						blocked.add(blockedErr)
+						out <- p
+						continue
+					}
+					if err != nil {
+						errors <- fmt.Errorf("could not read url: %s", err)
+						out <- p
+						continue
+					}
+
+					counted := &countingReader{r: stream}
+					emit := func(fields map[string]interface{}) error {
+						p.Fields = append(p.Fields, fields)
+						return nil
+					}
+					if provenance {
+						err = def.ParseReaderWithProvenance(counted, req.URL, emit)
+					} else {
+						err = def.ParseReader(counted, emit)
+					}
+					stream.Close()
+					if err != nil {
+						errors <- fmt.Errorf("could not stream url: %s", err)
+					}
+					if counted.n == 0 {
+						errors <- fmt.Errorf("Body was empty")
+					}
+
+					p.Size = counted.n
+					p.Fields, p.Rejected = finish(def, req.URL, p.Fields)
+					rejections.add(p.URL, p.Rejected)
+					out <- p
+				}
+			}
+		}()
+	}
+	return out
+}
+
+// Returns whether the webReader can stream the page for a request, which is
+// a GET with nothing of its own
+func streamable(webReader WebReader, req *Request) bool {
+	_, ok := webReader.(StreamReader)
+	return ok && req.plain() && len(req.Header) == 0 && canStream(webReader, req.URL)
+}
+
+// Opens the body of the page for a request with the webReader, streaming it
+// if possible
+func openStream(webReader WebReader, req *Request) (io.ReadCloser, error) {
+	if streamable(webReader, req) {
+		stream, err := webReader.(StreamReader).GetStream(req.URL)
+		if err != nil {
+			return nil, err
+		}
+		return stream, nil
+	}
+	body, err := getBody(webReader, req)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(strings.NewReader(body)), nil
+}
+
+// Counts the bytes read through it, for the size of a streamed page
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
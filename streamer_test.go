@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// A WebReader which serves bodies from a map
+type mapReader map[string]string
+
+func (m mapReader) GetBody(url string) (string, error) {
+	body, found := m[url]
+	if !found {
+		return "", fmt.Errorf("no body for %s", url)
+	}
+	return body, nil
+}
+
+func TestStreamer(t *testing.T) {
+	content := []byte("<path>{{path}}</path>")
+	tmpfile, err := ioutil.TempFile("", "foo.definition")
+	if err != nil {
+		t.Fatalf("failed to create tmp file: %s", err)
+	}
+	if _, err := tmpfile.Write(content); err != nil {
+		t.Fatalf("failed to write content: %s", err)
+	}
+	defer tmpfile.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<path>foo.jpg</path><!-- --><path>bar.jpg</path> EOF"))
+	}))
+	defer server.Close()
+
+	// Readers which stream and those which can't both give every record
+	for _, webReader := range []WebReader{
+		NewHttpReader(),
+		mapReader{server.URL: "<path>foo.jpg</path><!-- --><path>bar.jpg</path> EOF"},
+	} {
+		input := make(chan string)
+		errors := make(chan error)
+		quit := make(chan struct{})
+		out := streamer(webReader, input, errors, quit, tmpfile.Name(), false)
+
+		input <- server.URL
+		expected := []map[string]interface{}{
+			{"path": "foo.jpg"},
+			{"path": "bar.jpg"},
+		}
+		select {
+		case err := <-errors:
+			t.Fatalf("Did not expect to receive an error, got %s", err)
+		case p := <-out:
+			if !reflect.DeepEqual(p.Fields, expected) {
+				t.Errorf("Output %+v does not match expected %+v", p.Fields, expected)
+			}
+			if p.Size != 52 {
+				t.Errorf("Expected the size to be 52, got %d", p.Size)
+			}
+		}
+		close(quit)
+	}
+}
+
+func TestStreamingProfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stream")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<path>a.jpg</path><path>b.jpg</path> EOF"))
+	}))
+	defer server.Close()
+
+	for name, content := range map[string]string{
+		"path.definition": "<path>{{path}}</path>",
+		"profiles.json":   `[{"name": "feed", "hosts": ["*"], "definitions": {"page": "path.definition"}, "stream": true, "reader": "http", "formatter": "json"}]`,
+		"bundle.json":     `[{"name": "feed", "hosts": ["*"], "definitions": {"page": "page.bundle"}, "stream": true, "formatter": "json"}]`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write %s: %s", name, err)
+		}
+	}
+
+	if _, err := LoadProfiles(filepath.Join(dir, "bundle.json")); err == nil {
+		t.Errorf("Expected an error streaming a bundle")
+	}
+
+	profiles, err := LoadProfiles(filepath.Join(dir, "profiles.json"))
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	input := make(chan string)
+	errors := make(chan error)
+	quit := make(chan struct{})
+	defer close(quit)
+	out := router(input, errors, quit, profiles)
+
+	input <- server.URL
+	select {
+	case err := <-errors:
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	case output := <-out:
+		b, _ := json.Marshal(output.Value)
+		if string(b) != `[{"path":"a.jpg"},{"path":"b.jpg"}]` {
+			t.Errorf("Expected both records, got %s", b)
+		}
+	}
+}
+
+func TestStreamingThroughFetchFlags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stream")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("<path>a.jpg</path><path>b.jpg</path> EOF"))
+	}))
+	defer server.Close()
+
+	for name, content := range map[string]string{
+		"path.definition": "<path>{{path}}</path>",
+		"profiles.json":   `[{"name": "feed", "hosts": ["*"], "definitions": {"page": "path.definition"}, "stream": true, "formatter": "json"}]`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write %s: %s", name, err)
+		}
+	}
+	profiles, err := LoadProfiles(filepath.Join(dir, "profiles.json"))
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+
+	// Every layer the flags add, on top of the default retries and robots.txt
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	fetch := newFetchFlags(flags)
+	err = flags.Parse([]string{
+		"-concurrency", "1",
+		"-cache", filepath.Join(dir, "cache"),
+		"-archive", filepath.Join(dir, "archive"),
+		"-warc", filepath.Join(dir, "pages.warc"),
+		"-record", filepath.Join(dir, "fixtures"),
+	})
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	fetching, err := fetch.apply(profiles)
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	defer fetching.Close()
+
+	if !streamable(profiles[0].WebReader(), &Request{URL: server.URL}) {
+		t.Fatalf("Expected the profile's reader to stream, got %T", profiles[0].WebReader())
+	}
+
+	input := make(chan string)
+	errors := make(chan error)
+	quit := make(chan struct{})
+	defer close(quit)
+	out := router(input, errors, quit, profiles)
+
+	input <- server.URL
+	select {
+	case err := <-errors:
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	case output := <-out:
+		b, _ := json.Marshal(output.Value)
+		if string(b) != `[{"path":"a.jpg"},{"path":"b.jpg"}]` {
+			t.Errorf("Expected both records, got %s", b)
+		}
+	}
+
+	// The layers which keep pages kept the streamed one
+	if entry, err := fetching.cache.get("feed", server.URL); err != nil || entry == nil {
+		t.Errorf("Expected the page to be cached, got %v (%v)", entry, err)
+	}
+	archive, err := OpenArchive(filepath.Join(dir, "archive"))
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	if body, err := archive.GetBody(server.URL); err != nil || body != "<path>a.jpg</path><path>b.jpg</path> EOF" {
+		t.Errorf("Expected the page to be archived, got %q (%v)", body, err)
+	}
+	if _, err := os.Stat(fixtureFile(filepath.Join(dir, "fixtures"), &Request{URL: server.URL})); err != nil {
+		t.Errorf("Expected the page to be recorded, got %s", err)
+	}
+	fetching.Close()
+	warc, err := OpenWARC(filepath.Join(dir, "pages.warc"))
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	if urls := warc.URLs(); !reflect.DeepEqual(urls, []string{server.URL}) {
+		t.Errorf("Expected the page in the WARC file, got %v", urls)
+	}
+}
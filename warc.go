@@ -0,0 +1,520 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WARCFile is a WARC file being written. When the file name ends in .gz each
+// record is gzipped on its own, as is usual for WARC files
+type WARCFile struct {
+	mu   sync.Mutex
+	f    *os.File
+	gzip bool
+}
+
+// CreateWARC creates a WARC file, starting it with a warcinfo record
+func CreateWARC(file string) (*WARCFile, error) {
+	f, err := os.Create(file)
+	if err != nil {
+		return nil, fmt.Errorf("could not create WARC file: %s", err)
+	}
+	w := &WARCFile{
+		f:    f,
+		gzip: strings.HasSuffix(file, ".gz"),
+	}
+
+	info := "software: github.com/ganners/scraper\r\nformat: WARC File Format 1.0\r\n"
+	err = w.writeRecord(warcRecord{
+		Type:        "warcinfo",
+		ContentType: "application/warc-fields",
+		Date:        time.Now(),
+		Extra:       [][2]string{{"WARC-Filename", filepath.Base(file)}},
+		Block:       []byte(info),
+	})
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// Write writes the request and response records for a response to a GET. A
+// response without a status (from a reader which doesn't know it) is written
+// as a resource record instead
+func (w *WARCFile) Write(resp *Response) error {
+	return w.WriteExchange(&Request{URL: resp.URL}, resp)
+}
+
+// WriteExchange is Write for the response to any request, which is written
+// with its method, headers and body
+func (w *WARCFile) WriteExchange(req *Request, resp *Response) error {
+	now := time.Now()
+
+	if resp.StatusCode == 0 {
+		contentType := resp.Header.Get("Content-Type")
+		if contentType == "" {
+			contentType = "text/html"
+		}
+		return w.writeRecord(warcRecord{
+			Type:        "resource",
+			TargetURI:   resp.URL,
+			ContentType: contentType,
+			Date:        now,
+			Block:       []byte(resp.Body),
+		})
+	}
+
+	u, err := url.Parse(resp.URL)
+	if err != nil {
+		return fmt.Errorf("could not parse url: %s", err)
+	}
+	var request bytes.Buffer
+	fmt.Fprintf(&request, "%s %s HTTP/1.1\r\nHost: %s\r\n", req.method(), u.RequestURI(), u.Host)
+	requestHeader := http.Header{}
+	for name, values := range req.Header {
+		requestHeader[name] = values
+	}
+	if req.Body != "" {
+		requestHeader.Set("Content-Length", strconv.Itoa(len(req.Body)))
+	}
+	requestHeader.Write(&request)
+	request.WriteString("\r\n")
+	request.WriteString(req.Body)
+
+	var response bytes.Buffer
+	fmt.Fprintf(&response, "HTTP/1.1 %d %s\r\n", resp.StatusCode, http.StatusText(resp.StatusCode))
+	header := http.Header{}
+	for name, values := range resp.Header {
+		header[name] = values
+	}
+	// The body has already been decoded and read in full
+	header.Del("Content-Encoding")
+	header.Del("Transfer-Encoding")
+	header.Set("Content-Length", strconv.Itoa(len(resp.Body)))
+	header.Write(&response)
+	response.WriteString("\r\n")
+	response.WriteString(resp.Body)
+
+	responseID := newWARCRecordID()
+	if err := w.writeRecord(warcRecord{
+		Type:        "response",
+		ID:          responseID,
+		TargetURI:   resp.URL,
+		ContentType: "application/http; msgtype=response",
+		Date:        now,
+		Extra:       [][2]string{{"WARC-Payload-Digest", warcDigest([]byte(resp.Body))}},
+		Block:       response.Bytes(),
+	}); err != nil {
+		return err
+	}
+	return w.writeRecord(warcRecord{
+		Type:        "request",
+		TargetURI:   resp.URL,
+		ContentType: "application/http; msgtype=request",
+		Date:        now,
+		Extra:       [][2]string{{"WARC-Concurrent-To", responseID}},
+		Block:       request.Bytes(),
+	})
+}
+
+// Close closes the WARC file
+func (w *WARCFile) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.f.Close()
+}
+
+// WARCWriter is a WebReader which writes every page that another one fetches
+// to a WARC file
+type WARCWriter struct {
+	WebReader
+	warc *WARCFile
+}
+
+// NewWARCWriter returns a reader which writes what webReader fetches to the
+// WARC file
+func NewWARCWriter(webReader WebReader, warc *WARCFile) *WARCWriter {
+	return &WARCWriter{
+		WebReader: webReader,
+		warc:      warc,
+	}
+}
+
+// Do makes the request and writes it and the page to the WARC file
+func (w *WARCWriter) Do(req *Request) (*Response, error) {
+	resp, err := doRequest(w.WebReader, req)
+	if err != nil {
+		return nil, err
+	}
+	if err := w.warc.WriteExchange(req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// GetResponse fetches the page and writes it to the WARC file
+func (w *WARCWriter) GetResponse(url string) (*Response, error) {
+	return w.Do(&Request{URL: url})
+}
+
+// GetBody fetches the body of the page and writes it to the WARC file
+func (w *WARCWriter) GetBody(url string) (string, error) {
+	resp, err := w.GetResponse(url)
+	if err != nil {
+		return "", err
+	}
+	return resp.Body, nil
+}
+
+// GetStream opens the body of the page, and writes it to the WARC file once
+// all of it has been read
+func (w *WARCWriter) GetStream(url string) (*Stream, error) {
+	stream, err := getStream(w.WebReader, url)
+	if err != nil {
+		return nil, err
+	}
+	return watchStream(stream, true, func(resp *Response) {
+		if resp == nil {
+			return
+		}
+		if err := w.warc.WriteExchange(&Request{URL: url}, resp); err != nil {
+			log.Printf("[Warning] Could not write %s to the WARC file: %s", url, err)
+		}
+	}), nil
+}
+
+// Streams when the other reader can
+func (w *WARCWriter) streams(url string) bool {
+	return canStream(w.WebReader, url)
+}
+
+// Writes every page which is fetched for the profiles to the WARC file
+func warcProfiles(profiles []*Profile, warc *WARCFile) {
+	for _, p := range profiles {
+		p.webReader = NewWARCWriter(p.WebReader(), warc)
+	}
+}
+
+// A warcRecord is a record to write
+type warcRecord struct {
+	Type        string
+	ID          string
+	TargetURI   string
+	ContentType string
+	Date        time.Time
+	Extra       [][2]string
+	Block       []byte
+}
+
+func (w *WARCFile) writeRecord(r warcRecord) error {
+	if r.ID == "" {
+		r.ID = newWARCRecordID()
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("WARC/1.0\r\n")
+	fmt.Fprintf(&buf, "WARC-Type: %s\r\n", r.Type)
+	fmt.Fprintf(&buf, "WARC-Record-ID: %s\r\n", r.ID)
+	fmt.Fprintf(&buf, "WARC-Date: %s\r\n", r.Date.UTC().Format(time.RFC3339))
+	if r.TargetURI != "" {
+		fmt.Fprintf(&buf, "WARC-Target-URI: %s\r\n", r.TargetURI)
+	}
+	for _, field := range r.Extra {
+		fmt.Fprintf(&buf, "%s: %s\r\n", field[0], field[1])
+	}
+	fmt.Fprintf(&buf, "WARC-Block-Digest: %s\r\n", warcDigest(r.Block))
+	fmt.Fprintf(&buf, "Content-Type: %s\r\n", r.ContentType)
+	fmt.Fprintf(&buf, "Content-Length: %d\r\n", len(r.Block))
+	buf.WriteString("\r\n")
+	buf.Write(r.Block)
+	buf.WriteString("\r\n\r\n")
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.gzip {
+		if _, err := w.f.Write(buf.Bytes()); err != nil {
+			return fmt.Errorf("could not write WARC record: %s", err)
+		}
+		return nil
+	}
+	gz := gzip.NewWriter(w.f)
+	if _, err := gz.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("could not write WARC record: %s", err)
+	}
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("could not write WARC record: %s", err)
+	}
+	return nil
+}
+
+// A random (version 4) UUID
+func newWARCRecordID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("<urn:uuid:%x-%x-%x-%x-%x>", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func warcDigest(b []byte) string {
+	sum := sha1.Sum(b)
+	return "sha1:" + base32.StdEncoding.EncodeToString(sum[:])
+}
+
+// WARCReader is a WebReader which replays the responses in a WARC file, such
+// as one from another crawler, without touching the network. When a request
+// was made more than once the last response is used. Requests other than a
+// GET (such as a POST of a form) are told apart by their request records
+//
+// Response, resource and request records are read, everything else is
+// skipped. The file can be gzipped, record by record or as a whole
+type WARCReader struct {
+	// By the key of their request (see requestKey)
+	responses map[string]*Response
+}
+
+// A record read from a WARC file: a response (or resource), or the request
+// which a response was for
+type warcRead struct {
+	id           string
+	concurrentTo []string
+	resp         *Response
+	req          *Request
+}
+
+// OpenWARC reads the responses of a WARC file
+func OpenWARC(file string) (*WARCReader, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("could not open WARC file: %s", err)
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	var r io.Reader = br
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("could not read WARC file: %s", err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	// Requests and responses name each other with WARC-Concurrent-To, in
+	// either order
+	var responses []*warcRead
+	requests := make(map[string]*Request)
+	records := bufio.NewReader(r)
+	for {
+		record, err := readWARCRecord(records)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not read %s: %s", file, err)
+		}
+		switch {
+		case record == nil:
+		case record.resp != nil:
+			responses = append(responses, record)
+		default:
+			for _, id := range append(record.concurrentTo, record.id) {
+				if id != "" {
+					requests[id] = record.req
+				}
+			}
+		}
+	}
+
+	w := &WARCReader{
+		responses: make(map[string]*Response),
+	}
+	for _, record := range responses {
+		var req *Request
+		for _, id := range append(record.concurrentTo, record.id) {
+			if req == nil && id != "" {
+				req = requests[id]
+			}
+		}
+		if req == nil {
+			req = &Request{URL: record.resp.URL}
+		}
+		w.responses[requestKey(req)] = record.resp
+	}
+	return w, nil
+}
+
+// Reads the next record, returning the response or request in it or nil if
+// it isn't one
+func readWARCRecord(r *bufio.Reader) (*warcRead, error) {
+	// Skip the blank lines between records
+	var version string
+	for version == "" {
+		line, err := r.ReadString('\n')
+		if err == io.EOF && strings.TrimSpace(line) == "" {
+			return nil, io.EOF
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unexpected end of record")
+		}
+		version = strings.TrimSpace(line)
+	}
+	if !strings.HasPrefix(version, "WARC/") {
+		return nil, fmt.Errorf("expected a WARC record, got %q", version)
+	}
+
+	fields := make(http.Header)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("unexpected end of record headers")
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid WARC header %q", line)
+		}
+		fields.Add(strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:]))
+	}
+
+	length, err := strconv.Atoi(fields.Get("Content-Length"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid Content-Length %q", fields.Get("Content-Length"))
+	}
+	block := make([]byte, length)
+	if _, err := io.ReadFull(r, block); err != nil {
+		return nil, fmt.Errorf("unexpected end of record block")
+	}
+
+	target := fields.Get("WARC-Target-URI")
+	// Some writers put the URI in angle brackets
+	target = strings.TrimSuffix(strings.TrimPrefix(target, "<"), ">")
+	record := &warcRead{
+		id:           fields.Get("WARC-Record-ID"),
+		concurrentTo: fields["Warc-Concurrent-To"],
+	}
+
+	switch fields.Get("WARC-Type") {
+	case "resource":
+		record.resp = &Response{
+			URL:    target,
+			Header: http.Header{"Content-Type": {fields.Get("Content-Type")}},
+			Body:   string(block),
+		}
+		return record, nil
+
+	case "request":
+		if !strings.HasPrefix(fields.Get("Content-Type"), "application/http") {
+			return nil, nil
+		}
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(block)))
+		if err != nil {
+			return nil, fmt.Errorf("could not read the request for %s: %s", target, err)
+		}
+		defer req.Body.Close()
+		b, err := ioutil.ReadAll(req.Body)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("could not read the request for %s: %s", target, err)
+		}
+		record.req = &Request{
+			Method: req.Method,
+			URL:    target,
+			Header: req.Header,
+			Body:   string(b),
+		}
+		return record, nil
+
+	case "response":
+		if !strings.HasPrefix(fields.Get("Content-Type"), "application/http") {
+			return nil, nil
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(block)), nil)
+		if err != nil {
+			return nil, fmt.Errorf("could not read the response for %s: %s", target, err)
+		}
+		defer resp.Body.Close()
+
+		var body io.Reader = resp.Body
+		if resp.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(resp.Body)
+			if err != nil {
+				return nil, fmt.Errorf("could not read the response for %s: %s", target, err)
+			}
+			defer gz.Close()
+			body = gz
+		}
+		b, err := ioutil.ReadAll(body)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("could not read the response for %s: %s", target, err)
+		}
+		record.resp = &Response{
+			URL:        target,
+			StatusCode: resp.StatusCode,
+			Header:     resp.Header,
+			Body:       string(b),
+		}
+		return record, nil
+	}
+	return nil, nil
+}
+
+// Do returns the response for the request from the WARC file
+func (w *WARCReader) Do(req *Request) (*Response, error) {
+	resp, found := w.responses[requestKey(req)]
+	if !found {
+		if !req.plain() {
+			return nil, fmt.Errorf("%s %s with that body is not in the WARC file", req.method(), req.URL)
+		}
+		return nil, fmt.Errorf("%s is not in the WARC file", req.URL)
+	}
+	return resp, nil
+}
+
+// GetResponse returns the response for the URL from the WARC file
+func (w *WARCReader) GetResponse(url string) (*Response, error) {
+	return w.Do(&Request{URL: url})
+}
+
+// GetBody returns the body for the URL from the WARC file
+func (w *WARCReader) GetBody(url string) (string, error) {
+	resp, err := w.GetResponse(url)
+	if err != nil {
+		return "", err
+	}
+	return resp.Body, nil
+}
+
+// URLs returns the URLs which have responses to a GET in the WARC file, in
+// order
+func (w *WARCReader) URLs() []string {
+	urls := make([]string, 0, len(w.responses))
+	for key, resp := range w.responses {
+		if key == resp.URL {
+			urls = append(urls, key)
+		}
+	}
+	sort.Strings(urls)
+	return urls
+}
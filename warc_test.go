@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWARC(t *testing.T) {
+	dir, err := ioutil.TempDir("", "warc")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"crawl.warc", "crawl.warc.gz"} {
+		file := filepath.Join(dir, name)
+		warc, err := CreateWARC(file)
+		if err != nil {
+			t.Fatalf("Did not expect to receive an error, got %s", err)
+		}
+
+		// A reader which only knows the body gives resource records
+		reader := NewWARCWriter(mapReader{"http://example.com/a": "<path>a.jpg</path>"}, warc)
+		if _, err := reader.GetBody("http://example.com/a"); err != nil {
+			t.Fatalf("Did not expect to receive an error, got %s", err)
+		}
+		if err := warc.Write(&Response{
+			URL:        "http://example.com/b?page=2",
+			StatusCode: 200,
+			Header:     http.Header{"Content-Type": {"text/html"}, "Content-Encoding": {"gzip"}},
+			Body:       "<path>b.jpg</path>",
+		}); err != nil {
+			t.Fatalf("Did not expect to receive an error, got %s", err)
+		}
+		if err := warc.Close(); err != nil {
+			t.Fatalf("Did not expect to receive an error, got %s", err)
+		}
+
+		replay, err := OpenWARC(file)
+		if err != nil {
+			t.Fatalf("Did not expect to receive an error reading %s, got %s", name, err)
+		}
+		if urls := replay.URLs(); !reflect.DeepEqual(urls, []string{"http://example.com/a", "http://example.com/b?page=2"}) {
+			t.Errorf("Expected both URLs in %s, got %v", name, urls)
+		}
+		body, err := replay.GetBody("http://example.com/a")
+		if err != nil || body != "<path>a.jpg</path>" {
+			t.Errorf("Expected the body of the resource in %s, got %q (%v)", name, body, err)
+		}
+		resp, err := replay.GetResponse("http://example.com/b?page=2")
+		if err != nil {
+			t.Fatalf("Did not expect to receive an error, got %s", err)
+		}
+		if resp.StatusCode != 200 || resp.Body != "<path>b.jpg</path>" || resp.Header.Get("Content-Type") != "text/html" {
+			t.Errorf("Expected the response in %s, got %+v", name, resp)
+		}
+		if resp.Header.Get("Content-Encoding") != "" {
+			t.Errorf("Expected the decoded response not to keep its Content-Encoding, got %s", resp.Header.Get("Content-Encoding"))
+		}
+		if _, err := replay.GetBody("http://example.com/c"); err == nil {
+			t.Errorf("Expected a URL which isn't in %s to fail", name)
+		}
+	}
+}
+
+func TestOpenWARC(t *testing.T) {
+	dir, err := ioutil.TempDir("", "warc")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Records as another crawler would write them, a chunked response and a
+	// gzipped one, with a request record (which names no response) and a
+	// metadata record to be skipped
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write([]byte("<path>gzipped.jpg</path>"))
+	gz.Close()
+
+	record := func(kind, target, contentType, block string) string {
+		return fmt.Sprintf("WARC/1.1\r\nWARC-Type: %s\r\nWARC-Target-URI: <%s>\r\nContent-Type: %s\r\nContent-Length: %d\r\n\r\n%s\r\n\r\n",
+			kind, target, contentType, len(block), block)
+	}
+	content := record("request", "http://example.com/chunked", "application/http; msgtype=request", "GET /chunked HTTP/1.1\r\n\r\n") +
+		record("response", "http://example.com/chunked", "application/http; msgtype=response",
+			"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n8\r\n<path>ch\r\ne\r\nunked.jpg</pat\r\n2\r\nh>\r\n0\r\n\r\n") +
+		record("metadata", "http://example.com/chunked", "application/warc-fields", "via: test\r\n") +
+		record("response", "http://example.com/gzipped", "application/http; msgtype=response",
+			"HTTP/1.1 404 Not Found\r\nContent-Encoding: gzip\r\nContent-Length: "+fmt.Sprint(gzipped.Len())+"\r\n\r\n"+gzipped.String())
+
+	file := filepath.Join(dir, "other.warc")
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write WARC file: %s", err)
+	}
+	replay, err := OpenWARC(file)
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	for url, expected := range map[string]string{
+		"http://example.com/chunked": "<path>chunked.jpg</path>",
+		"http://example.com/gzipped": "<path>gzipped.jpg</path>",
+	} {
+		if body, err := replay.GetBody(url); err != nil || body != expected {
+			t.Errorf("Expected %s to be %q, got %q (%v)", url, expected, body, err)
+		}
+	}
+	if resp, _ := replay.GetResponse("http://example.com/gzipped"); resp == nil || resp.StatusCode != 404 {
+		t.Errorf("Expected the status to be kept, got %+v", resp)
+	}
+
+	if err := ioutil.WriteFile(file, []byte(strings.Replace(content, "WARC/1.1", "HTTP/1.1", 1)), 0644); err != nil {
+		t.Fatalf("failed to write WARC file: %s", err)
+	}
+	if _, err := OpenWARC(file); err == nil {
+		t.Errorf("Expected an error reading something which isn't a WARC file")
+	}
+}
+
+func TestReparseWARC(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reparse")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "crawl.warc.gz")
+	warc, err := CreateWARC(file)
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	for url, body := range map[string]string{
+		"http://example.com/fruit": "<path>apricot.jpg</path><path>kiwi.jpg</path> EOF",
+		"http://other.com/":        "<path>other.jpg</path> EOF",
+	} {
+		if err := warc.Write(&Response{URL: url, StatusCode: 200, Body: body}); err != nil {
+			t.Fatalf("Did not expect to receive an error, got %s", err)
+		}
+	}
+	warc.Close()
+	if err := ioutil.WriteFile(filepath.Join(dir, "path.definition"), []byte("<path>{{path}}</path>"), 0644); err != nil {
+		t.Fatalf("failed to write definition: %s", err)
+	}
+
+	out := filepath.Join(dir, "out.ndjson")
+	err = reparseCommand([]string{
+		"-warc", file,
+		"-definition", filepath.Join(dir, "path.definition"),
+		"-url", "http://example.com/*",
+		"-sink", "ndjson:" + out,
+	})
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+
+	records, err := readNDJSON(out)
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	if len(records) != 2 || records[0]["path"] != "apricot.jpg" || records[1]["path"] != "kiwi.jpg" {
+		t.Errorf("Expected the records of the matching page, got %v", records)
+	}
+
+	if err := reparseCommand([]string{"-warc", file, "-archive", dir}); err == nil {
+		t.Errorf("Expected an error given both an archive and a WARC file")
+	}
+}
+
+func TestWARCPostRequest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "warc")
+	if err != nil {
+		t.Fatalf("failed to create tmp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "crawl.warc")
+	warc, err := CreateWARC(file)
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	req := &Request{
+		Method: "POST",
+		URL:    "http://example.com/search?page=1",
+		Header: http.Header{"Content-Type": {"application/x-www-form-urlencoded"}},
+		Body:   "q=apricot",
+	}
+	resp := &Response{URL: req.URL, StatusCode: 200, Header: http.Header{}, Body: "<path>a.jpg</path>"}
+	if err := warc.WriteExchange(req, resp); err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	warc.Close()
+
+	b, _ := ioutil.ReadFile(file)
+	expected := "POST /search?page=1 HTTP/1.1\r\nHost: example.com\r\nContent-Length: 9\r\nContent-Type: application/x-www-form-urlencoded\r\n\r\nq=apricot"
+	if !strings.Contains(string(b), expected) {
+		t.Errorf("Expected the request record to have the method, headers and body, got %s", b)
+	}
+
+	// Reading it back, the response is for the POST and not a GET
+	replay, err := OpenWARC(file)
+	if err != nil {
+		t.Fatalf("Did not expect to receive an error, got %s", err)
+	}
+	if got, err := replay.Do(req); err != nil || got.Body != resp.Body {
+		t.Errorf("Expected the response to the POST, got %+v (%v)", got, err)
+	}
+	if _, err := replay.GetResponse(req.URL); err == nil {
+		t.Errorf("Expected no response to a GET of %s", req.URL)
+	}
+	if urls := replay.URLs(); len(urls) != 0 {
+		t.Errorf("Expected no URLs which can be got, got %v", urls)
+	}
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"strings"
+	"sync"
 
 	"github.com/PuerkitoBio/goquery"
 	"github.com/headzoo/surf"
@@ -17,6 +21,221 @@ type WebReader interface {
 	GetBody(url string) (string, error)
 }
 
+// StreamReader is a WebReader which can also return the body as it arrives,
+// rather than reading all of it into memory first. A stream is only opened
+// for a page which was fetched fine, an error status is a StatusError
+type StreamReader interface {
+	WebReader
+	GetStream(url string) (*Stream, error)
+}
+
+// Stream is the body of a page as it arrives, with the status and headers
+// when the reader knows them. It has to be closed
+type Stream struct {
+	io.ReadCloser
+	URL        string
+	StatusCode int
+	Header     http.Header
+}
+
+// StatusError is the error for a page which the site gave an error status
+// for, when there is no response to give it in
+type StatusError struct {
+	URL        string
+	StatusCode int
+	Header     http.Header
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s gave %d %s", e.URL, e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// Response is a page as it was fetched, with the status and headers when the
+// reader knows them
+type Response struct {
+	URL        string
+	StatusCode int
+	Header     http.Header
+	Body       string
+}
+
+// ResponseReader is a WebReader which can also return the status and headers
+// of the page
+type ResponseReader interface {
+	WebReader
+	GetResponse(url string) (*Response, error)
+}
+
+// Request is a request for a page, with headers to send along with it. It is
+// a GET unless it has another method, such as a POST with a form in the body
+type Request struct {
+	Method string
+	URL    string
+	Header http.Header
+	Body   string
+
+	// Whether it can be sent again when it fails, although its method
+	// isn't one which can be
+	Retry bool
+}
+
+// Returns the method of the request
+func (r *Request) method() string {
+	if r.Method == "" {
+		return "GET"
+	}
+	return r.Method
+}
+
+// Returns whether the request is a GET with no body, which any reader can
+// make
+func (r *Request) plain() bool {
+	return r.method() == "GET" && r.Body == ""
+}
+
+// Returns whether sending the request again does no more than sending it
+// once, so that it can be retried
+func (r *Request) idempotent() bool {
+	switch r.method() {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return r.Retry
+}
+
+// RequestReader is a ResponseReader which can send headers with the request,
+// such as those for a conditional request, and requests other than a GET
+type RequestReader interface {
+	ResponseReader
+	Do(req *Request) (*Response, error)
+}
+
+// CookieReader is a WebReader which can keep cookies between requests, in a
+// jar which may be shared with other readers
+type CookieReader interface {
+	WebReader
+	WithCookies(jar http.CookieJar) WebReader
+}
+
+// Makes the request with any WebReader, those which can't send headers just
+// fetch the URL. Only a RequestReader can make requests other than a GET
+func doRequest(webReader WebReader, req *Request) (*Response, error) {
+	if r, ok := webReader.(RequestReader); ok {
+		return r.Do(req)
+	}
+	if !req.plain() {
+		return nil, fmt.Errorf("could not %s %s, the reader can only GET", req.method(), req.URL)
+	}
+	return getResponse(webReader, req.URL)
+}
+
+// Gets the response for a URL from any WebReader, those which can't give the
+// status and headers just give the body
+func getResponse(webReader WebReader, url string) (*Response, error) {
+	if r, ok := webReader.(ResponseReader); ok {
+		return r.GetResponse(url)
+	}
+	body, err := webReader.GetBody(url)
+	if err != nil {
+		return nil, err
+	}
+	return &Response{
+		URL:    url,
+		Header: http.Header{},
+		Body:   body,
+	}, nil
+}
+
+// Opens the body of a URL with any WebReader, as it arrives from those which
+// can stream and read in full from those which can't
+func getStream(webReader WebReader, url string) (*Stream, error) {
+	if s, ok := webReader.(StreamReader); ok {
+		return s.GetStream(url)
+	}
+	resp, err := getResponse(webReader, url)
+	if err != nil {
+		return nil, err
+	}
+	return responseStream(resp)
+}
+
+// Returns whether the reader can stream the URL. Readers which wrap another
+// can when it can, which they say with a streams method
+func canStream(webReader WebReader, url string) bool {
+	if w, ok := webReader.(interface{ streams(url string) bool }); ok {
+		return w.streams(url)
+	}
+	_, ok := webReader.(StreamReader)
+	return ok
+}
+
+// Returns a stream of a response which has already been read, or a
+// StatusError if it has an error status
+func responseStream(resp *Response) (*Stream, error) {
+	if resp.StatusCode >= 400 {
+		return nil, &StatusError{URL: resp.URL, StatusCode: resp.StatusCode, Header: resp.Header}
+	}
+	return &Stream{
+		ReadCloser: ioutil.NopCloser(strings.NewReader(resp.Body)),
+		URL:        resp.URL,
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+	}, nil
+}
+
+// Returns the stream with its body watched, so that closed is called once
+// when it is closed. With keep set what is read is held on to and given to
+// closed, as the response of the page if all of it was read or nil if not
+func watchStream(stream *Stream, keep bool, closed func(resp *Response)) *Stream {
+	watched := *stream
+	watched.ReadCloser = &watchedBody{
+		ReadCloser: stream.ReadCloser,
+		stream:     stream,
+		keep:       keep,
+		closed:     closed,
+	}
+	return &watched
+}
+
+// The body of a watched stream
+type watchedBody struct {
+	io.ReadCloser
+	stream *Stream
+	keep   bool
+	read   bytes.Buffer
+	whole  bool
+	once   sync.Once
+	closed func(resp *Response)
+}
+
+func (w *watchedBody) Read(p []byte) (int, error) {
+	n, err := w.ReadCloser.Read(p)
+	if w.keep {
+		w.read.Write(p[:n])
+	}
+	if err == io.EOF {
+		w.whole = true
+	}
+	return n, err
+}
+
+func (w *watchedBody) Close() error {
+	err := w.ReadCloser.Close()
+	w.once.Do(func() {
+		if !w.keep || !w.whole {
+			w.closed(nil)
+			return
+		}
+		w.closed(&Response{
+			URL:        w.stream.URL,
+			StatusCode: w.stream.StatusCode,
+			Header:     w.stream.Header,
+			Body:       w.read.String(),
+		})
+	})
+	return err
+}
+
 // PhantomReader uses gophantom to create a headless browser
 type PhantomReader struct {
 	phantom phantomgo.Phantomer
@@ -53,7 +272,9 @@ func (p *PhantomReader) GetBody(url string) (string, error) {
 
 // SurfReader uses surf, a browser which supports some DOM operations if
 // we wanted to scrape using CSS selectors
-type SurfReader struct{}
+type SurfReader struct {
+	jar http.CookieJar
+}
 
 // NewSurfReader returns a pointer to a SurfReader, no params required
 func NewSurfReader() *SurfReader {
@@ -61,10 +282,13 @@ func NewSurfReader() *SurfReader {
 }
 
 // GetBody will construct a browser and grab the contents from the URL
-func (SurfReader) GetBody(url string) (string, error) {
+func (s SurfReader) GetBody(url string) (string, error) {
 	// Create the browser on each request for a body, it would require
 	// locking otherwise
 	bow := surf.NewBrowser()
+	if s.jar != nil {
+		bow.SetCookieJar(s.jar)
+	}
 	err := bow.Open(url)
 	if err != nil {
 		return "", fmt.Errorf("could not open url: %s", err)
@@ -76,19 +300,30 @@ func (SurfReader) GetBody(url string) (string, error) {
 	return body, nil
 }
 
-// HttpReader will just use the built in http.Get
-type HttpReader struct{}
+// WithCookies returns a surf reader whose browsers share the jar, so that the
+// cookies outlive each of them
+func (SurfReader) WithCookies(jar http.CookieJar) WebReader {
+	return &SurfReader{jar: jar}
+}
+
+// HttpReader will just use the built in http client, with the options it was
+// made with (see NewHttpReaderWithOptions) if any
+type HttpReader struct {
+	client     *http.Client
+	header     http.Header
+	userAgents *userAgents
+}
 
 // Returns a http reader
 func NewHttpReader() *HttpReader {
 	return &HttpReader{}
 }
 
-// GetBody will just execute http.Get and return the body or an error
-func (HttpReader) GetBody(url string) (string, error) {
-	resp, err := http.Get(url)
+// GetBody will just execute a GET and return the body or an error
+func (h HttpReader) GetBody(url string) (string, error) {
+	resp, err := h.send(&Request{URL: url})
 	if err != nil {
-		return "", fmt.Errorf("could not get from url: %s", err)
+		return "", err
 	}
 	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
@@ -98,7 +333,112 @@ func (HttpReader) GetBody(url string) (string, error) {
 	return string(body), nil
 }
 
-// GoogleCacheReader will just use the built in http.Get, but will grab
+// GetResponse will execute a GET and return the body along with the status
+// and headers
+func (h HttpReader) GetResponse(url string) (*Response, error) {
+	return h.Do(&Request{URL: url})
+}
+
+// Do will execute the request and return the body along with the status and
+// headers
+func (h HttpReader) Do(req *Request) (*Response, error) {
+	resp, err := h.send(req)
+	if err != nil {
+		return nil, err
+	}
+	return readResponse(req.URL, resp)
+}
+
+// GetStream will execute a GET and return the unread body, which must be
+// closed by the caller. An error status is a StatusError, rather than the
+// body of the error page
+func (h HttpReader) GetStream(url string) (*Stream, error) {
+	resp, err := h.send(&Request{URL: url})
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		resp.Body.Close()
+		return nil, &StatusError{URL: url, StatusCode: resp.StatusCode, Header: resp.Header}
+	}
+	return &Stream{
+		ReadCloser: resp.Body,
+		URL:        url,
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+	}, nil
+}
+
+// WithCookies returns a copy of the reader which keeps cookies in the jar
+func (h HttpReader) WithCookies(jar http.CookieJar) WebReader {
+	client := http.Client{}
+	if h.client != nil {
+		client = *h.client
+	}
+	client.Jar = jar
+	h.client = &client
+	return &h
+}
+
+// Sends the request with its method, headers and body
+func (h HttpReader) send(req *Request) (*http.Response, error) {
+	var body io.Reader
+	if req.Body != "" {
+		body = strings.NewReader(req.Body)
+	}
+	httpReq, err := http.NewRequest(req.method(), req.URL, body)
+	if err != nil {
+		return nil, fmt.Errorf("could not create request: %s", err)
+	}
+	for name, values := range req.Header {
+		httpReq.Header[name] = values
+	}
+	return h.do(httpReq)
+}
+
+// Sends the request with the reader's headers and user agent, where the
+// request doesn't have its own
+func (h HttpReader) do(httpReq *http.Request) (*http.Response, error) {
+	for name, values := range h.header {
+		if _, found := httpReq.Header[name]; !found {
+			httpReq.Header[name] = values
+		}
+	}
+	if httpReq.Header.Get("User-Agent") == "" {
+		if h.userAgents != nil {
+			httpReq.Header.Set("User-Agent", h.userAgents.take())
+		} else {
+			httpReq.Header.Set("User-Agent", DefaultUserAgent)
+		}
+	}
+
+	client := h.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("could not get from url: %w", err)
+	}
+	return resp, nil
+}
+
+// Reads the body of the response, and closes it
+func readResponse(url string, resp *http.Response) (*Response, error) {
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("could not read response body: %w", err)
+	}
+	return &Response{
+		URL:        url,
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		Body:       string(body),
+	}, nil
+}
+
+// GoogleCacheReader will just use the HttpReader, but will grab
 // it from the Google cache so that all of the JS has been rendered
 // (i.e. SEO friendly version)
 type GoogleCacheReader struct {
@@ -110,15 +450,65 @@ func NewGoogleCacheReader() *GoogleCacheReader {
 	return &GoogleCacheReader{}
 }
 
-// GetBody will just execute http.Get and return the body or an error
+// GetBody will just execute a GET and return the body or an error
 func (g GoogleCacheReader) GetBody(url string) (string, error) {
+	newUrl, err := g.cacheUrl(url)
+	if err != nil {
+		return "", err
+	}
+	return g.HttpReader.GetBody(newUrl)
+}
+
+// GetResponse is GetBody with the status and headers of the cached page
+func (g GoogleCacheReader) GetResponse(url string) (*Response, error) {
+	return g.Do(&Request{URL: url})
+}
+
+// Do is GetResponse with the headers of the request. The cache only has
+// pages which can be got
+func (g GoogleCacheReader) Do(req *Request) (*Response, error) {
+	if !req.plain() {
+		return nil, fmt.Errorf("could not %s %s, the google cache only has pages which can be got", req.method(), req.URL)
+	}
+	newUrl, err := g.cacheUrl(req.URL)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := g.HttpReader.Do(&Request{URL: newUrl, Header: req.Header})
+	if err != nil {
+		return nil, err
+	}
+	resp.URL = req.URL
+	return resp, nil
+}
 
+// GetStream is GetBody without reading the body
+func (g GoogleCacheReader) GetStream(url string) (*Stream, error) {
+	newUrl, err := g.cacheUrl(url)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := g.HttpReader.GetStream(newUrl)
+	if err != nil {
+		return nil, err
+	}
+	stream.URL = url
+	return stream, nil
+}
+
+// WithCookies returns a copy of the reader which keeps cookies in the jar
+func (g GoogleCacheReader) WithCookies(jar http.CookieJar) WebReader {
+	g.HttpReader = *g.HttpReader.WithCookies(jar).(*HttpReader)
+	return &g
+}
+
+// Returns the URL of the page in the Google cache
+func (GoogleCacheReader) cacheUrl(url string) (string, error) {
 	if len(url) == 0 {
 		return "", errors.New("url length cannot be 0")
 	}
 
 	// e.g. http://webcache.googleusercontent.com/search?q=cache:vbGcdXhWHFsJ:www.sainsburys.co.uk/shop/gb/groceries/fruit-veg/ripe---ready+&amp;cd=1&amp;hl=en&amp;ct=clnk&amp;gl=uk
 	googleCacheUrl := "http://webcache.googleusercontent.com/search?q=cache:vbGcdXhWHFsJ:"
-	newUrl := fmt.Sprintf("%s%s", googleCacheUrl, url)
-	return g.HttpReader.GetBody(newUrl)
+	return fmt.Sprintf("%s%s", googleCacheUrl, url), nil
 }